@@ -0,0 +1,260 @@
+package vod
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrBusy = errors.New("too many ffmpeg processes")
+
+const (
+	// a remux counts as a quarter of a transcode.
+	transcodeCost = 4
+	remuxCost     = 1
+
+	defaultQueueTimeout = 30
+	// busyRetryAfter is the Retry-After seconds of ErrBusy responses.
+	busyRetryAfter = 5
+)
+
+// processClass is what the ffmpeg process costs.
+type processClass int
+
+const (
+	classRemux processClass = iota
+	classSoftware
+	classHardware
+)
+
+// admission limits the ffmpeg processes of the service. The requests over the limits wait in a queue ordered by
+// the priority then the arrival, the waiters fit in the freed budget are admitted, but the background ones wait
+// while any playback is waiting.
+type admission struct {
+	m        sync.Mutex
+	total    int // in cost units, 0 means unlimited
+	hardware int
+	software int
+	used     int
+	usedHW   int
+	usedSW   int
+	waiters  []*admissionWaiter // playback first, then by the arrival
+	timeout  time.Duration      // negative fails at once
+}
+
+type admissionWaiter struct {
+	contextID  string
+	class      processClass
+	background bool
+	ready      chan struct{} // closed once admitted
+}
+
+// newAdmission returns nil if nothing is limited.
+func newAdmission(config *ContextConfig) *admission {
+	if config.MaxTranscodes <= 0 && config.MaxHWTranscodes <= 0 && config.MaxSWTranscodes <= 0 {
+		return nil
+	}
+
+	timeout := config.QueueTimeout
+	if timeout == 0 {
+		timeout = defaultQueueTimeout
+	}
+
+	return &admission{
+		total:    max(config.MaxTranscodes, 0) * transcodeCost,
+		hardware: config.MaxHWTranscodes,
+		software: config.MaxSWTranscodes,
+		timeout:  time.Duration(timeout) * time.Second,
+	}
+}
+
+func (c processClass) cost() int {
+	if c == classRemux {
+		return remuxCost
+	}
+
+	return transcodeCost
+}
+
+// fits returns true if the budget is enough for the class, a.m must be held.
+func (a *admission) fits(class processClass) bool {
+	if a.total > 0 && a.used+class.cost() > a.total {
+		return false
+	}
+
+	switch class {
+	case classHardware:
+		return a.hardware <= 0 || a.usedHW < a.hardware
+	case classSoftware:
+		return a.software <= 0 || a.usedSW < a.software
+	}
+
+	return true
+}
+
+func (a *admission) take(class processClass, delta int) {
+	a.used += class.cost() * delta
+
+	switch class {
+	case classHardware:
+		a.usedHW += delta
+	case classSoftware:
+		a.usedSW += delta
+	}
+}
+
+// slot is the budget held by a process, it's released once.
+type slot struct {
+	once      sync.Once
+	admission *admission
+	class     processClass
+}
+
+func (s *slot) release() {
+	if s == nil {
+		return
+	}
+
+	s.once.Do(func() {
+		s.admission.m.Lock()
+		defer s.admission.m.Unlock()
+
+		s.admission.take(s.class, -1)
+		s.admission.dispatch()
+	})
+}
+
+// acquire takes the budget of the process, it waits in the queue up to the timeout, or until closed.
+// It returns a nil slot if nothing is limited.
+func (a *admission) acquire(contextID string, class processClass, background bool, closed <-chan bool) (*slot, error) {
+	if a == nil {
+		return nil, nil
+	}
+
+	a.m.Lock()
+
+	if a.fits(class) && (!background || !a.playbackWaiting()) {
+		a.take(class, 1)
+		a.m.Unlock()
+
+		return &slot{admission: a, class: class}, nil
+	}
+
+	timeout := a.timeout
+	if timeout < 0 {
+		a.m.Unlock()
+
+		return nil, ErrBusy
+	}
+
+	w := &admissionWaiter{contextID: contextID, class: class, background: background, ready: make(chan struct{})}
+	a.waiters = append(a.waiters, w)
+	sort.SliceStable(a.waiters, func(i, j int) bool {
+		return !a.waiters[i].background && a.waiters[j].background
+	})
+	a.m.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var err error
+
+	select {
+	case <-w.ready:
+		return &slot{admission: a, class: class}, nil
+	case <-timer.C:
+		err = ErrBusy
+	case <-closed:
+		err = ErrProcessStopped
+	}
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	// admitted at the same time.
+	select {
+	case <-w.ready:
+		return &slot{admission: a, class: class}, nil
+	default:
+	}
+
+	for i, waiter := range a.waiters {
+		if waiter == w {
+			a.waiters = append(a.waiters[:i], a.waiters[i+1:]...)
+
+			break
+		}
+	}
+
+	return nil, err
+}
+
+// playbackWaiting returns true if any playback is waiting, a.m must be held.
+func (a *admission) playbackWaiting() bool {
+	return len(a.waiters) > 0 && !a.waiters[0].background
+}
+
+// dispatch admits the waiters fit in the budget, a.m must be held.
+func (a *admission) dispatch() {
+	waiting := make([]*admissionWaiter, 0, len(a.waiters))
+	blocked := false // a playback is still waiting
+
+	for _, w := range a.waiters {
+		if (!w.background || !blocked) && a.fits(w.class) {
+			a.take(w.class, 1)
+			close(w.ready)
+
+			continue
+		}
+
+		if !w.background {
+			blocked = true
+		}
+		waiting = append(waiting, w)
+	}
+
+	a.waiters = waiting
+}
+
+// position returns the position of the first waiter of the context from 1, or 0 if it's not waiting.
+func (a *admission) position(contextID string) int {
+	if a == nil {
+		return 0
+	}
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	for i, w := range a.waiters {
+		if w.contextID == contextID {
+			return i + 1
+		}
+	}
+
+	return 0
+}
+
+// processClass returns the class of the ffmpeg process of the stream,
+// the audio transcode and the subtitle extraction are as cheap as a remux.
+func (s *Stream) processClass() processClass {
+	switch {
+	case s.subtitle != nil, !s.needTranscode(), s.audio != nil:
+		return classRemux
+	case s.encoderHWInfo().codec != HWAccelNone:
+		return classHardware
+	}
+
+	return classSoftware
+}
+
+// admit takes the budget of a new ffmpeg process of the stream.
+func (s *Stream) admit() (*slot, error) {
+	return s.context.admission.acquire(s.context.id, s.processClass(), s.context.background, s.context.closed)
+}
+
+// QueuePosition returns the position of the context in the ffmpeg queue from 1, or 0 if it's not waiting,
+// so the UI could show a wait message.
+func (c *Context) QueuePosition() int {
+	return c.admission.position(c.id)
+}
@@ -0,0 +1,132 @@
+package vod
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmissionLimits(t *testing.T) {
+	a := newAdmission(&ContextConfig{MaxTranscodes: 2, MaxHWTranscodes: 1, QueueTimeout: -1})
+
+	hw, err := a.acquire("a", classHardware, false, nil)
+	assert.NoError(t, err)
+	_, err = a.acquire("b", classHardware, false, nil)
+	assert.Equal(t, ErrBusy, err)
+
+	sw, err := a.acquire("c", classSoftware, false, nil)
+	assert.NoError(t, err)
+	_, err = a.acquire("d", classRemux, false, nil)
+	assert.Equal(t, ErrBusy, err)
+
+	// a transcode makes room for four remuxes.
+	sw.release()
+	sw.release()
+	for i := 0; i < transcodeCost/remuxCost; i++ {
+		_, err = a.acquire("d", classRemux, false, nil)
+		assert.NoError(t, err)
+	}
+	_, err = a.acquire("d", classRemux, false, nil)
+	assert.Equal(t, ErrBusy, err)
+
+	hw.release()
+	assert.Equal(t, 4, a.used)
+	assert.Nil(t, newAdmission(&ContextConfig{}))
+}
+
+func TestAdmissionQueuesPlaybackFirst(t *testing.T) {
+	a := newAdmission(&ContextConfig{MaxSWTranscodes: 1})
+	running, err := a.acquire("running", classSoftware, false, nil)
+	assert.NoError(t, err)
+
+	admitted := make(chan string, 2)
+	for _, waiter := range []struct {
+		id         string
+		background bool
+	}{{"job", true}, {"player", false}} {
+		go func() {
+			slot, err := a.acquire(waiter.id, classSoftware, waiter.background, nil)
+			assert.NoError(t, err)
+			admitted <- waiter.id
+			slot.release()
+		}()
+		assert.Eventually(t, func() bool {
+			return a.position(waiter.id) > 0
+		}, time.Second, time.Millisecond*10)
+	}
+
+	context := &Context{id: "player", admission: a}
+	assert.Equal(t, 1, context.QueuePosition())
+	assert.Equal(t, 2, a.position("job"))
+
+	// a remux doesn't wait for the software encoder, but the background one waits for the playback.
+	remux, err := a.acquire("remux", classRemux, false, nil)
+	assert.NoError(t, err)
+	remux.release()
+
+	a.m.Lock()
+	a.timeout = -1
+	a.m.Unlock()
+	_, err = a.acquire("remux", classRemux, true, nil)
+	assert.Equal(t, ErrBusy, err)
+
+	running.release()
+	assert.Equal(t, "player", <-admitted)
+	assert.Equal(t, "job", <-admitted)
+	assert.Equal(t, 0, context.QueuePosition())
+}
+
+func TestAdmissionWaiterLeavesOnClose(t *testing.T) {
+	a := newAdmission(&ContextConfig{MaxTranscodes: 1})
+	_, err := a.acquire("running", classSoftware, false, nil)
+	assert.NoError(t, err)
+
+	closed := make(chan bool)
+	result := make(chan error, 1)
+	go func() {
+		_, err := a.acquire("closed", classSoftware, false, closed)
+		result <- err
+	}()
+	assert.Eventually(t, func() bool {
+		return a.position("closed") == 1
+	}, time.Second, time.Millisecond*10)
+
+	close(closed)
+	assert.Equal(t, ErrProcessStopped, <-result)
+	assert.Equal(t, 0, a.position("closed"))
+}
+
+func TestStreamsShareTheBudget(t *testing.T) {
+	ffmpeg, _ := newFakeFFMpeg(t, "sleep 5")
+	a := newAdmission(&ContextConfig{MaxSWTranscodes: 1, QueueTimeout: -1})
+	info := testProbeInfo()
+	newLimitedContext := func(id string) *Context {
+		context := newTestContext(t, id, &ContextConfig{
+			FFMpegPath: ffmpeg,
+			HWAccel:    HWAccelNone,
+			StreamSpec: []StreamSpec{{Name: "force", Force: true}},
+		}, info)
+		context.admission = a
+		t.Cleanup(func() { _ = context.Close() })
+
+		return context
+	}
+
+	first := newLimitedContext("first")
+	assert.NoError(t, first.Stream("force").startProcess(0))
+
+	second := newLimitedContext("second")
+	_, err := second.Stream("force").Chunk(0, 0)
+	assert.Equal(t, ErrBusy, err)
+
+	recorder := httptest.NewRecorder()
+	writeError(recorder, err)
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, "5", recorder.Header().Get("Retry-After"))
+
+	assert.NoError(t, first.Close())
+	assert.NoError(t, second.Stream("force").startProcess(0))
+}
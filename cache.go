@@ -0,0 +1,364 @@
+package vod
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const cacheTmpSuffix = ".tmp"
+
+// segmentCache keeps the finished segments on disk across contexts, so rewatching or another viewer of
+// the same source doesn't transcode again. The least recently used segments are evicted once the total
+// size is over the limit. The access order is kept by the mtime of the files, so it survives restarts.
+type segmentCache struct {
+	m       sync.Mutex
+	dir     string
+	limit   int64
+	size    int64
+	lru     *list.List // front is the most recently used
+	entries map[string]*list.Element
+	logger  Logger
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+func newSegmentCache(dir string, limit int64, logger Logger) (*segmentCache, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	c := &segmentCache{
+		dir:     dir,
+		limit:   limit,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		logger:  logger,
+	}
+
+	return c, c.load()
+}
+
+// load rebuilds the lru from the files left by the previous run.
+func (c *segmentCache) load() error {
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	type file struct {
+		entry   cacheEntry
+		modTime time.Time
+	}
+
+	found := make([]file, 0, len(files))
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		// unfinished copy of the previous run
+		if strings.HasSuffix(f.Name(), cacheTmpSuffix) {
+			_ = os.Remove(filepath.Join(c.dir, f.Name()))
+
+			continue
+		}
+
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+
+		found = append(found, file{entry: cacheEntry{key: f.Name(), size: info.Size()}, modTime: info.ModTime()})
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].modTime.After(found[j].modTime)
+	})
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for _, f := range found {
+		c.entries[f.entry.key] = c.lru.PushBack(&f.entry)
+		c.size += f.entry.size
+	}
+	c.evict()
+
+	return nil
+}
+
+// get opens the cached segment, ok is false if it's not cached.
+func (c *segmentCache) get(key string) (io.ReadCloser, bool) {
+	c.m.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.m.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	path := filepath.Join(c.dir, key)
+
+	f, err := os.Open(path)
+	if err != nil {
+		// removed behind our back
+		c.remove(key)
+
+		return nil, false
+	}
+
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+
+	return f, true
+}
+
+// put adds the segment file to the cache. The file is hard linked if link is true and possible, so the stream could
+// remove its own copy as usual. The files ffmpeg rewrites in place, like the init segment, must not be linked.
+func (c *segmentCache) put(key, path string, link bool) error {
+	c.m.Lock()
+	_, ok := c.entries[key]
+	c.m.Unlock()
+
+	if ok {
+		return nil
+	}
+
+	target := filepath.Join(c.dir, key)
+	if err := linkOrCopy(path, target, link); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if _, ok := c.entries[key]; ok {
+		return nil
+	}
+
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, size: info.Size()})
+	c.size += info.Size()
+	c.evict()
+
+	return nil
+}
+
+func (c *segmentCache) remove(key string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.removeElement(e)
+	}
+}
+
+// evict removes the least recently used segments until the size is under the limit, c.m must be held.
+func (c *segmentCache) evict() {
+	for c.size > c.limit && c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *segmentCache) removeElement(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+
+	if err := os.Remove(filepath.Join(c.dir, entry.key)); err != nil && !os.IsNotExist(err) {
+		c.logger.Errorf("failed to remove cached segment %s: %v", entry.key, err)
+	}
+}
+
+func linkOrCopy(src, dst string, link bool) error {
+	if link {
+		if err := os.Link(src, dst); err == nil || os.IsExist(err) {
+			return nil
+		}
+	}
+
+	// different filesystems or not linked, copy to a tmp file first, so a partial file is never cached.
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + cacheTmpSuffix
+
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(out, in); err != nil {
+		_ = out.Close()
+		_ = os.Remove(tmp)
+
+		return err
+	}
+
+	if err = out.Close(); err != nil {
+		_ = os.Remove(tmp)
+
+		return err
+	}
+
+	return os.Rename(tmp, dst)
+}
+
+// cacheKey identifies the segment of the stream, the segment is only reusable if the source is not modified
+// and it's produced by the same spec, hardware acceleration, container and boundaries.
+// The init segment of fmp4 uses index -1, so does the whole WebVTT of the subtitle, which is only rendered by the jobs.
+func (s *Stream) cacheKey(index int) (string, bool) {
+	if s.context.cache == nil && s.context.contextConfig.SegmentStore == nil && s.context.output == nil {
+		return "", false
+	}
+
+	stat, err := s.context.sourceStat()
+	if err != nil {
+		return "", false
+	}
+
+	var (
+		track = -1
+		start float64
+		end   float64
+	)
+
+	if s.audio != nil {
+		track = s.audio.Index
+	}
+	if s.subtitle != nil {
+		track = s.subtitle.Index
+	}
+	if index >= 0 && index < len(s.context.chunks) {
+		start = s.context.chunks[index].start
+		end = start + s.context.chunks[index].duration
+	}
+
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%s%s|%d|%d|%+v|%d|%t|%s|%s|%s|%d|%.6f|%.6f",
+		s.context.path, stat.etag, stat.size, stat.modTime.UnixNano(),
+		s.spec, track, s.needTranscode(),
+		s.context.contextConfig.HWAccel, s.format, s.segmentContainer(),
+		index, start, end,
+	)
+
+	ext := ".ts"
+	if s.segmentContainer() == ContainerFMP4 {
+		ext = ".m4s"
+	}
+	if index < 0 {
+		ext = ".mp4"
+	}
+	if s.subtitle != nil {
+		ext = ".vtt"
+	}
+
+	return hex.EncodeToString(h.Sum(nil)) + ext, true
+}
+
+// cachedChunk returns the cached segment if any, the rendered output is checked first,
+// then the local cache and the segment store.
+func (s *Stream) cachedChunk(index int) (io.ReadCloser, bool) {
+	key, ok := s.cacheKey(index)
+	if !ok {
+		return nil, false
+	}
+
+	if r, ok := s.rendered(key); ok {
+		return r, true
+	}
+
+	if s.context.cache != nil {
+		if r, ok := s.context.cache.get(key); ok {
+			return r, true
+		}
+	}
+
+	store := s.context.contextConfig.SegmentStore
+	if store == nil {
+		return nil, false
+	}
+
+	r, err := store.Get(key)
+	if err != nil {
+		if !errors.Is(err, ErrSegmentNotFound) {
+			s.logger.Warnf("failed to get chunk %d from the store: %v", index, err)
+		}
+
+		return nil, false
+	}
+
+	return r, true
+}
+
+// cacheChunk stores the finished segment, it's called out of the lock since it may copy the file.
+// The init segment is rewritten in place by ffmpeg on every restart, so it's copied rather than linked or kept opened,
+// the numbered segments are never reopened.
+func (s *Stream) cacheChunk(index int, path string) {
+	key, ok := s.cacheKey(index)
+	if !ok {
+		return
+	}
+
+	rewritten := index < 0
+	if s.context.cache != nil {
+		if err := s.context.cache.put(key, path, !rewritten); err != nil {
+			s.logger.Errorf("failed to cache chunk %d: %v", index, err)
+		}
+	}
+
+	if store := s.context.contextConfig.SegmentStore; store != nil {
+		var r io.ReadCloser
+		if rewritten {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				s.logger.Errorf("failed to store chunk %d: %v", index, err)
+
+				return
+			}
+			r = io.NopCloser(bytes.NewReader(content))
+		} else {
+			// the opened file is still readable after the stream removes it.
+			f, err := os.Open(path)
+			if err != nil {
+				s.logger.Errorf("failed to store chunk %d: %v", index, err)
+
+				return
+			}
+			r = f
+		}
+
+		// the upload may be slow, ffmpeg must not wait for it.
+		go func() {
+			defer r.Close()
+
+			if err := store.Put(key, r); err != nil {
+				s.logger.Errorf("failed to store chunk %d: %v", index, err)
+			}
+		}()
+	}
+}
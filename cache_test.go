@@ -0,0 +1,107 @@
+package vod
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestSegment(t *testing.T, size int) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "0.ts")
+	assert.NoError(t, os.WriteFile(path, make([]byte, size), 0o600))
+
+	return path
+}
+
+func TestSegmentCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := newSegmentCache(dir, 25, NewEmptyLogger())
+	assert.NoError(t, err)
+
+	assert.NoError(t, cache.put("a", writeTestSegment(t, 10), true))
+	assert.NoError(t, cache.put("b", writeTestSegment(t, 10), true))
+
+	// a is used, so b is the one to evict
+	r, ok := cache.get("a")
+	assert.True(t, ok)
+	_ = r.Close()
+
+	assert.NoError(t, cache.put("c", writeTestSegment(t, 10), true))
+	_, ok = cache.get("b")
+	assert.False(t, ok)
+	assert.NoFileExists(t, filepath.Join(dir, "b"))
+	assert.Equal(t, int64(20), cache.size)
+
+	// the files are loaded by the next run, unfinished copies are removed.
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "d"+cacheTmpSuffix), []byte("x"), 0o600))
+	reloaded, err := newSegmentCache(dir, 25, NewEmptyLogger())
+	assert.NoError(t, err)
+	assert.Len(t, reloaded.entries, 2)
+	assert.NoFileExists(t, filepath.Join(dir, "d"+cacheTmpSuffix))
+}
+
+func TestServeChunkFromCache(t *testing.T) {
+	config := &ContextConfig{Format: FormatHLS}
+	info := testProbeInfo()
+	context := newTestContext(t, "cache", config, info)
+	// the key depends on the stat of the source.
+	context.path = "testdata/test.mp3"
+
+	cache, err := newSegmentCache(t.TempDir(), 1<<20, NewEmptyLogger())
+	assert.NoError(t, err)
+	context.cache = cache
+
+	stream := context.Stream("Origin")
+	key, ok := stream.cacheKey(1)
+	assert.True(t, ok)
+	other, _ := stream.cacheKey(2)
+	assert.NotEqual(t, key, other)
+
+	segment := filepath.Join(t.TempDir(), "1.ts")
+	assert.NoError(t, os.WriteFile(segment, []byte("cached segment"), 0o600))
+	stream.cacheChunk(1, segment)
+	// the stream removes its own copy, the cached one is still there.
+	assert.NoError(t, os.Remove(segment))
+
+	// no ffmpeg is started, FFMpegPath is empty.
+	r, err := stream.Chunk(1, 1)
+	assert.Equal(t, "cached segment", readAll(t, r, err))
+	assert.Nil(t, stream.cmd)
+}
+
+func TestCacheCopiesInitSegment(t *testing.T) {
+	store := NewMemoryStore(1 << 20)
+	context := newTestContext(t, "init", &ContextConfig{SegmentContainer: ContainerFMP4, SegmentStore: store}, testProbeInfo())
+	context.path = "testdata/test.mp3"
+
+	cache, err := newSegmentCache(t.TempDir(), 1<<20, NewEmptyLogger())
+	assert.NoError(t, err)
+	context.cache = cache
+
+	stream := context.Stream(Origin.Name)
+	key, ok := stream.cacheKey(-1)
+	assert.True(t, ok)
+
+	init := filepath.Join(t.TempDir(), initSegmentFile)
+	assert.NoError(t, os.WriteFile(init, []byte("first init"), 0o600))
+	stream.cacheChunk(-1, init)
+	assert.Eventually(t, func() bool {
+		_, err := store.Get(key)
+
+		return err == nil
+	}, time.Second, time.Millisecond*10)
+
+	// ffmpeg truncates and rewrites the same file once it restarts.
+	assert.NoError(t, os.WriteFile(init, []byte("second"), 0o600))
+
+	r, ok := cache.get(key)
+	assert.True(t, ok)
+	assert.Equal(t, "first init", readAll(t, r, nil))
+	r, err = store.Get(key)
+	assert.Equal(t, "first init", readAll(t, r, err))
+}
@@ -6,10 +6,12 @@ import (
 
 type tsChunk struct {
 	id       int
+	start    float64
 	duration float64
 	done     chan bool
 	f        *os.File
 	path     string
+	err      error // set before done is closed if the chunk will never be written
 }
 
 func (c *tsChunk) Read(p []byte) (int, error) {
@@ -24,6 +26,27 @@ func (c *tsChunk) Read(p []byte) (int, error) {
 	return c.f.Read(p)
 }
 
+// reader returns a new handle of the chunk, so the chunk could be read concurrently.
+func (c *tsChunk) reader() *tsChunk {
+	return &tsChunk{id: c.id, start: c.start, duration: c.duration, done: c.done, path: c.path}
+}
+
+// finished returns true if the chunk is written or failed.
+func (c *tsChunk) finished() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// fail wakes up the waiters with the error.
+func (c *tsChunk) fail(err error) {
+	c.err = err
+	close(c.done)
+}
+
 // Close the chunk fd
 func (c *tsChunk) Close() error {
 	f := c.f
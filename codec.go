@@ -0,0 +1,239 @@
+package vod
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The video codecs of StreamSpec.Codec, the names are the same as ffprobe codec_name.
+const (
+	CodecH264 = "h264"
+	CodecHEVC = "hevc"
+	CodecAV1  = "av1"
+	CodecVP9  = "vp9"
+)
+
+// audioCodecStrings are the RFC 6381 codec strings of the audio codecs, aac depends on the profile.
+var audioCodecStrings = map[string]string{
+	"mp3":  "mp4a.40.34",
+	"ac3":  "ac-3",
+	"eac3": "ec-3",
+	"opus": "Opus",
+	"flac": "fLaC",
+}
+
+// h264Profiles are the profile_idc and the constraint flags of the ffprobe profile names.
+var h264Profiles = map[string][2]int{
+	"Constrained Baseline":  {0x42, 0xe0},
+	"Baseline":              {0x42, 0x00},
+	"Main":                  {0x4d, 0x40},
+	"Extended":              {0x58, 0x00},
+	"High":                  {0x64, 0x00},
+	"High 10":               {0x6e, 0x00},
+	"High 4:2:2":            {0x7a, 0x00},
+	"High 4:4:4 Predictive": {0xf4, 0x00},
+}
+
+// videoCodec returns the codec of the video in the output.
+func (s *Stream) videoCodec() string {
+	if !s.needTranscode() {
+		return s.probe.VideoCodec
+	}
+	if s.spec.Codec == "" {
+		return CodecH264
+	}
+
+	return s.spec.Codec
+}
+
+// tonemap returns true if the HDR video is transcoded to SDR h264.
+func (s *Stream) tonemap() bool {
+	return s.audio == nil && s.probe.HDR() && s.videoCodec() == CodecH264
+}
+
+// deinterlace returns true if the interlaced video is deinterlaced, which needs the transcode.
+func (s *Stream) deinterlace() bool {
+	return s.audio == nil && s.probe.Interlaced() && s.context.contextConfig.Deinterlace != DeinterlaceNone
+}
+
+// frameRate returns the frame rate of the output, it's doubled if every field is a frame.
+func (s *Stream) frameRate() float64 {
+	if s.deinterlace() && s.context.contextConfig.doubleRate() && s.encoderHWInfo().codec != HWAccelQSV {
+		return s.probe.FrameRate * 2
+	}
+
+	return s.probe.FrameRate
+}
+
+// audioCodec returns the codec of the audio in the output, audio is always transcoded to aac.
+func (s *Stream) audioCodec() string {
+	codec := s.probe.AudioCodec
+	if s.audio != nil {
+		codec = s.audio.Codec
+	}
+	if s.needTranscode() || !s.supportAudioCodec(codec) {
+		return "aac"
+	}
+
+	return codec
+}
+
+// codecs returns the CODECS attribute of the stream, the audio is included if it's muxed with the video.
+func (s *Stream) codecs() string {
+	if s.audio != nil {
+		return audioCodecString(s.audioCodec(), s.audio.Profile)
+	}
+
+	codecs := s.videoCodecString()
+	if len(s.context.audios) == 0 && s.probe.AudioCodec != "" {
+		profile := ""
+		if track := s.probe.DefaultAudioTrack(); track != nil {
+			profile = track.Profile
+		}
+		codecs = codecs + "," + audioCodecString(s.audioCodec(), profile)
+	}
+
+	return codecs
+}
+
+// videoCodecString returns the codec string of the output video.
+// The copied video uses the probed profile and level, the transcoded one uses the defaults of the encoders,
+// which are 8 bit main profiles, and the level is estimated by the resolution.
+func (s *Stream) videoCodecString() string {
+	codec := s.videoCodec()
+	level := estimateLevel(codec, s.height, s.frameRate())
+
+	if s.needTranscode() {
+		return videoCodecString(codec, "", level, "")
+	}
+
+	if s.probe.VideoLevel > 0 {
+		level = s.probe.VideoLevel
+	}
+
+	return videoCodecString(codec, s.probe.VideoProfile, level, s.probe.PixelFormat)
+}
+
+func videoCodecString(codec, profile string, level int, pixelFormat string) string {
+	switch codec {
+	case CodecH264:
+		p, ok := h264Profiles[profile]
+		if !ok {
+			p = h264Profiles["High"]
+		}
+
+		return fmt.Sprintf("avc1.%02x%02x%02x", p[0], p[1], level)
+	case CodecHEVC:
+		if profile == "Main 10" {
+			return fmt.Sprintf("hvc1.2.4.L%d.B0", level)
+		}
+
+		return fmt.Sprintf("hvc1.1.6.L%d.B0", level)
+	case CodecAV1:
+		p := 0
+		switch profile {
+		case "High":
+			p = 1
+		case "Professional":
+			p = 2
+		}
+
+		return fmt.Sprintf("av01.%d.%02dM.%02d", p, level, bitDepth(pixelFormat))
+	case CodecVP9:
+		p := 0
+		if _, err := fmt.Sscanf(profile, "Profile %d", &p); err != nil {
+			p = 0
+		}
+
+		return fmt.Sprintf("vp09.%02d.%02d.%02d", p, level, bitDepth(pixelFormat))
+	}
+
+	return codec
+}
+
+func audioCodecString(codec, profile string) string {
+	if codec == "aac" {
+		switch profile {
+		case "HE-AAC":
+			return "mp4a.40.5"
+		case "HE-AACv2":
+			return "mp4a.40.29"
+		}
+
+		return "mp4a.40.2"
+	}
+
+	if c, ok := audioCodecStrings[codec]; ok {
+		return c
+	}
+
+	return codec
+}
+
+// bitDepth returns the bit depth of the pixel format, like yuv420p10le.
+func bitDepth(pixelFormat string) int {
+	switch {
+	case strings.Contains(pixelFormat, "12"):
+		return 12
+	case strings.Contains(pixelFormat, "10"):
+		return 10
+	}
+
+	return 8
+}
+
+// estimateLevel returns the level of the codec for the resolution and frame rate,
+// in the same unit as ffprobe: h264 and vp9 are level*10, hevc is level*30 and av1 is seq_level_idx.
+func estimateLevel(codec string, height int, frameRate float64) int {
+	high := 0
+	if frameRate > 30 {
+		high = 1
+	}
+
+	var levels [4]int
+
+	switch codec {
+	case CodecH264:
+		levels = [4]int{31 + high, 40 + 2*high, 50 + high, 51 + high}
+	case CodecHEVC:
+		levels = [4]int{93, 120 + 3*high, 150 + 3*high, 180}
+	case CodecAV1:
+		levels = [4]int{5, 8 + high, 12 + high, 16}
+	case CodecVP9:
+		levels = [4]int{31, 40 + high, 50 + high, 60}
+	default:
+		return 0
+	}
+
+	switch {
+	case height <= 720:
+		return levels[0]
+	case height <= 1080:
+		return levels[1]
+	case height <= 2160:
+		return levels[2]
+	}
+
+	return levels[3]
+}
+
+// encoderHWInfo returns the backend encoding the target codec.
+// If the configured backend doesn't support the codec, the software encoder is used, and the decoding too,
+// since the software encoder can't read the frames in the gpu memory.
+// After the hardware encoder keeps crashing, the stream is switched to software by the supervisor.
+func (s *Stream) encoderHWInfo() hwInfo {
+	if s.softwareOnly.Load() {
+		return allHWInfos[HWAccelNone]
+	}
+
+	hwAccel, ok := allHWInfos[s.context.contextConfig.HWAccel]
+	if !ok {
+		hwAccel = allHWInfos[HWAccelNone]
+	}
+
+	if _, ok := hwAccel.encoder(s.spec.Codec); !ok {
+		return allHWInfos[HWAccelNone]
+	}
+
+	return hwAccel
+}
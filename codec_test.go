@@ -0,0 +1,206 @@
+package vod
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetCodecEncoderArgs(t *testing.T) {
+	hevc := StreamSpec{Name: "HEVC", Codec: CodecHEVC}
+	av1 := StreamSpec{Name: "AV1", Codec: CodecAV1}
+	config := &ContextConfig{Format: FormatHLS, StreamSpec: []StreamSpec{hevc, av1}, HWAccel: HWAccelVAAPI}
+	info := testProbeInfo()
+	context := newTestContext(t, "codec", config, info)
+
+	stream := context.Stream("HEVC")
+	assert.True(t, stream.needTranscode())
+	assert.Equal(t, ContainerTS, stream.segmentContainer())
+	args := stream.buildFFMpegArgs(0, true, FormatHLS, false)
+	assert.Subset(t, args, []string{"-hwaccel", "vaapi", "-c:v", "hevc_vaapi", "-global_quality", "25"})
+	assert.NotContains(t, args, "hvc1")
+
+	stream = context.Stream("AV1")
+	assert.Equal(t, ContainerFMP4, stream.segmentContainer())
+	assert.Equal(t, "video/mp4", stream.ChunkMimeType())
+
+	// VideoToolBox can't encode av1, so both decoding and encoding fallback to software.
+	context.contextConfig.HWAccel = HWAccelVTB
+	args = stream.buildFFMpegArgs(0, true, FormatHLS, false)
+	assert.Subset(t, args, []string{"-c:v", "libsvtav1"})
+	assert.NotContains(t, args, "-hwaccel")
+
+	r, err := context.Content()
+	master := readAll(t, r, err)
+	assert.Contains(t, master, `CODECS="hvc1.1.6.L120.B0,mp4a.40.2"`)
+	assert.Contains(t, master, `CODECS="av01.0.08M.08,mp4a.40.2"`)
+}
+
+func TestTargetCodecCopiesSameCodec(t *testing.T) {
+	config := &ContextConfig{Format: FormatHLS, SegmentContainer: ContainerFMP4, StreamSpec: []StreamSpec{{Name: "HEVC", Codec: CodecHEVC}}}
+	info := &ProbeInfo{Duration: 20, Width: 1920, Height: 1080, VideoCodec: "hevc", AudioCodec: "aac"}
+	context := newTestContext(t, "copy", config, info)
+
+	stream := context.Stream("HEVC")
+	assert.False(t, stream.needTranscode())
+	assert.Equal(t, "hvc1.1.6.L120.B0,mp4a.40.2", stream.codecs())
+	assert.Subset(t, stream.buildFFMpegArgs(0, false, FormatHLS, false), []string{"-c", "copy", "-tag:v", "hvc1"})
+}
+
+func TestHDRTonemapsToSDRH264(t *testing.T) {
+	config := &ContextConfig{
+		Format:     FormatHLS,
+		HWAccel:    HWAccelNone,
+		StreamSpec: []StreamSpec{{Name: "720p", Width: 1280, Height: 720}, {Name: "HEVC", Codec: CodecHEVC, Force: true}},
+	}
+	info := &ProbeInfo{
+		Duration: 20, Width: 3840, Height: 2160, VideoCodec: "hevc", AudioCodec: "aac", PixelFormat: "yuv420p10le",
+		ColorTransfer: "smpte2084", ColorPrimaries: "bt2020", ColorSpace: "bt2020nc",
+	}
+	context := newTestContext(t, "hdr", config, info)
+
+	stream := context.Stream("720p")
+	assert.True(t, stream.tonemap())
+	args := stream.buildFFMpegArgs(0, true, FormatHLS, false)
+	assert.Subset(t, args, tonemapArgs(transferPQ, 1280, 720))
+	assert.Subset(t, args, []string{"-color_primaries", "bt709", "-color_trc", "bt709", "-colorspace", "bt709"})
+	assert.NotContains(t, args, scaleArgs(1280, 720)[1])
+
+	context.contextConfig.HWAccel = HWAccelVAAPI
+	assert.Subset(t, stream.buildFFMpegArgs(0, true, FormatHLS, false), tonemapVAAPI(transferPQ, 1280, 720))
+
+	// tonemap_vaapi doesn't map HLG, it's mapped on the cpu between the vaapi decoder and encoder.
+	info.ColorTransfer = transferHLG
+	args = stream.buildFFMpegArgs(0, true, FormatHLS, false)
+	assert.Subset(t, args, tonemapVAAPI(transferHLG, 1280, 720))
+	assert.Contains(t, tonemapVAAPI(transferHLG, 1280, 720)[1], "hwdownload,format=p010le,"+tonemapArgs(transferHLG, 0, 0)[1]+",hwupload")
+	assert.NotContains(t, tonemapVAAPI(transferHLG, 1280, 720)[1], "tonemap_vaapi")
+	context.contextConfig.HWAccel = HWAccelVAAPILP
+	assert.Subset(t, stream.buildFFMpegArgs(0, true, FormatHLS, false), tonemapVAAPI(transferHLG, 1280, 720))
+
+	// the hevc output keeps the HDR.
+	assert.False(t, context.Stream("HEVC").tonemap())
+
+	// SDR sources are scaled as before.
+	info.ColorTransfer = "bt709"
+	assert.False(t, stream.tonemap())
+	assert.Subset(t, stream.buildFFMpegArgs(0, true, FormatHLS, false), scaleVAAPI(1280, 720))
+}
+
+func TestInterlacedSourceIsDeinterlaced(t *testing.T) {
+	config := &ContextConfig{
+		Format:     FormatHLS,
+		HWAccel:    HWAccelNone,
+		StreamSpec: []StreamSpec{Origin, {Name: "sd", Width: 640, Height: 512}},
+	}
+	info := &ProbeInfo{Duration: 20, Width: 720, Height: 576, VideoCodec: "h264", AudioCodec: "aac", FrameRate: 25, FieldOrder: "tt"}
+	context := newTestContext(t, "interlaced", config, info)
+
+	// the origin is transcoded only to deinterlace.
+	origin := context.Stream(Origin.Name)
+	assert.True(t, origin.needTranscode())
+	assert.Subset(t, origin.buildFFMpegArgs(0, true, FormatHLS, false), []string{"-vf", "bwdif=mode=send_frame:deint=interlaced"})
+	assert.Equal(t, 25.0, origin.frameRate())
+
+	config.Deinterlace = DeinterlaceYADIF
+	double := true
+	config.DeinterlaceDoubleRate = &double
+	stream := context.Stream("sd")
+	assert.Subset(t, stream.buildFFMpegArgs(0, true, FormatHLS, false),
+		[]string{"-vf", "yadif=mode=send_field:deint=interlaced," + scaleArgs(640, 512)[1]})
+	assert.Equal(t, 50.0, stream.frameRate())
+
+	r, err := context.Content()
+	assert.Contains(t, readAll(t, r, err), "FRAME-RATE=50.000")
+
+	config.HWAccel = HWAccelVAAPI
+	assert.Subset(t, stream.buildFFMpegArgs(0, true, FormatHLS, false),
+		[]string{"-vf", "format=nv12|vaapi,hwupload,deinterlace_vaapi=rate=field," + scaleVAAPI(640, 512)[1]})
+
+	config.Deinterlace = DeinterlaceNone
+	assert.False(t, origin.needTranscode())
+
+	config.Deinterlace = ""
+	info.FieldOrder = "progressive"
+	assert.False(t, origin.needTranscode())
+}
+
+func TestInterlacedHDRIsDeinterlacedBeforeTonemap(t *testing.T) {
+	config := &ContextConfig{Format: FormatHLS, HWAccel: HWAccelVAAPI, StreamSpec: []StreamSpec{{Name: "720p", Width: 1280, Height: 720}}}
+	info := &ProbeInfo{
+		Duration: 20, Width: 1920, Height: 1080, VideoCodec: "hevc", AudioCodec: "aac", FrameRate: 25, FieldOrder: "tt",
+		PixelFormat: "yuv420p10le", ColorTransfer: transferPQ, ColorPrimaries: "bt2020", ColorSpace: "bt2020nc",
+	}
+	context := newTestContext(t, "interlaced-hdr", config, info)
+	stream := context.Stream("720p")
+	assert.True(t, stream.tonemap())
+
+	// the deinterlaced frames are still p010 when they are tonemapped.
+	assert.Subset(t, stream.buildFFMpegArgs(0, true, FormatHLS, false),
+		[]string{"-vf", "format=p010|vaapi,hwupload,deinterlace_vaapi=rate=frame," + tonemapVAAPI(transferPQ, 1280, 720)[1]})
+
+	config.HWAccel = HWAccelNVENC
+	args := stream.buildFFMpegArgs(0, true, FormatHLS, false)
+	assert.Subset(t, args, []string{"-vf", "format=p010|cuda,hwupload,yadif_cuda=mode=send_frame:deint=interlaced," +
+		tonemapNVENC(transferPQ, 1280, 720)[1]})
+	assert.NotContains(t, strings.Join(args, " "), "nv12|cuda,hwupload,yadif_cuda")
+
+	// the opencl tonemap sets the filter device, so qsv deinterlaces on the cpu.
+	config.HWAccel = HWAccelQSV
+	args = stream.buildFFMpegArgs(0, true, FormatHLS, false)
+	assert.Subset(t, args, []string{"-vf", "bwdif=mode=send_frame:deint=interlaced," + tonemapOpenCL(transferPQ, 1280, 720)[5]})
+	assert.NotContains(t, strings.Join(args, " "), "deinterlace_qsv")
+
+	config.HWAccel = HWAccelNone
+	assert.Subset(t, stream.buildFFMpegArgs(0, true, FormatHLS, false),
+		[]string{"-vf", "bwdif=mode=send_frame:deint=interlaced," + tonemapArgs(transferPQ, 1280, 720)[1]})
+}
+
+func TestContextTurnsOffDoubleRate(t *testing.T) {
+	double, single := true, false
+	service := newTestService(t)
+	service.config.DeinterlaceDoubleRate = &double
+
+	assert.True(t, service.mergeConfig(&ContextConfig{}).doubleRate())
+	assert.False(t, service.mergeConfig(&ContextConfig{DeinterlaceDoubleRate: &single}).doubleRate())
+}
+
+func TestVideoCodecString(t *testing.T) {
+	assert.Equal(t, "avc1.64001f", videoCodecString(CodecH264, "High", 31, "yuv420p"))
+	assert.Equal(t, "avc1.4d4028", videoCodecString(CodecH264, "Main", 40, "yuv420p"))
+	assert.Equal(t, "avc1.42e01e", videoCodecString(CodecH264, "Constrained Baseline", 30, "yuv420p"))
+	assert.Equal(t, "hvc1.2.4.L150.B0", videoCodecString(CodecHEVC, "Main 10", 150, "yuv420p10le"))
+	assert.Equal(t, "av01.0.08M.10", videoCodecString(CodecAV1, "Main", 8, "yuv420p10le"))
+	assert.Equal(t, "vp09.02.40.10", videoCodecString(CodecVP9, "Profile 2", 40, "yuv420p10le"))
+	assert.Equal(t, "mp4a.40.5", audioCodecString("aac", "HE-AAC"))
+	assert.Equal(t, "ec-3", audioCodecString("eac3", ""))
+	assert.Equal(t, 42, estimateLevel(CodecH264, 1080, 60))
+}
+
+func TestMasterPlaylistBandwidthAndCodecs(t *testing.T) {
+	config := &ContextConfig{
+		Format:     FormatHLS,
+		StreamSpec: []StreamSpec{Origin, {Name: "720P", Width: 1280, Height: 720, Bitrate: 2000000}},
+	}
+	info := &ProbeInfo{
+		Duration: 20, Width: 1920, Height: 1080, VideoCodec: "h264", AudioCodec: "aac", FrameRate: 25,
+		VideoProfile: "Main", VideoLevel: 40, VideoBitrate: 5000000, AudioBitrate: 192000,
+		AudioTracks: []AudioTrack{{Index: 1, Codec: "aac", Key: "audio-0", Profile: "LC", Bitrate: 192000}},
+	}
+	context := newTestContext(t, "bandwidth", config, info)
+
+	r, err := context.Content()
+	master := readAll(t, r, err)
+	assert.Contains(t, master, `BANDWIDTH=5192000,AVERAGE-BANDWIDTH=5192000,RESOLUTION=1920x1080,FRAME-RATE=25.000,CODECS="avc1.4d4028,mp4a.40.2"`)
+	// the bitrate is scaled by the pixels, the audio is transcoded with the default bitrate.
+	assert.Contains(t, master, `BANDWIDTH=3525333,AVERAGE-BANDWIDTH=2350222,RESOLUTION=1280x720,FRAME-RATE=25.000,CODECS="avc1.64001f,mp4a.40.2"`)
+
+	// once the segments are produced, they are measured.
+	stream := context.Stream("Origin")
+	stream.sizes[0] = 3000000 // 6s
+	stream.sizes[1] = 1500000
+	peak, average := stream.Bandwidth()
+	assert.Equal(t, 4000000, peak)
+	assert.Equal(t, 3000000, average)
+}
@@ -5,8 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
-	"path/filepath"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -35,6 +36,9 @@ var (
 // otherwise, it will ignore the spec.
 // if scale and width are set both, the width and height will be ignored.
 // if width/height does not fit the aspect ratio, the height will be adjusted.
+// Codec is the target video codec when transcoding, CodecH264, CodecHEVC, CodecAV1 or CodecVP9, default is CodecH264.
+// If Codec is set, the source with the same codec is copied, it means the clients of the spec support it.
+// The hls segments of CodecAV1 and CodecVP9 are always fmp4, since mpegts can't carry them.
 type StreamSpec struct {
 	Name    string
 	Width   int
@@ -42,6 +46,7 @@ type StreamSpec struct {
 	Force   bool
 	Bitrate int     // not used yet
 	Scale   float64 // not used yet
+	Codec   string
 }
 
 type ContextConfig struct {
@@ -53,14 +58,39 @@ type ContextConfig struct {
 	SupportVideoCodec []string // default is h264
 	SupportAudioCodec []string // default is aac
 
+	// dash only config, the segments are always fmp4
+	TemplateGenerator TemplateGenerator
+
 	// hls only config
 	ListGenerator ListGenerator
 	TSGenerator   TSGenerator
+	// SegmentContainer is the container of the segments, ContainerTS or ContainerFMP4, default is ContainerTS.
+	// ContainerFMP4 serves an init segment through InitGenerator urls.
+	SegmentContainer string
+	InitGenerator    InitGenerator
+	// Encryption encrypts the segments if it's EncryptionAES128, the key is issued by KeyProvider per context,
+	// default is RandomKeyProvider, and served through KeyGenerator urls.
+	Encryption   string
+	KeyProvider  KeyProvider
+	KeyGenerator KeyGenerator
+
+	// Trickplay enables the thumbnail sprite sheets if it's not nil,
+	// hls also advertises them by #EXT-X-IMAGE-STREAM-INF.
+	Trickplay       *TrickplayConfig
+	SpriteGenerator SpriteGenerator
+
 	ChunkDuration int
 	MaxBuffer     int
 	MinBuffer     int
-	// TODO do we give user a callback when the context is idle for a while
-	IdleTimeout int // in second
+	// Deinterlace is the software filter of the interlaced sources, DeinterlaceBWDIF, DeinterlaceYADIF or DeinterlaceNone,
+	// default is DeinterlaceBWDIF. The interlaced sources are always transcoded unless it's DeinterlaceNone.
+	// DeinterlaceDoubleRate outputs a frame per field, like 50fps of 25i, it's ignored by QSV.
+	// It's a pointer so a context could turn it off, nil uses the config of the service.
+	Deinterlace           string
+	DeinterlaceDoubleRate *bool
+	// IdleTimeout closes the context after it's not accessed for a while, 0 means never, in second.
+	// The context is not idle while a mp4 response is still being read.
+	IdleTimeout int
 
 	// The config below should be service level
 	// HWAccel is the hardware acceleration, default is auto
@@ -73,22 +103,64 @@ type ContextConfig struct {
 	// Allowing the user to override the default tmp path and ffmpeg path
 	FFMpegPath  string
 	FFProbePath string
+	// CachePath keeps the finished segments across contexts, the cache is disabled if it's empty.
+	// The least recently used segments are removed once the cache is over CacheSize bytes.
+	// Unlike TmpPath, it's not cleaned by the service, so it's better not to share it with TmpPath.
+	CachePath string
+	CacheSize int64
+	// SegmentStore also keeps the finished segments, like DiskStore, MemoryStore or S3Store.
+	// It's checked after the local cache, so a shared store lets the nodes reuse the output of each other.
+	SegmentStore SegmentStore
+	// OutputPath keeps the renditions pre-transcoded by the jobs of Service.AddJob, the jobs are disabled if it's empty.
+	// The contexts serve the rendered segments before transcoding, nothing is removed from it by the service.
+	// JobWorkers is the number of jobs running at the same time, default is 1.
+	OutputPath string
+	JobWorkers int
+	// MaxTranscodes limits the ffmpeg processes of the service, a remux counts as a quarter of a transcode.
+	// MaxHWTranscodes and MaxSWTranscodes limit the transcodes by the hardware and the software encoders.
+	// 0 means unlimited. The processes over the limits wait up to QueueTimeout seconds then fail with ErrBusy,
+	// default is 30, negative fails at once. The playback goes before the jobs.
+	MaxTranscodes   int
+	MaxHWTranscodes int
+	MaxSWTranscodes int
+	QueueTimeout    int
+	// Load samples the host and adapts the transcoding to the load, it's disabled if nil, see LoadConfig.
+	Load *LoadConfig
+	// SourceHeader adds the headers to the requests of the remote sources, which are http(s) urls.
+	// SourceClient requests them, default is http.DefaultClient.
+	SourceHeader SourceHeader
+	SourceClient *http.Client
+	// ThumbnailFormat is the format of Service.Thumbnail, ImageJPEG, ImagePNG or ImageWebP, default is ImageJPEG.
+	ThumbnailFormat string
+	// Signer signs the urls served by Service.Handler, the urls are not signed if it's nil.
+	Signer *URLSigner
+	// Metrics collects the metrics served by Service.MetricsHandler, it's disabled by default.
+	Metrics bool
 }
 
 var (
-	ErrEmptyConfig     = errors.New("config is nil")
-	ErrFFMpegPath      = errors.New("ffmpeg path is empty")
-	ErrFormat          = errors.New("format is empty")
-	ErrListGenerator   = errors.New("list generator is nil")
-	ErrTSGenerator     = errors.New("ts generator is nil")
-	ErrChunkDuration   = errors.New("chunk duration is 0")
-	ErrMaxBuffer       = errors.New("max buffer is 0")
-	ErrMinBuffer       = errors.New("min buffer is 0")
-	ErrTmpPath         = errors.New("tmp path is empty")
-	ErrUnknownStrategy = errors.New("strategy is unknown")
-	ErrStreamSpec      = errors.New("stream spec is empty")
+	ErrEmptyConfig       = errors.New("config is nil")
+	ErrFFMpegPath        = errors.New("ffmpeg path is empty")
+	ErrFormat            = errors.New("format is empty")
+	ErrListGenerator     = errors.New("list generator is nil")
+	ErrTSGenerator       = errors.New("ts generator is nil")
+	ErrInitGenerator     = errors.New("init generator is nil")
+	ErrTemplateGenerator = errors.New("template generator is nil")
+	ErrKeyGenerator      = errors.New("key generator is nil")
+	ErrContainer         = errors.New("segment container is unknown")
+	ErrChunkDuration     = errors.New("chunk duration is 0")
+	ErrMaxBuffer         = errors.New("max buffer is 0")
+	ErrMinBuffer         = errors.New("min buffer is 0")
+	ErrTmpPath           = errors.New("tmp path is empty")
+	ErrUnknownStrategy   = errors.New("strategy is unknown")
+	ErrStreamSpec        = errors.New("stream spec is empty")
 )
 
+// doubleRate returns true if a frame is output per field.
+func (c *ContextConfig) doubleRate() bool {
+	return c.DeinterlaceDoubleRate != nil && *c.DeinterlaceDoubleRate
+}
+
 func (c *ContextConfig) valid() error {
 	if c == nil {
 		return ErrEmptyConfig
@@ -102,7 +174,8 @@ func (c *ContextConfig) valid() error {
 		return ErrFormat
 	}
 
-	if c.Format == FormatHLS {
+	switch c.Format {
+	case FormatHLS:
 		switch {
 		case c.ListGenerator == nil:
 			return ErrListGenerator
@@ -116,7 +189,34 @@ func (c *ContextConfig) valid() error {
 			return ErrMinBuffer
 		case c.TmpPath == "":
 			return ErrTmpPath
+		case c.SegmentContainer != ContainerTS && c.SegmentContainer != ContainerFMP4:
+			return ErrContainer
+		case c.SegmentContainer == ContainerFMP4 && c.InitGenerator == nil:
+			return ErrInitGenerator
+		case c.Encryption != "" && c.Encryption != EncryptionAES128:
+			return ErrEncryptionNotSupported
+		case c.Encryption != "" && c.KeyGenerator == nil:
+			return ErrKeyGenerator
 		}
+	case FormatDASH:
+		switch {
+		case c.TemplateGenerator == nil:
+			return ErrTemplateGenerator
+		case c.InitGenerator == nil:
+			return ErrInitGenerator
+		case c.ChunkDuration == 0:
+			return ErrChunkDuration
+		case c.MaxBuffer == 0:
+			return ErrMaxBuffer
+		case c.MinBuffer == 0:
+			return ErrMinBuffer
+		case c.TmpPath == "":
+			return ErrTmpPath
+		}
+	}
+
+	if c.Format != FormatHLS && c.Encryption != "" {
+		return ErrEncryptionNotSupported
 	}
 
 	if len(c.StreamSpec) == 0 {
@@ -134,6 +234,8 @@ func MimeType(format string) string {
 		return "video/mp4"
 	case FormatTS:
 		return "video/MP2T"
+	case FormatDASH:
+		return "application/dash+xml"
 	}
 
 	return "application/octet-stream"
@@ -143,15 +245,47 @@ type Context struct {
 	id            string
 	contextConfig *ContextConfig
 	streams       []*Stream
+	audios        []*Stream // audio renditions, only when the source has multiple audio tracks
+	subtitles     []*Stream
+	chunks        []tsChunk // the segments shared by all streams, so the renditions are aligned
 	path          string
+	cache         *segmentCache // nil if the cache is disabled
+	output        *DiskStore    // the segments rendered by the jobs, nil if the jobs are disabled
+	admission     *admission    // nil if the ffmpeg processes are not limited
+	background    bool          // the context of a job, it yields to the playback
+	load          *loadMonitor  // nil if the load is not sampled
+	trickplay     *trickplay    // nil if trickplay is disabled
+	key           *contentKey   // nil if the encryption is disabled
 	lastAccess    int64
+	readers       int32 // the open mp4 readers
+	cm            sync.Mutex
 	onClose       func(id string, reason CloseReason)
+	events        *eventBus // nil if the context is not created by a service
+	metrics       *metrics  // nil if the metrics are disabled
 	closed        chan bool
 	err           error
 	info          *ProbeInfo
+	stat          *sourceStat // the stat of the source, nil until it's requested
+	sm            sync.Mutex
 	logger        Logger
 }
 
+// sourceStat returns the stat of the source, it's requested once, as it's a round trip for the remote sources.
+func (c *Context) sourceStat() (sourceStat, error) {
+	c.sm.Lock()
+	defer c.sm.Unlock()
+
+	if c.stat == nil {
+		stat, err := c.contextConfig.statSource(c.path)
+		if err != nil {
+			return sourceStat{}, err
+		}
+		c.stat = &stat
+	}
+
+	return *c.stat, nil
+}
+
 func newContext(id, path string, config *ContextConfig, info *ProbeInfo, onClose func(string, CloseReason), logger Logger) (*Context, error) {
 	context := &Context{
 		id:            id,
@@ -163,12 +297,27 @@ func newContext(id, path string, config *ContextConfig, info *ProbeInfo, onClose
 		onClose:       onClose,
 		info:          info,
 	}
-	// TODO not valid config, seems to be valid in caller,
-	// if true, consider move mkdir to caller too.
-	if config.Format == FormatHLS {
-		if err := os.MkdirAll(filepath.Join(config.TmpPath, id), os.ModePerm); err != nil {
+	if segmented(config.Format) {
+		context.chunks = splitChunks(info.Duration, info.Keyframes, float64(config.ChunkDuration))
+	}
+
+	if config.Encryption != "" {
+		if config.KeyProvider == nil {
+			config.KeyProvider = RandomKeyProvider{}
+		}
+
+		key, err := newContentKey(config.KeyProvider, id)
+		if err != nil {
 			return nil, err
 		}
+		context.key = key
+	}
+
+	if config.Trickplay != nil && info.Width > 0 {
+		if config.SpriteGenerator == nil {
+			config.SpriteGenerator = DefaultSpriteGenerator
+		}
+		context.trickplay = newTrickplay(*config.Trickplay, info)
 	}
 
 	streams := make([]*Stream, 0, len(config.StreamSpec))
@@ -186,35 +335,66 @@ func newContext(id, path string, config *ContextConfig, info *ProbeInfo, onClose
 	}
 
 	context.streams = streams
-	if context.contextConfig.Format == FormatHLS {
-		if context.contextConfig.IdleTimeout > 0 {
-			go context.checkAlive()
+
+	// with a single audio track, we keep it muxed with the video.
+	// dash always serves audio in its own adaptation set.
+	if config.Format == FormatHLS && len(info.AudioTracks) > 1 || config.Format == FormatDASH {
+		for i := range info.AudioTracks {
+			context.audios = append(context.audios, newAudioStream(&info.AudioTracks[i], context, info, logger))
+		}
+	}
+
+	if config.Format == FormatHLS {
+		for i := range info.SubtitleTracks {
+			context.subtitles = append(context.subtitles, newSubtitleStream(&info.SubtitleTracks[i], context, info, logger))
 		}
 	}
 
+	// TODO not valid config, seems to be valid in caller,
+	// if true, consider move mkdir to caller too.
+	if segmented(config.Format) {
+		for _, s := range context.allStreams() {
+			if err := os.MkdirAll(s.dir(), os.ModePerm); err != nil {
+				return nil, err
+			}
+		}
+	}
 	return context, nil
 }
 
 type CloseReason string
 
 const (
-	Normal = CloseReason("normal")
+	CloseUser     = CloseReason("user")     // closed by Context.Close
+	CloseIdle     = CloseReason("idle")     // closed by the service after IdleTimeout
+	CloseError    = CloseReason("error")    // closed because the only video rendition can't recover
+	CloseShutdown = CloseReason("shutdown") // closed by Service.Stop
+
+	// Deprecated: use CloseUser.
+	Normal = CloseUser
 )
 
 func (c *Context) access() {
 	atomic.StoreInt64(&c.lastAccess, time.Now().Unix())
 }
 
-// Close all ffmpeg process, we don't monitor the process, Close must be called by the user
-// TODO not called by user, multiple Close will cause error
+// Close all ffmpeg process and remove the context from the service.
+// The idle context is closed by the service, Close returns ErrIdleTimeout then.
 func (c *Context) Close() error {
+	return c.close(CloseUser, nil)
+}
+
+func (c *Context) close(reason CloseReason, cause error) error {
+	c.cm.Lock()
+	defer c.cm.Unlock()
+
 	select {
 	case <-c.closed:
 		return c.err
 	default:
 	}
 	var err error
-	for _, s := range c.streams {
+	for _, s := range c.allStreams() {
 		err = s.Close()
 	}
 
@@ -222,11 +402,13 @@ func (c *Context) Close() error {
 		return err
 	}
 
-	_ = os.RemoveAll(filepath.Join(c.contextConfig.TmpPath, c.id))
+	_ = os.RemoveAll(c.contextConfig.TmpPath)
 
-	if c.onClose == nil {
-		c.onClose(c.id, Normal)
+	c.err = cause
+	if c.onClose != nil {
+		c.onClose(c.id, reason)
 	}
+	c.emit(Event{Type: EventContextClosed, Reason: reason, Err: cause})
 
 	close(c.closed)
 
@@ -239,25 +421,30 @@ func (c *Context) MimeType() string {
 
 // Content return the content of the context
 // if the format is HLS, it will return the m3u8 file
+// if the format is DASH, it will return the mpd file
 // otherwise, it will return the content of the first stream
 func (c *Context) Content() (io.ReadCloser, error) {
 	c.access()
 
 	if c.contextConfig.Format == FormatHLS {
-		if len(c.streams) == 1 {
+		if len(c.streams) == 1 && len(c.audios) == 0 && len(c.subtitles) == 0 && c.trickplay == nil {
 			return c.streams[0].Content()
 		}
 
 		return c.multiStreamContent()
 	}
 
+	if c.contextConfig.Format == FormatDASH {
+		return c.dashContent()
+	}
+
 	return c.streams[0].Content()
 }
 
 func (c *Context) Stream(name string) *Stream {
 	c.access()
 
-	for _, s := range c.streams {
+	for _, s := range c.allStreams() {
 		if s.spec.Name == name {
 			return s
 		}
@@ -266,14 +453,42 @@ func (c *Context) Stream(name string) *Stream {
 	return nil
 }
 
+// AudioStreams returns the audio renditions, it's empty unless the source has multiple audio tracks.
+func (c *Context) AudioStreams() []*Stream {
+	return c.audios
+}
+
+func (c *Context) allStreams() []*Stream {
+	streams := make([]*Stream, 0, len(c.streams)+len(c.audios)+len(c.subtitles))
+	streams = append(streams, c.streams...)
+	streams = append(streams, c.audios...)
+
+	return append(streams, c.subtitles...)
+}
+
 func (c *Context) multiStreamContent() (io.ReadCloser, error) {
 	buf := &bytes.Buffer{}
 	buf.WriteString("#EXTM3U\n")
 
+	defaultTrack := c.info.DefaultAudioTrack()
+	names := audioNames(c.audios)
+	for i, s := range c.audios {
+		buf.WriteString(audioMediaLine(s, names[i], s.audio == defaultTrack))
+	}
+
+	names = subtitleNames(c.subtitles)
+	for i, s := range c.subtitles {
+		buf.WriteString(subtitleMediaLine(s, names[i]))
+	}
+
 	for i, s := range c.streams {
 		buf.WriteString(DefaultListGenerator(i, s))
 	}
 
+	if c.trickplay != nil {
+		buf.WriteString(c.trickplayStreamLine())
+	}
+
 	buf.WriteString("#EXT-X-ENDLIST\n")
 
 	return io.NopCloser(buf), nil
@@ -296,13 +511,120 @@ const (
 type ListGenerator func(index int, stream *Stream) string
 
 func DefaultListGenerator(index int, stream *Stream) string {
-	// TODO bitrate w,d should not be empty
-	l := fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"avc1.42e00a,mp4a.40.2\"\n", index*5000, stream.width, stream.height)
-	l = l + fmt.Sprintf("index.m3u8?spec=%s\n", stream.spec.Name)
+	peak, average := stream.Bandwidth()
+	// the bandwidth of the variant includes the audio rendition.
+	var audioPeak, audioAverage int
+	for _, a := range stream.context.audios {
+		p, avg := a.Bandwidth()
+		audioPeak, audioAverage = max(audioPeak, p), max(audioAverage, avg)
+	}
+
+	l := fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,RESOLUTION=%dx%d",
+		peak+audioPeak, average+audioAverage, stream.width, stream.height)
+	if stream.frameRate() > 0 {
+		l = l + fmt.Sprintf(",FRAME-RATE=%.3f", stream.frameRate())
+	}
+	l = l + fmt.Sprintf(",CODECS=\"%s\"", stream.codecs())
+	if len(stream.context.audios) > 0 {
+		l = l + fmt.Sprintf(",AUDIO=\"%s\"", audioGroupID)
+	}
+	if len(stream.context.subtitles) > 0 {
+		l = l + fmt.Sprintf(",SUBTITLES=\"%s\"", subtitleGroupID)
+	}
+	l = l + "\n" + playlistURI(stream) + "\n"
 
 	return l
 }
 
+const audioGroupID = "audio"
+
+func playlistURI(stream *Stream) string {
+	return fmt.Sprintf("index.m3u8?id=%s&spec=%s", stream.context.ID(), stream.spec.Name)
+}
+
+// audioNames returns the NAME of the audio renditions, which must be unique in the group by RFC 8216.
+// The title, or the language, is suffixed by the channel layout if it collides, then by the key.
+func audioNames(streams []*Stream) []string {
+	names := make([]string, len(streams))
+	for i, s := range streams {
+		names[i] = renditionName(s.audio.Title, s.audio.Language, s.audio.Key)
+	}
+
+	return uniqueNames(names,
+		func(i int) string { return channelLayout(streams[i].audio) },
+		func(i int) string { return streams[i].audio.Key },
+	)
+}
+
+// renditionName returns the first non empty of the title, the language and the key.
+func renditionName(title, language, key string) string {
+	switch {
+	case title != "":
+		return title
+	case language != "":
+		return language
+	}
+
+	return key
+}
+
+// uniqueNames suffixes the colliding names by each suffix in order, the empty suffix is skipped.
+func uniqueNames(names []string, suffixes ...func(i int) string) []string {
+	for _, suffix := range suffixes {
+		counts := make(map[string]int, len(names))
+		for _, name := range names {
+			counts[name]++
+		}
+		for i := range names {
+			if counts[names[i]] > 1 {
+				if extra := suffix(i); extra != "" {
+					names[i] = names[i] + " (" + extra + ")"
+				}
+			}
+		}
+	}
+
+	return names
+}
+
+// channelLayout returns the name of the common channel layouts.
+func channelLayout(track *AudioTrack) string {
+	switch track.Channels {
+	case 0:
+		return ""
+	case 1:
+		return "mono"
+	case 2:
+		return "stereo"
+	case 6:
+		return "5.1"
+	case 8:
+		return "7.1"
+	}
+
+	return fmt.Sprintf("%d channels", track.Channels)
+}
+
+// audioMediaLine returns the EXT-X-MEDIA line of the audio rendition.
+func audioMediaLine(stream *Stream, name string, isDefault bool) string {
+	track := stream.audio
+	l := fmt.Sprintf("#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"%s\",NAME=\"%s\"", audioGroupID, name)
+	if track.Language != "" && track.Language != "und" {
+		l = l + fmt.Sprintf(",LANGUAGE=\"%s\"", track.Language)
+	}
+	if isDefault {
+		l = l + ",DEFAULT=YES"
+	} else {
+		l = l + ",DEFAULT=NO"
+	}
+	l = l + ",AUTOSELECT=YES"
+	if track.Channels > 0 {
+		l = l + fmt.Sprintf(",CHANNELS=\"%d\"", track.Channels)
+	}
+
+	return l + fmt.Sprintf(",URI=\"%s\"\n", playlistURI(stream))
+}
+
 func fit(spec StreamSpec, info *ProbeInfo) bool {
 	if spec.Force {
 		return true
@@ -321,26 +643,6 @@ func fit(spec StreamSpec, info *ProbeInfo) bool {
 
 var ErrIdleTimeout = errors.New("context is idle")
 
-func (c *Context) checkAlive() {
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
-
-	// TODO consider using service to check, save a lot of goroutine
-	for {
-		select {
-		case <-ticker.C:
-			now := time.Now().Unix()
-			if now-atomic.LoadInt64(&c.lastAccess) > int64(c.contextConfig.IdleTimeout) {
-				c.err = ErrIdleTimeout
-				_ = c.Close()
-			}
-		case <-c.closed:
-			ticker.Stop()
-			return
-		}
-	}
-}
-
 func adjustSpec(spec StreamSpec, info *ProbeInfo) StreamSpec {
 	if spec.Force && spec.Bitrate > 0 {
 		// they know what they are doing, we ignore the spec.
@@ -380,7 +682,8 @@ func adjustSpec(spec StreamSpec, info *ProbeInfo) StreamSpec {
 		spec.Width++
 	}
 
-	spec.Bitrate = (spec.Width * spec.Height) / (info.Width * info.Height) * originBitrate
+	// the bitrate is proportional to the pixels, the ratio must be calculated in float.
+	spec.Bitrate = int(float64(spec.Width*spec.Height) / float64(info.Width*info.Height) * float64(originBitrate))
 
 	return spec
 }
@@ -1,6 +1,7 @@
 package vod
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -29,6 +30,13 @@ func TestAdjustSpecCalculatesWidthFromHeight(t *testing.T) {
 	assert.Equal(t, 540, result.Height)
 }
 
+func TestAdjustSpecScalesBitrateByPixels(t *testing.T) {
+	spec := StreamSpec{Width: 960}
+	info := &ProbeInfo{Width: 1920, Height: 1080, VideoCodec: "h264", VideoBitrate: 4000000}
+	result := adjustSpec(spec, info)
+	assert.Equal(t, 1000000, result.Bitrate)
+}
+
 func TestAdjustSpecRoundsUpOddDimensions(t *testing.T) {
 	spec := StreamSpec{Width: 961, Height: 541}
 	info := &ProbeInfo{Width: 1920, Height: 1080}
@@ -36,3 +44,66 @@ func TestAdjustSpecRoundsUpOddDimensions(t *testing.T) {
 	assert.Equal(t, 962, result.Width)
 	assert.Equal(t, 540, result.Height)
 }
+
+func TestMultiAudioContentAdvertisesAudioGroup(t *testing.T) {
+	info := &ProbeInfo{
+		Duration: 20, Width: 1920, Height: 1080, VideoCodec: "h264", AudioCodec: "aac",
+		AudioTracks: []AudioTrack{
+			{Index: 1, Codec: "aac", Key: "audio-0", Language: "jpn", Channels: 2},
+			{Index: 2, Codec: "ac3", Key: "audio-1", Language: "eng", Title: "English", Channels: 6, Default: true},
+		},
+	}
+	context := newTestContext(t, "multi", nil, info)
+	r, err := context.Content()
+	content := readAll(t, r, err)
+
+	assert.Contains(t, content,
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="jpn",LANGUAGE="jpn",DEFAULT=NO,AUTOSELECT=YES,CHANNELS="2",URI="index.m3u8?id=multi&spec=audio-0"`)
+	assert.Contains(t, content,
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="English",LANGUAGE="eng",DEFAULT=YES,AUTOSELECT=YES,CHANNELS="6",URI="index.m3u8?id=multi&spec=audio-1"`)
+	assert.Contains(t, content, `AUDIO="audio"`)
+	assert.Equal(t, 1, strings.Count(content, "#EXT-X-STREAM-INF"))
+	assert.Len(t, context.AudioStreams(), 2)
+	assert.NotNil(t, context.Stream("audio-1"))
+}
+
+func TestMultiAudioNamesAreUnique(t *testing.T) {
+	info := &ProbeInfo{
+		Duration: 20, Width: 1920, Height: 1080, VideoCodec: "h264", AudioCodec: "aac",
+		AudioTracks: []AudioTrack{
+			{Index: 1, Codec: "aac", Key: "audio-0", Language: "eng", Channels: 2},
+			{Index: 2, Codec: "ac3", Key: "audio-1", Language: "eng", Channels: 6},
+			{Index: 3, Codec: "aac", Key: "audio-2", Language: "eng", Channels: 2},
+			{Index: 4, Codec: "aac", Key: "audio-3", Language: "jpn", Channels: 2},
+		},
+	}
+	context := newTestContext(t, "names", nil, info)
+
+	assert.Equal(t, []string{"eng (stereo) (audio-0)", "eng (5.1)", "eng (stereo) (audio-2)", "jpn"}, audioNames(context.audios))
+
+	r, err := context.Content()
+	content := readAll(t, r, err)
+	assert.Contains(t, content, `NAME="eng (5.1)",LANGUAGE="eng"`)
+	assert.Contains(t, content, `NAME="jpn",LANGUAGE="jpn"`)
+}
+
+func TestMultiAudioMapsTracksExplicitly(t *testing.T) {
+	info := &ProbeInfo{
+		Duration: 20, Width: 1920, Height: 1080, VideoCodec: "h264", AudioCodec: "aac",
+		AudioTracks: []AudioTrack{
+			{Index: 1, Codec: "aac", Key: "audio-0"},
+			{Index: 2, Codec: "ac3", Key: "audio-1"},
+		},
+	}
+	context := newTestContext(t, "multi", nil, info)
+
+	video := context.Stream("Origin")
+	assert.False(t, video.needTranscode())
+	assert.Subset(t, video.buildFFMpegArgs(0, false, FormatHLS, false), []string{"-map", "0:v:0", "-an"})
+
+	audio := context.Stream("audio-1")
+	assert.True(t, audio.needTranscode())
+	args := audio.buildFFMpegArgs(0, true, FormatHLS, false)
+	assert.Subset(t, args, []string{"-map", "0:2", "-vn", "-c:a", "aac"})
+	assert.NotContains(t, args, "-c:v")
+}
@@ -0,0 +1,219 @@
+package vod
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+const (
+	dashTimescale     = 1000
+	dashChannelScheme = "urn:mpeg:dash:23003:3:audio_channel_configuration:2011"
+)
+
+// TemplateGenerator generates the media attribute of the SegmentTemplate,
+// $Number$ is replaced by the index of the segment by the player.
+type TemplateGenerator func(stream *Stream, context *Context) string
+
+func DefaultTemplateGenerator(stream *Stream, context *Context) string {
+	return fmt.Sprintf("/video/ts?id=%s&index=$Number$&spec=%s", context.ID(), stream.spec.Name)
+}
+
+type mpd struct {
+	XMLName                   xml.Name `xml:"MPD"`
+	Xmlns                     string   `xml:"xmlns,attr"`
+	Profiles                  string   `xml:"profiles,attr"`
+	Type                      string   `xml:"type,attr"`
+	MediaPresentationDuration string   `xml:"mediaPresentationDuration,attr"`
+	MinBufferTime             string   `xml:"minBufferTime,attr"`
+	Period                    mpdPeriod
+}
+
+type mpdPeriod struct {
+	XMLName        xml.Name `xml:"Period"`
+	ID             string   `xml:"id,attr"`
+	Start          string   `xml:"start,attr"`
+	AdaptationSets []mpdAdaptationSet
+}
+
+type mpdAdaptationSet struct {
+	XMLName          xml.Name `xml:"AdaptationSet"`
+	ID               int      `xml:"id,attr"`
+	ContentType      string   `xml:"contentType,attr"`
+	MimeType         string   `xml:"mimeType,attr"`
+	Lang             string   `xml:"lang,attr,omitempty"`
+	SegmentAlignment bool     `xml:"segmentAlignment,attr"`
+	StartWithSAP     int      `xml:"startWithSAP,attr"`
+	Label            string   `xml:"Label,omitempty"`
+	Role             *mpdDescriptor
+	Representation   mpdRepresentation
+}
+
+type mpdDescriptor struct {
+	XMLName     xml.Name
+	SchemeIDURI string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+type mpdRepresentation struct {
+	XMLName                   xml.Name `xml:"Representation"`
+	ID                        string   `xml:"id,attr"`
+	Bandwidth                 int      `xml:"bandwidth,attr"`
+	Codecs                    string   `xml:"codecs,attr,omitempty"`
+	Width                     int      `xml:"width,attr,omitempty"`
+	Height                    int      `xml:"height,attr,omitempty"`
+	FrameRate                 string   `xml:"frameRate,attr,omitempty"`
+	AudioChannelConfiguration *mpdDescriptor
+	SegmentTemplate           mpdSegmentTemplate
+}
+
+type mpdSegmentTemplate struct {
+	XMLName         xml.Name     `xml:"SegmentTemplate"`
+	Timescale       int          `xml:"timescale,attr"`
+	StartNumber     int          `xml:"startNumber,attr"`
+	Media           string       `xml:"media,attr"`
+	Initialization  string       `xml:"initialization,attr"`
+	SegmentTimeline []mpdSegment `xml:"SegmentTimeline>S"`
+}
+
+// mpdSegment is a S element of the SegmentTimeline, r repeats the same duration.
+type mpdSegment struct {
+	T      int64 `xml:"t,attr"`
+	D      int64 `xml:"d,attr"`
+	Repeat int   `xml:"r,attr,omitempty"`
+}
+
+// dashContent returns the mpd of the context, every video spec and audio track has its own adaptation set.
+// The segments are served by the same lazy transcoding as hls.
+func (c *Context) dashContent() (io.ReadCloser, error) {
+	manifest := mpd{
+		Xmlns:                     "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:                  "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:                      "static",
+		MediaPresentationDuration: dashDuration(c.info.Duration),
+		MinBufferTime:             dashDuration(float64(c.contextConfig.ChunkDuration)),
+		Period:                    mpdPeriod{ID: "0", Start: dashDuration(0)},
+	}
+
+	for _, s := range c.allStreams() {
+		set := mpdAdaptationSet{
+			ID:               len(manifest.Period.AdaptationSets),
+			MimeType:         MimeType(FormatMP4),
+			SegmentAlignment: true,
+			StartWithSAP:     1,
+			Representation:   s.dashRepresentation(),
+		}
+
+		if s.audio != nil {
+			set.ContentType = "audio"
+			set.MimeType = "audio/mp4"
+			set.Label = s.audio.Title
+			if s.audio.Language != "und" {
+				set.Lang = s.audio.Language
+			}
+			if s.audio == c.info.DefaultAudioTrack() {
+				set.Role = &mpdDescriptor{
+					XMLName:     xml.Name{Local: "Role"},
+					SchemeIDURI: "urn:mpeg:dash:role:2011",
+					Value:       "main",
+				}
+			}
+		} else {
+			set.ContentType = "video"
+		}
+
+		manifest.Period.AdaptationSets = append(manifest.Period.AdaptationSets, set)
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(xml.Header)
+
+	encoder := xml.NewEncoder(buf)
+	encoder.Indent("", "  ")
+
+	if err := encoder.Encode(manifest); err != nil {
+		return nil, err
+	}
+
+	buf.WriteString("\n")
+
+	return io.NopCloser(buf), nil
+}
+
+func (s *Stream) dashRepresentation() mpdRepresentation {
+	representation := mpdRepresentation{
+		ID: s.spec.Name,
+		SegmentTemplate: mpdSegmentTemplate{
+			Timescale:       dashTimescale,
+			StartNumber:     0,
+			Media:           s.context.contextConfig.TemplateGenerator(s, s.context),
+			Initialization:  s.context.contextConfig.InitGenerator(s, s.context),
+			SegmentTimeline: dashTimeline(s.generateChunks()),
+		},
+	}
+
+	if s.audio != nil {
+		representation.Codecs = s.codecs()
+		representation.Bandwidth, _ = s.Bandwidth()
+		if s.audio.Channels > 0 {
+			representation.AudioChannelConfiguration = &mpdDescriptor{
+				XMLName:     xml.Name{Local: "AudioChannelConfiguration"},
+				SchemeIDURI: dashChannelScheme,
+				Value:       strconv.Itoa(s.audio.Channels),
+			}
+		}
+
+		return representation
+	}
+
+	representation.Codecs = s.codecs()
+	representation.Width, representation.Height = s.width, s.height
+	representation.Bandwidth, _ = s.Bandwidth()
+	if s.frameRate() > 0 {
+		representation.FrameRate = dashFrameRate(s.frameRate())
+	}
+
+	return representation
+}
+
+// dashTimeline describes the chunks, which are split at keyframes and may have different durations.
+// The adjacent chunks with the same duration are merged.
+func dashTimeline(chunks []tsChunk) []mpdSegment {
+	timeline := make([]mpdSegment, 0, len(chunks))
+
+	for _, c := range chunks {
+		t := int64(math.Round(c.start * dashTimescale))
+		d := int64(math.Round((c.start+c.duration)*dashTimescale)) - t
+
+		if n := len(timeline); n > 0 {
+			last := &timeline[n-1]
+			if last.D == d && last.T+last.D*int64(last.Repeat+1) == t {
+				last.Repeat++
+
+				continue
+			}
+		}
+
+		timeline = append(timeline, mpdSegment{T: t, D: d})
+	}
+
+	return timeline
+}
+
+// dashFrameRate formats the frame rate to FrameRateType, which doesn't allow decimals.
+func dashFrameRate(rate float64) string {
+	milli := int(math.Round(rate * dashTimescale))
+	if milli%dashTimescale == 0 {
+		return strconv.Itoa(milli / dashTimescale)
+	}
+
+	return fmt.Sprintf("%d/%d", milli, dashTimescale)
+}
+
+// dashDuration formats seconds to xs:duration.
+func dashDuration(seconds float64) string {
+	return fmt.Sprintf("PT%.3fS", seconds)
+}
@@ -0,0 +1,42 @@
+package vod
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDashContentHasAdaptationSetPerStream(t *testing.T) {
+	config := &ContextConfig{
+		Format:     FormatDASH,
+		StreamSpec: []StreamSpec{Origin, Resolution720P},
+	}
+	info := &ProbeInfo{
+		Duration: 20, Width: 1920, Height: 1080, VideoCodec: "h264", AudioCodec: "aac", FrameRate: 24000.0 / 1001,
+		VideoBitrate: 4000000,
+		AudioTracks: []AudioTrack{
+			{Index: 1, Codec: "aac", Key: "audio-0", Language: "eng", Channels: 2},
+		},
+	}
+	context := newTestContext(t, "dash", config, info)
+	assert.Equal(t, "application/dash+xml", context.MimeType())
+
+	r, err := context.Content()
+	content := readAll(t, r, err)
+	assert.Contains(t, content, `mediaPresentationDuration="PT20.000S"`)
+	assert.Contains(t, content, `<AdaptationSet id="0" contentType="video" mimeType="video/mp4"`)
+	assert.Contains(t, content, `<Representation id="720P" bandwidth="`)
+	assert.Contains(t, content, `frameRate="23976/1000"`)
+	assert.Contains(t, content, `<AdaptationSet id="2" contentType="audio" mimeType="audio/mp4" lang="eng"`)
+	assert.Contains(t, content, `media="/video/ts?id=dash&amp;index=$Number$&amp;spec=audio-0"`)
+	assert.Contains(t, content, `initialization="/video/init?id=dash&amp;spec=Origin"`)
+
+	stream := context.Stream("Origin")
+	assert.Equal(t, ContainerFMP4, stream.segmentContainer())
+	assert.Subset(t, stream.buildFFMpegArgs(0, false, FormatDASH, false), []string{"-map", "0:v:0", "-an", "-segment_format", "mp4"})
+}
+
+func TestDashFrameRate(t *testing.T) {
+	assert.Equal(t, "25", dashFrameRate(25))
+	assert.Equal(t, "29970/1000", dashFrameRate(30000.0/1001))
+}
@@ -0,0 +1,170 @@
+package vod
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The encryption methods of the HLS segments.
+// SAMPLE-AES requires encrypting the samples inside the container, which ffmpeg can't do,
+// so it's rejected with ErrEncryptionNotSupported.
+const (
+	EncryptionAES128    = "AES-128"
+	EncryptionSampleAES = "SAMPLE-AES"
+)
+
+const keySize = 16
+
+var (
+	ErrEncryptionNotSupported = errors.New("encryption method is not supported")
+	ErrEncryptionDisabled     = errors.New("encryption is disabled")
+	ErrInvalidKey             = errors.New("key and iv must be 16 bytes")
+)
+
+// KeyProvider issues the AES-128 key of the context, it's called once when the context is created.
+// If the returned iv is nil, the media sequence number of the segment is used as the iv, as the HLS spec defines.
+type KeyProvider interface {
+	Key(contextID string) (key []byte, iv []byte, err error)
+}
+
+// RandomKeyProvider issues a random key for every context, the keys are gone with the contexts.
+type RandomKeyProvider struct{}
+
+func (RandomKeyProvider) Key(string) ([]byte, []byte, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+
+	return key, nil, nil
+}
+
+// KeyGenerator generates the uri of the key, used by the EXT-X-KEY tag.
+type KeyGenerator func(context *Context) string
+
+func DefaultKeyGenerator(context *Context) string {
+	return fmt.Sprintf("/video/key?id=%s", context.ID())
+}
+
+// contentKey is the key of the context, iv is nil if it's derived from the segment index.
+type contentKey struct {
+	key []byte
+	iv  []byte
+}
+
+func newContentKey(provider KeyProvider, contextID string) (*contentKey, error) {
+	key, iv, err := provider.Key(contextID)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != keySize || iv != nil && len(iv) != keySize {
+		return nil, ErrInvalidKey
+	}
+
+	return &contentKey{key: key, iv: iv}, nil
+}
+
+// segmentIV returns the iv of the segment.
+func (k *contentKey) segmentIV(index int) []byte {
+	if k.iv != nil {
+		return k.iv
+	}
+
+	iv := make([]byte, keySize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(index))
+
+	return iv
+}
+
+// keyLine returns the EXT-X-KEY line of the media playlist.
+func (c *Context) keyLine() string {
+	line := fmt.Sprintf("#EXT-X-KEY:METHOD=%s,URI=\"%s\"", EncryptionAES128, c.contextConfig.KeyGenerator(c))
+	if c.key.iv != nil {
+		line += ",IV=0x" + hex.EncodeToString(c.key.iv)
+	}
+
+	return line + "\n"
+}
+
+// Key returns the key of the segments, it's served to the players by the uri of KeyGenerator.
+func (c *Context) Key() ([]byte, error) {
+	c.access()
+
+	if c.key == nil {
+		return nil, ErrEncryptionDisabled
+	}
+
+	return c.key.key, nil
+}
+
+// encrypt encrypts the segment on the fly if the encryption is enabled, the subtitles are never encrypted.
+func (s *Stream) encrypt(index int, r io.ReadCloser, err error) (io.ReadCloser, error) {
+	key := s.context.key
+	if err != nil || key == nil || s.subtitle != nil {
+		return r, err
+	}
+
+	block, err := aes.NewCipher(key.key)
+	if err != nil {
+		_ = r.Close()
+
+		return nil, err
+	}
+
+	return &cbcReader{
+		src:  r,
+		mode: cipher.NewCBCEncrypter(block, key.segmentIV(index)),
+		read: make([]byte, 32*1024),
+	}, nil
+}
+
+// cbcReader encrypts the source by AES-CBC with PKCS7 padding.
+type cbcReader struct {
+	src  io.ReadCloser
+	mode cipher.BlockMode
+	read []byte
+	buf  []byte // the plaintext less than a block
+	out  []byte // the ciphertext not read yet
+	eof  bool
+}
+
+func (r *cbcReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+
+		n, err := r.src.Read(r.read)
+		r.buf = append(r.buf, r.read[:n]...)
+
+		switch {
+		case errors.Is(err, io.EOF):
+			r.eof = true
+			pad := aes.BlockSize - len(r.buf)%aes.BlockSize
+			r.buf = append(r.buf, bytes.Repeat([]byte{byte(pad)}, pad)...)
+		case err != nil:
+			return 0, err
+		}
+
+		full := len(r.buf) / aes.BlockSize * aes.BlockSize
+		r.mode.CryptBlocks(r.buf[:full], r.buf[:full])
+		r.out = r.buf[:full]
+		r.buf = append([]byte(nil), r.buf[full:]...)
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+
+	return n, nil
+}
+
+func (r *cbcReader) Close() error {
+	return r.src.Close()
+}
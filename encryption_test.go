@@ -0,0 +1,141 @@
+package vod
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fixedKeyProvider struct {
+	key []byte
+	iv  []byte
+}
+
+func (f fixedKeyProvider) Key(string) ([]byte, []byte, error) {
+	return f.key, f.iv, nil
+}
+
+func decryptCBC(t *testing.T, key, iv, data []byte) []byte {
+	t.Helper()
+
+	block, err := aes.NewCipher(key)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(data)%aes.BlockSize)
+
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+	pad := int(plain[len(plain)-1])
+
+	return plain[:len(plain)-pad]
+}
+
+func TestCBCReaderPadsAnySize(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, keySize)
+	iv := bytes.Repeat([]byte{2}, keySize)
+
+	for _, size := range []int{0, 15, 16, 100000} {
+		plain := bytes.Repeat([]byte("segment"), size/7+1)[:size]
+		block, _ := aes.NewCipher(key)
+		r := &cbcReader{
+			src:  io.NopCloser(iotest.OneByteReader(bytes.NewReader(plain))),
+			mode: cipher.NewCBCEncrypter(block, iv),
+			read: make([]byte, 1024),
+		}
+
+		encrypted, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, (size/aes.BlockSize+1)*aes.BlockSize, len(encrypted))
+		assert.Equal(t, plain, decryptCBC(t, key, iv, encrypted))
+	}
+}
+
+func TestEncryptedHLSSegments(t *testing.T) {
+	key := bytes.Repeat([]byte{3}, keySize)
+	config := &ContextConfig{Format: FormatHLS, Encryption: EncryptionAES128, KeyProvider: fixedKeyProvider{key: key}}
+	info := testProbeInfo()
+	context := newTestContext(t, "encrypted", config, info)
+	context.path = "testdata/test.mp3"
+
+	cache, err := newSegmentCache(t.TempDir(), 1<<20, NewEmptyLogger())
+	assert.NoError(t, err)
+	context.cache = cache
+
+	stream := context.Stream(Origin.Name)
+	content, err := stream.Content()
+	playlist := readAll(t, content, err)
+	assert.Contains(t, playlist, "#EXT-X-KEY:METHOD=AES-128,URI=\"/video/key?id=encrypted\"\n")
+	assert.NotContains(t, playlist, "IV=")
+
+	segment := filepath.Join(t.TempDir(), "2.ts")
+	assert.NoError(t, os.WriteFile(segment, []byte("clear segment"), 0o600))
+	stream.cacheChunk(2, segment)
+
+	r, err := stream.Chunk(2, 2)
+	encrypted := readAll(t, r, err)
+	assert.NotEqual(t, "clear segment", encrypted)
+
+	// the iv is the media sequence number.
+	iv := make([]byte, keySize)
+	iv[keySize-1] = 2
+	assert.Equal(t, []byte("clear segment"), decryptCBC(t, key, iv, []byte(encrypted)))
+}
+
+func TestEncryptionKeyLineWithIV(t *testing.T) {
+	iv := bytes.Repeat([]byte{0xab}, keySize)
+	config := &ContextConfig{
+		Format:      FormatHLS,
+		Encryption:  EncryptionAES128,
+		KeyProvider: fixedKeyProvider{key: make([]byte, keySize), iv: iv},
+	}
+	info := testProbeInfo()
+	context := newTestContext(t, "iv", config, info)
+
+	assert.Equal(t, "#EXT-X-KEY:METHOD=AES-128,URI=\"/video/key?id=iv\",IV=0xabababababababababababababababab\n",
+		context.keyLine())
+	assert.Equal(t, iv, context.key.segmentIV(5))
+}
+
+func TestEncryptionConfigValidation(t *testing.T) {
+	config := &ContextConfig{FFMpegPath: "ffmpeg", FFProbePath: "ffprobe", Format: FormatHLS, StreamSpec: []StreamSpec{Origin}}
+	config.TmpPath = t.TempDir()
+	setHLSDefaultValue(config)
+
+	config.Encryption = EncryptionSampleAES
+	assert.Equal(t, ErrEncryptionNotSupported, config.valid())
+
+	config.Encryption = EncryptionAES128
+	assert.NoError(t, config.valid())
+
+	config.Format = FormatDASH
+	assert.Equal(t, ErrEncryptionNotSupported, config.valid())
+
+	_, err := newContentKey(fixedKeyProvider{key: []byte("short")}, "id")
+	assert.Equal(t, ErrInvalidKey, err)
+}
+
+func TestHandlerServesKey(t *testing.T) {
+	service := newTestService(t, "test")
+	handler := service.Handler("/video")
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/video/key?id=test", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	key := bytes.Repeat([]byte{4}, keySize)
+	service.contexts["test"].key = &contentKey{key: key}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/video/key?id=test", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "no-store", recorder.Header().Get("Cache-Control"))
+	assert.Equal(t, key, recorder.Body.Bytes())
+}
@@ -0,0 +1,126 @@
+package vod
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType is the type of Event.
+type EventType string
+
+const (
+	EventContextCreated   = EventType("context_created")
+	EventStreamStarted    = EventType("stream_started") // the stream is requested for the first time
+	EventProcessStarted   = EventType("process_started")
+	EventProcessSuspended = EventType("process_suspended") // the buffer is full
+	EventProcessResumed   = EventType("process_resumed")
+	EventProcessExited    = EventType("process_exited")
+	EventSegmentReady     = EventType("segment_ready")
+	EventTranscodeError   = EventType("transcode_error") // ffmpeg exits unexpectedly, Err is the reason
+	EventContextClosed    = EventType("context_closed")  // Reason is why it's closed
+)
+
+// Event is the lifecycle event of the contexts, the fields not related to the type are zero.
+type Event struct {
+	Type      EventType
+	Time      time.Time
+	ContextID string
+	Stream    string // the spec name
+	Segment   int    // the index of the segment
+	PID       int    // the pid of ffmpeg
+	Reason    CloseReason
+	Err       error
+}
+
+// eventBufferSize is the buffer of every subscriber, the events are dropped if the subscriber is too slow,
+// so the transcoding is never blocked.
+const eventBufferSize = 256
+
+type eventBus struct {
+	m           sync.Mutex
+	subscribers map[int]chan Event
+	next        int
+	logger      Logger
+}
+
+func newEventBus(logger Logger) *eventBus {
+	return &eventBus{
+		subscribers: make(map[int]chan Event),
+		logger:      logger,
+	}
+}
+
+// publish sends the event to all subscribers, it's safe to call with a nil bus.
+func (b *eventBus) publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	for _, ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+			b.logger.Warnf("event %s of context %s is dropped, the subscriber is too slow", e.Type, e.ContextID)
+		}
+	}
+}
+
+func (b *eventBus) subscribe() (<-chan Event, func()) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	id := b.next
+	b.next++
+	ch := make(chan Event, eventBufferSize)
+	b.subscribers[id] = ch
+
+	var once sync.Once
+
+	return ch, func() {
+		once.Do(func() {
+			b.m.Lock()
+			defer b.m.Unlock()
+
+			delete(b.subscribers, id)
+			close(ch)
+		})
+	}
+}
+
+// Events returns a channel of the events of all contexts, and a function to unsubscribe which closes the channel.
+// The events are dropped if the channel is not read in time.
+func (s *Service) Events() (<-chan Event, func()) {
+	return s.events.subscribe()
+}
+
+// Subscribe calls fn for every event in order, fn is called on its own goroutine, so it may block for a while
+// without blocking the transcoding. It returns a function to unsubscribe.
+func (s *Service) Subscribe(fn func(Event)) func() {
+	ch, cancel := s.events.subscribe()
+
+	go func() {
+		for e := range ch {
+			fn(e)
+		}
+	}()
+
+	return cancel
+}
+
+// emit publishes the event of the context.
+func (c *Context) emit(e Event) {
+	e.ContextID = c.id
+	c.events.publish(e)
+}
+
+// emit publishes the event of the stream.
+func (s *Stream) emit(e Event) {
+	e.Stream = s.spec.Name
+	s.context.emit(e)
+}
@@ -0,0 +1,100 @@
+package vod
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+
+	return Event{}
+}
+
+func TestEventsContextClosedByUser(t *testing.T) {
+	service := newTestService(t)
+	service.events = newEventBus(NewEmptyLogger())
+	context := addTestContext(t, service, "events", nil, testProbeInfo())
+	events, cancel := service.Events()
+	defer cancel()
+
+	assert.Nil(t, context.Close())
+
+	e := nextEvent(t, events)
+	assert.Equal(t, EventContextClosed, e.Type)
+	assert.Equal(t, "events", e.ContextID)
+	assert.Equal(t, CloseUser, e.Reason)
+	assert.False(t, e.Time.IsZero())
+
+	// closing again emits nothing.
+	assert.Nil(t, context.Close())
+	assert.Len(t, events, 0)
+}
+
+func TestEventsContextClosedByShutdown(t *testing.T) {
+	service := newTestService(t)
+	service.events = newEventBus(NewEmptyLogger())
+	addTestContext(t, service, "events", nil, testProbeInfo())
+	received := make(chan Event, 1)
+	cancel := service.Subscribe(func(e Event) { received <- e })
+	defer cancel()
+
+	assert.Nil(t, service.Stop())
+
+	e := nextEvent(t, received)
+	assert.Equal(t, EventContextClosed, e.Type)
+	assert.Equal(t, CloseShutdown, e.Reason)
+}
+
+func TestEventsStreamStartedOnce(t *testing.T) {
+	service := newTestService(t)
+	service.events = newEventBus(NewEmptyLogger())
+	context := addTestContext(t, service, "events", nil, testProbeInfo())
+	events, cancel := service.Events()
+	defer cancel()
+
+	stream := context.Stream(Origin.Name)
+	_, err := stream.Content()
+	assert.Nil(t, err)
+	_, err = stream.Content()
+	assert.Nil(t, err)
+
+	e := nextEvent(t, events)
+	assert.Equal(t, EventStreamStarted, e.Type)
+	assert.Equal(t, Origin.Name, e.Stream)
+	assert.Len(t, events, 0)
+}
+
+func TestEventsDroppedForSlowSubscriber(t *testing.T) {
+	bus := newEventBus(NewEmptyLogger())
+	events, cancel := bus.subscribe()
+
+	for i := 0; i < eventBufferSize+10; i++ {
+		bus.publish(Event{Type: EventSegmentReady, Segment: i})
+	}
+	assert.Len(t, events, eventBufferSize)
+	assert.Equal(t, 0, (<-events).Segment)
+
+	cancel()
+	cancel()
+	bus.publish(Event{Type: EventSegmentReady})
+
+	count := 0
+	for range events {
+		count++
+	}
+	assert.Equal(t, eventBufferSize-1, count)
+
+	// nil bus is a no-op.
+	var nilBus *eventBus
+	nilBus.publish(Event{Type: EventSegmentReady})
+}
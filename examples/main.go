@@ -1,11 +1,7 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
-	"errors"
-	"io"
-	"log"
 	"net/http"
 	"strconv"
 	"time"
@@ -31,9 +27,7 @@ func main() {
 		panic(err)
 	}
 	http.HandleFunc("/play", play)
-	http.HandleFunc("/video/index.m3u8", m3u8)
-	http.HandleFunc("/video/ts", ts)
-	http.HandleFunc("/video/mp4", mp4)
+	http.Handle("/video/", videoService.Handler("/video"))
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "examples/index.html")
 	})
@@ -105,153 +99,3 @@ func play(writer http.ResponseWriter, request *http.Request) {
 	json.NewEncoder(writer).Encode(&res)
 	return
 }
-
-func ts(writer http.ResponseWriter, request *http.Request) {
-	var err error
-	queries := request.URL.Query()
-	id := queries.Get("id")
-	context := videoService.Context(id)
-	if context == nil {
-		_, _ = writer.Write([]byte("context is nil"))
-
-		return
-	}
-
-	spec := queries.Get("spec")
-	stream := context.Stream(spec)
-	if stream == nil {
-		_, _ = writer.Write([]byte("stream not found"))
-
-		return
-	}
-
-	indexStr := request.URL.Query().Get("index")
-	if indexStr == "" {
-		_, _ = writer.Write([]byte("index is required"))
-
-		return
-	}
-
-	var index int
-	index, err = strconv.Atoi(indexStr)
-
-	if err != nil {
-		_, _ = writer.Write([]byte(err.Error()))
-
-		return
-	}
-
-	var readCloser io.ReadCloser
-	readCloser, err = stream.Chunk(index, index)
-
-	defer func() {
-		_ = readCloser.Close()
-	}()
-
-	if err != nil {
-		_, _ = writer.Write([]byte(err.Error()))
-
-		return
-	}
-
-	writer.Header().Set("Content-Type", "video/MP2T")
-	_, _ = io.Copy(writer, readCloser)
-}
-
-func m3u8(writer http.ResponseWriter, request *http.Request) {
-
-	queries := request.URL.Query()
-	spec := queries.Get("spec")
-	id := queries.Get("id")
-	c := videoService.Context(id)
-	if c == nil {
-		_, _ = writer.Write([]byte("context is nil"))
-
-		return
-	}
-
-	if spec != "" {
-		stream := c.Stream(spec)
-		if stream == nil {
-			_, _ = writer.Write([]byte("stream not found"))
-
-			return
-		}
-		content, err := stream.Content()
-		if err != nil {
-			_, _ = writer.Write([]byte(err.Error()))
-
-			return
-		}
-
-		writer.Header().Set("Content-Type", c.MimeType())
-		_, _ = io.Copy(writer, content)
-
-		return
-	} else {
-		content, err := c.Content()
-		if err != nil {
-			_, _ = writer.Write([]byte(err.Error()))
-
-			return
-		}
-
-		writer.Header().Set("Content-Type", c.MimeType())
-		_, _ = io.Copy(writer, content)
-	}
-}
-
-func mp4(writer http.ResponseWriter, request *http.Request) {
-	var err error
-	queries := request.URL.Query()
-	id := queries.Get("id")
-	context := videoService.Context(id)
-	if context == nil {
-		_, _ = writer.Write([]byte("context is nil"))
-
-		return
-	}
-
-	var readCloser io.ReadCloser
-	readCloser, err = context.Content()
-	if err != nil {
-		_, _ = writer.Write([]byte(err.Error()))
-
-		return
-	}
-
-	defer readCloser.Close()
-	writer.Header().Set("Content-Type", context.MimeType())
-	const (
-		bufLen = 1024 * 1024 // 1Mb
-	)
-	buf := make([]byte, bufLen)
-	stdoutReader := bufio.NewReader(readCloser)
-	flusher, ok := writer.(http.Flusher)
-	if !ok {
-		_, _ = io.Copy(writer, readCloser)
-
-		return
-	}
-
-	for {
-		var n int
-		n, err = stdoutReader.Read(buf)
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
-
-			break
-		}
-
-		_, err = writer.Write(buf[:n])
-		if err != nil {
-			log.Println(err)
-
-			break
-		}
-
-		flusher.Flush()
-	}
-}
@@ -6,64 +6,88 @@ import (
 	"strconv"
 )
 
+// buildFFMpegArgs builds the args of the segments from the start index.
 func (s *Stream) buildFFMpegArgs(start int, transcode bool, format string, pipe bool) []string {
-	hwAccel, ok := allHWInfos[s.context.contextConfig.HWAccel]
-	if !ok {
-		hwAccel = allHWInfos[HWAccelNone]
+	var ss float64
+	if start > 0 && start < len(s.context.chunks) {
+		// seek to the exact start of the chunk, which is a keyframe if keyframes are known.
+		ss = s.context.chunks[start].start
 	}
 
+	return s.buildSeekArgs(ss, start, transcode, format, pipe)
+}
+
+// buildSeekArgs builds the args starting at ss seconds, start is the index of the first segment if it's segmented.
+func (s *Stream) buildSeekArgs(ss float64, start int, transcode bool, format string, pipe bool) []string {
+	hwAccel := s.encoderHWInfo()
+
 	args := []string{
 		"-loglevel", "debug", // set log level to debug, only debug level could get ts ended.
 		"-noaccurate_seek",
 		"-noautorotate",
 	}
 
-	if start > 0 {
-		ss := float64(start)
-		if s.format == FormatHLS {
-			ss = ss * float64(s.context.contextConfig.ChunkDuration)
-		}
-
+	if ss > 0 {
 		args = append(args, "-ss", fmt.Sprintf("%.6f", ss))
 	}
 
-	if len(hwAccel.decoderArgs) != 0 && transcode {
+	if len(hwAccel.decoderArgs) != 0 && transcode && s.audio == nil {
 		args = append(args, "-hwaccel")
 		args = append(args, hwAccel.decoderArgs...)
 	}
 
+	args = append(args, s.context.contextConfig.inputArgs(s.context.path)...)
 	args = append(args, "-i", s.context.path)
 	args = append(args, "-y", "-copyts", "-fflags", "+genpts")
+	args = append(args, s.mapArgs()...)
 	// args = append(args, "-start_at_zero")
-	if format == FormatHLS {
+	// the fmp4 segments set their own format.
+	if format == FormatHLS && s.segmentContainer() != ContainerFMP4 {
 		args = append(args, "-f", "mpegts")
 	}
-	if !transcode {
+	switch {
+	case !transcode:
 		args = append(args, "-c", "copy")
-	} else {
-		// if transcode, we only support h264 and aac
+	case s.audio != nil:
+		args = append(args, "-c:a", "aac")
+	default:
+		// the audio is always aac
+		encoderArgs, _ := hwAccel.encoder(s.spec.Codec)
+		if hwAccel.codec == HWAccelNone {
+			encoderArgs = s.fasterPreset(encoderArgs)
+		}
 		args = append(args, "-c:v")
-		args = append(args, hwAccel.encoderArgs...)
+		args = append(args, encoderArgs...)
 
 		if s.spec.Bitrate > 0 {
 			args = append(args, "-b:v", strconv.Itoa(int(float64(s.spec.Bitrate)*hwAccel.encodeFactor)))
 		}
 
-		args = append(args, "-c:a", "aac")
-		if s.spec.Width > 0 {
-			// if width>0, we must set height already
-			args = append(args, hwAccel.scaleArgs(s.spec.Width, s.spec.Height)...)
+		if len(s.context.audios) == 0 {
+			args = append(args, "-c:a", "aac")
+		}
+		args = append(args, s.filterArgs(hwAccel)...)
+		if s.tonemap() {
+			args = append(args, "-color_primaries", "bt709", "-color_trc", "bt709", "-colorspace", "bt709")
 		}
 	}
 
+	// Safari only plays hevc in mp4 with hvc1 tag.
+	if s.audio == nil && s.videoCodec() == CodecHEVC && (format == FormatMP4 || s.segmentContainer() == ContainerFMP4) {
+		args = append(args, "-tag:v", "hvc1")
+	}
 	if format == FormatMP4 {
 		args = append(args, "-movflags", "frag_keyframe+empty_moov")
 	}
 	if format == FormatMP4 {
 		args = append(args, "-f", format)
 	}
-	if format == FormatHLS {
-		args = append(args, s.buildHLSArgs(start, transcode)...)
+	if segmented(format) {
+		if s.segmentContainer() == ContainerFMP4 {
+			args = append(args, s.buildFMP4Args(start, transcode)...)
+		} else {
+			args = append(args, s.buildHLSArgs(start, transcode)...)
+		}
 	}
 
 	if pipe {
@@ -73,66 +97,88 @@ func (s *Stream) buildFFMpegArgs(start int, transcode bool, format string, pipe
 	return args
 }
 
+// filterArgs returns the -vf chain of the video, it's deinterlaced first, then tonemapped or scaled.
+func (s *Stream) filterArgs(hwAccel hwInfo) []string {
+	var args []string
+
+	switch {
+	case s.tonemap():
+		// if width>0, we must set height already
+		args = hwAccel.tonemapArgs(s.probe.ColorTransfer, s.spec.Width, s.spec.Height)
+	case s.spec.Width > 0:
+		args = hwAccel.scaleArgs(s.spec.Width, s.spec.Height)
+	}
+
+	if s.deinterlace() {
+		config := s.context.contextConfig
+		args = prependFilter(args, hwAccel.deinterlace(config.Deinterlace, config.doubleRate(), s.tonemap()))
+	}
+
+	return args
+}
+
+// mapArgs selects the input streams explicitly when the audio tracks are served as separated renditions,
+// otherwise we let ffmpeg pick the streams.
+func (s *Stream) mapArgs() []string {
+	switch {
+	case s.audio != nil:
+		return []string{"-map", "0:" + strconv.Itoa(s.audio.Index), "-vn", "-sn"}
+	case len(s.context.audios) > 0:
+		return []string{"-map", "0:v:0", "-an", "-sn"}
+	}
+
+	return nil
+}
+
 func (s *Stream) buildHLSArgs(start int, transcode bool) []string {
 	args := []string{
 		"-max_delay", "5000000",
 		"-avoid_negative_ts", "disabled",
 		"-f", "segment",
 		"-segment_format", "mpegts",
-		"-segment_list", filepath.Join(s.context.contextConfig.TmpPath, "index.m3u8"),
+		"-segment_list", filepath.Join(s.dir(), "index.m3u8"),
 		"-segment_list_type", "m3u8",
-		"-segment_time", formatTime(s.context.contextConfig.ChunkDuration),
 		"-segment_start_number", strconv.Itoa(start),
 		"-break_non_keyframes", "1",
 		"-individual_header_trailer", "0",
 		"-write_header_trailer", "0",
-		filepath.Join(s.context.contextConfig.TmpPath, "%d.ts"),
 	}
-	if transcode {
-		args = append(args, "-force_key_frames", "expr:gte(t,n_forced*3)")
+	// cut at the chunk starts, so the segments match the playlist.
+	// with -copyts, the times are the source timestamps.
+	if times := formatTimes(s.context.chunks, start); times != "" {
+		args = append(args, "-segment_times", times)
+		// output options must be set before the output.
+		if transcode && s.audio == nil {
+			args = append(args, "-force_key_frames", times)
+		}
 	}
 
-	return args
+	return append(args, filepath.Join(s.dir(), "%d.ts"))
 }
 
-//
-// func (s *Stream) buildM4SFFMpegArgs(start int, transcode bool, format string, pipe bool) []string {
-//	hw, ok := allHWInfos[s.context.contextConfig.HWAccel]
-//	if !ok {
-//		hw = allHWInfos[HWAccelNone]
-//	}
-//	args := []string{
-//		"-loglevel", "debug", // set log level to debug, only debug level could get ts ended.
-//		"-report",
-//		"-noaccurate_seek",
-//		"-noautorotate",
-//	}
-//	if start > 0 {
-//		ss := float64(start)
-//		if s.format == FormatHLS {
-//			ss = ss * float64(s.context.contextConfig.ChunkDuration)
-//		}
-//		args = append(args, "-ss", fmt.Sprintf("%.6f", ss))
-//	}
-//	if hw.decoder != "" && transcode {
-//		args = append(args, "-hwaccel", hw.decoder)
-//	}
-//	args = append(args, "-i", s.context.path)
-//	args = append(args, "-y")
-//	args = append(args, "-copyts")
-//	args = append(args, "-c", "copy")
-//	//-f hls \
-//	//-hls_fmp4_init_filename pelicans-128k-IS.mp4 \
-//	//-hls_segment_filename pelicans-128k-%d.m4s \
-//	//-hls_segment_type fmp4 \
-//	//-hls_time 6 \
-//	//temp.m3u8
-//	args = append(args, "-f", "hls")
-//	args = append(args, "-hls_fmp4_init_filename", "init.mp4")
-//	args = append(args, "-hls_segment_filename", "%d.m4s")
-//	args = append(args, "-hls_segment_type", "fmp4")
-//	args = append(args, "-hls_time", "6")
-//	args = append(args, "temp.m3u8")
-//
-//	return args
-//}
+const initSegmentFile = "init.mp4"
+
+// buildFMP4Args segments the stream into fragmented mp4 with the segment muxer, like buildHLSArgs, so the segments
+// are cut at the chunk starts. The header is written once to the init segment, the segments are only fragments.
+func (s *Stream) buildFMP4Args(start int, transcode bool) []string {
+	args := []string{
+		"-max_delay", "5000000",
+		"-avoid_negative_ts", "disabled",
+		"-f", "segment",
+		"-segment_format", "mp4",
+		"-segment_format_options", "movflags=+frag_keyframe+empty_moov+default_base_moof+skip_trailer",
+		"-segment_header_filename", filepath.Join(s.dir(), initSegmentFile),
+		"-segment_list", filepath.Join(s.dir(), "index.m3u8"),
+		"-segment_list_type", "m3u8",
+		"-segment_start_number", strconv.Itoa(start),
+	}
+	// with -copyts, the times are the source timestamps, the fragments must start at keyframes.
+	if times := formatTimes(s.context.chunks, start); times != "" {
+		args = append(args, "-segment_times", times)
+		if transcode && s.audio == nil {
+			args = append(args, "-force_key_frames", times)
+		}
+	}
+
+	return append(args, filepath.Join(s.dir(), "%d.m4s"))
+}
@@ -0,0 +1,459 @@
+package vod
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrContextNotFound = errors.New("context not found")
+	ErrInvalidIndex    = errors.New("invalid chunk index")
+)
+
+const (
+	routePlaylist = "/index.m3u8"
+	routeManifest = "/manifest.mpd"
+	routeSegment  = "/ts"
+	routeInit     = "/init"
+	routeMP4      = "/mp4"
+	routeSubtitle = "/subtitle.vtt"
+	routeSprite   = "/sprite"
+	routeImages   = "/trickplay.m3u8"
+	routeThumbs   = "/trickplay.vtt"
+	routeKey      = "/key"
+)
+
+// Handler returns a http.Handler which serves the contexts of the service.
+// Mount it at prefix, the routes below match the urls produced by DefaultListGenerator
+// and DefaultTSGenerator when prefix is "/video":
+//
+//	{prefix}/index.m3u8?id={id}             master playlist, or the only variant playlist
+//	{prefix}/index.m3u8?id={id}&spec={spec} variant playlist
+//	{prefix}/manifest.mpd?id={id}           dash manifest
+//	{prefix}/ts?id={id}&spec={spec}&index=N segment
+//	{prefix}/init?id={id}&spec={spec}       init segment of fmp4 segments, matches DefaultInitGenerator
+//	{prefix}/mp4?id={id}[&spec={spec}]      progressive mp4, supports byte range if the source is passed through
+//	{prefix}/mp4?id={id}&start={seconds}    progressive mp4 starts at the time offset
+//	{prefix}/subtitle.vtt?id={id}&key={key} whole subtitle track in WebVTT
+//	{prefix}/sprite?id={id}&index=N         trickplay sprite sheet, matches DefaultSpriteGenerator
+//	{prefix}/trickplay.m3u8?id={id}         image playlist of the sprite sheets
+//	{prefix}/trickplay.vtt?id={id}          WebVTT thumbnail track
+//	{prefix}/key?id={id}                    AES-128 key of the segments, matches DefaultKeyGenerator
+//
+// Creating the context is still the job of the caller.
+// If ContextConfig.Signer of the context is set, every request of it must carry a valid token, see URLSigner.
+// The requests of the unknown contexts are verified by the signer of the service.
+func (s *Service) Handler(prefix string) http.Handler {
+	return &handler{
+		service: s,
+		prefix:  strings.TrimSuffix(prefix, "/"),
+	}
+}
+
+type handler struct {
+	service *Service
+	prefix  string
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	route, ok := strings.CutPrefix(r.URL.Path, h.prefix)
+	if !ok {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if signer := h.signer(id); signer != nil {
+		if err := signer.Verify(r, id); err != nil {
+			writeError(w, err)
+
+			return
+		}
+	}
+
+	switch route {
+	case routePlaylist, routeManifest:
+		h.playlist(w, r)
+	case routeSegment:
+		h.segment(w, r)
+	case routeInit:
+		h.init(w, r)
+	case routeMP4:
+		h.mp4(w, r)
+	case routeSubtitle:
+		h.subtitle(w, r)
+	case routeSprite:
+		h.sprite(w, r)
+	case routeImages, routeThumbs:
+		h.trickplay(w, r, route)
+	case routeKey:
+		h.key(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// signer returns the signer of the context, or the signer of the service if the context is unknown,
+// so the requests don't tell whether the id exists.
+func (h *handler) signer(id string) *URLSigner {
+	if context := h.service.Context(id); context != nil {
+		return context.contextConfig.Signer
+	}
+
+	return h.service.config.Signer
+}
+
+func (h *handler) context(r *http.Request) (*Context, error) {
+	context := h.service.Context(r.URL.Query().Get("id"))
+	if context == nil {
+		return nil, ErrContextNotFound
+	}
+
+	return context, nil
+}
+
+func (h *handler) stream(r *http.Request) (*Context, *Stream, error) {
+	context, err := h.context(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stream := context.Stream(r.URL.Query().Get("spec"))
+	if stream == nil {
+		return nil, nil, ErrStreamNotFound
+	}
+
+	return context, stream, nil
+}
+
+func (h *handler) playlist(w http.ResponseWriter, r *http.Request) {
+	var (
+		context *Context
+		content io.ReadCloser
+		err     error
+	)
+
+	if r.URL.Query().Get("spec") == "" {
+		context, err = h.context(r)
+		if err == nil {
+			content, err = context.Content()
+		}
+	} else {
+		var stream *Stream
+		context, stream, err = h.stream(r)
+		if err == nil {
+			content, err = stream.Content()
+		}
+	}
+
+	if err != nil {
+		writeError(w, err)
+
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", context.MimeType())
+	h.copySigned(w, r, context, content, context.contextConfig.Format == FormatDASH)
+}
+
+func (h *handler) segment(w http.ResponseWriter, r *http.Request) {
+	_, stream, err := h.stream(r)
+	if err != nil {
+		writeError(w, err)
+
+		return
+	}
+
+	index, err := strconv.Atoi(r.URL.Query().Get("index"))
+	if err != nil || index < 0 || index >= stream.ChunkLength() {
+		writeError(w, ErrInvalidIndex)
+
+		return
+	}
+
+	chunk, err := stream.Chunk(index, index)
+	if err != nil {
+		writeError(w, err)
+
+		return
+	}
+	defer chunk.Close()
+
+	w.Header().Set("Content-Type", stream.ChunkMimeType())
+	_, _ = io.Copy(w, chunk)
+}
+
+func (h *handler) init(w http.ResponseWriter, r *http.Request) {
+	_, stream, err := h.stream(r)
+	if err != nil {
+		writeError(w, err)
+
+		return
+	}
+
+	content, err := stream.Init()
+	if err != nil {
+		writeError(w, err)
+
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", MimeType(FormatMP4))
+	_, _ = io.Copy(w, content)
+}
+
+// mp4 serves the progressive mp4.
+// The passed through source supports byte range requests, otherwise the start query could be used to seek,
+// which is the time offset in seconds.
+func (h *handler) mp4(w http.ResponseWriter, r *http.Request) {
+	context, err := h.context(r)
+	if err != nil {
+		writeError(w, err)
+
+		return
+	}
+
+	// the first stream is the content of the context.
+	stream := context.streams[0]
+	if spec := r.URL.Query().Get("spec"); spec != "" {
+		stream = context.Stream(spec)
+	}
+	if stream == nil {
+		writeError(w, ErrStreamNotFound)
+
+		return
+	}
+
+	if stream.Passthrough() {
+		source, modTime, err := stream.source()
+		if err != nil {
+			writeError(w, err)
+
+			return
+		}
+		defer source.Close()
+
+		w.Header().Set("Content-Type", context.MimeType())
+		// ServeContent handles Range, If-Range and Content-Range for us.
+		http.ServeContent(w, r, "", modTime, source)
+
+		return
+	}
+
+	var content io.ReadCloser
+
+	if start := r.URL.Query().Get("start"); start != "" {
+		seconds, err := strconv.ParseFloat(start, 64)
+		if err != nil {
+			writeError(w, ErrInvalidSeek)
+
+			return
+		}
+		content, err = stream.Seek(time.Duration(seconds * float64(time.Second)))
+		if err != nil {
+			writeError(w, err)
+
+			return
+		}
+	} else {
+		content, err = stream.Content()
+		if err != nil {
+			writeError(w, err)
+
+			return
+		}
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", context.MimeType())
+	w.Header().Set("Accept-Ranges", "none")
+	copyFlush(w, content)
+}
+
+func (h *handler) subtitle(w http.ResponseWriter, r *http.Request) {
+	context, err := h.context(r)
+	if err != nil {
+		writeError(w, err)
+
+		return
+	}
+
+	content, err := context.Subtitle(r.URL.Query().Get("key"))
+	if err != nil {
+		writeError(w, err)
+
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", "text/vtt")
+	_, _ = io.Copy(w, content)
+}
+
+func (h *handler) sprite(w http.ResponseWriter, r *http.Request) {
+	context, err := h.context(r)
+	if err != nil {
+		writeError(w, err)
+
+		return
+	}
+
+	index, err := strconv.Atoi(r.URL.Query().Get("index"))
+	if err != nil {
+		writeError(w, ErrInvalidIndex)
+
+		return
+	}
+
+	content, err := context.Sprite(index)
+	if err != nil {
+		writeError(w, err)
+
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", context.SpriteMimeType())
+	_, _ = io.Copy(w, content)
+}
+
+func (h *handler) trickplay(w http.ResponseWriter, r *http.Request, route string) {
+	context, err := h.context(r)
+	if err != nil {
+		writeError(w, err)
+
+		return
+	}
+
+	var content io.ReadCloser
+
+	mimeType := "text/vtt"
+	if route == routeImages {
+		mimeType = MimeType(FormatHLS)
+		content, err = context.TrickplayPlaylist()
+	} else {
+		content, err = context.Thumbnails()
+	}
+
+	if err != nil {
+		writeError(w, err)
+
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", mimeType)
+	h.copySigned(w, r, context, content, false)
+}
+
+// copySigned copies the playlist, the token of the request is appended to the urls in it if the context signs them.
+func (h *handler) copySigned(w http.ResponseWriter, r *http.Request, context *Context, content io.Reader, manifest bool) {
+	if context.contextConfig.Signer == nil {
+		_, _ = io.Copy(w, content)
+
+		return
+	}
+
+	body, err := io.ReadAll(content)
+	if err != nil {
+		writeError(w, err)
+
+		return
+	}
+
+	if manifest {
+		body = signManifest(body, requestToken(r))
+	} else {
+		body = signPlaylist(body, requestToken(r))
+	}
+	_, _ = w.Write(body)
+}
+
+// copyFlush copies the content to the client and flush after every write,
+// so the client could start playing before ffmpeg finished.
+func copyFlush(w http.ResponseWriter, r io.Reader) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		_, _ = io.Copy(w, r)
+
+		return
+	}
+
+	const bufLen = 1024 * 1024 // 1Mb
+
+	buf := make([]byte, bufLen)
+
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			flusher.Flush()
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// key serves the raw key, it must not be cached by the proxies.
+func (h *handler) key(w http.ResponseWriter, r *http.Request) {
+	context, err := h.context(r)
+	if err != nil {
+		writeError(w, err)
+
+		return
+	}
+
+	key, err := context.Key()
+	if err != nil {
+		writeError(w, err)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(key)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrBusy) {
+		w.Header().Set("Retry-After", strconv.Itoa(busyRetryAfter))
+	}
+	http.Error(w, err.Error(), statusCode(err))
+}
+
+// statusCode maps the error to the http status code.
+// Anything we don't know is treated as ffmpeg failure.
+func statusCode(err error) int {
+	switch {
+	case errors.Is(err, ErrContextNotFound), errors.Is(err, ErrStreamNotFound), errors.Is(err, ErrTrickplayDisabled),
+		errors.Is(err, ErrEncryptionDisabled):
+		return http.StatusNotFound
+	case errors.Is(err, ErrSignatureInvalid), errors.Is(err, ErrSignatureExpired):
+		return http.StatusForbidden
+	case errors.Is(err, ErrRangeNotSupported):
+		return http.StatusRequestedRangeNotSatisfiable
+	case errors.Is(err, ErrInvalidIndex), errors.Is(err, ErrInvalidFormat), errors.Is(err, ErrInvalidSeek):
+		return http.StatusBadRequest
+	}
+
+	return http.StatusServiceUnavailable
+}
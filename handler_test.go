@@ -0,0 +1,90 @@
+package vod
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlerServesPlaylist(t *testing.T) {
+	handler := newTestService(t, "test").Handler("/video")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/video/index.m3u8?id=test", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/x-mpegURL", recorder.Header().Get("Content-Type"))
+	assert.Contains(t, recorder.Body.String(), "/video/ts?id=test&index=3&spec=Origin")
+	assert.Equal(t, 4, strings.Count(recorder.Body.String(), "#EXTINF"))
+}
+
+func TestHandlerReturnsNotFoundForUnknownContext(t *testing.T) {
+	handler := newTestService(t, "test").Handler("/video")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/video/index.m3u8?id=unknown", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestHandlerReturnsNotFoundForUnknownSpec(t *testing.T) {
+	handler := newTestService(t, "test").Handler("/video")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/video/ts?id=test&spec=unknown&index=0", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestHandlerReturnsBadRequestForInvalidIndex(t *testing.T) {
+	handler := newTestService(t, "test").Handler("/video")
+
+	for _, index := range []string{"", "abc", "-1", "4"} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/video/ts?id=test&spec=Origin&index="+index, nil))
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, "index %q", index)
+	}
+}
+
+func TestHandlerReturnsNotFoundForUnknownRoute(t *testing.T) {
+	handler := newTestService(t, "test").Handler("/video")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/other/index.m3u8?id=test", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestStatusCodeTreatsUnknownErrorAsUnavailable(t *testing.T) {
+	assert.Equal(t, http.StatusServiceUnavailable, statusCode(ErrNoChunkID))
+	assert.Equal(t, http.StatusNotFound, statusCode(ErrStreamNotFound))
+}
+
+func TestHandlerServesByteRangeForPassthroughMP4(t *testing.T) {
+	service := newTestService(t)
+	info := &ProbeInfo{Duration: 20, Format: "mov,mp4,m4a,3gp,3g2,mj2", VideoCodec: "h264", AudioCodec: "aac"}
+	context := addTestContext(t, service, "mp4", &ContextConfig{Format: FormatMP4}, info)
+	context.path = "testdata/test.mp3"
+
+	request := httptest.NewRequest(http.MethodGet, "/video/mp4?id=mp4", nil)
+	request.Header.Set("Range", "bytes=0-9")
+	recorder := httptest.NewRecorder()
+	service.Handler("/video").ServeHTTP(recorder, request)
+
+	stat, err := os.Stat(context.path)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, recorder.Code)
+	assert.Equal(t, fmt.Sprintf("bytes 0-9/%d", stat.Size()), recorder.Header().Get("Content-Range"))
+	assert.Equal(t, "video/mp4", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, 10, recorder.Body.Len())
+}
+
+func TestHandlerRejectsInvalidSeek(t *testing.T) {
+	service := newTestService(t)
+	info := &ProbeInfo{Duration: 20, Format: "flv", VideoCodec: "h264", AudioCodec: "aac"}
+	addTestContext(t, service, "mp4", &ContextConfig{Format: FormatMP4}, info)
+
+	for _, start := range []string{"abc", "-1", "20"} {
+		recorder := httptest.NewRecorder()
+		service.Handler("/video").ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/video/mp4?id=mp4&start="+start, nil))
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, "start %q", start)
+	}
+}
@@ -35,6 +35,13 @@ type hwInfo struct {
 	encodeFactor float64
 	detector     hwDetectFunc
 	scaleArgs    func(w, h int) []string
+	// tonemapArgs maps the HDR video of the transfer to SDR, then scales it like scaleArgs if w > 0.
+	tonemapArgs func(transfer string, w, h int) []string
+	// deinterlace returns the deinterlace filter, the software filter is used by the encoders without their own.
+	// The hdr frames are kept in p010 for the tonemap.
+	deinterlace func(software string, double, hdr bool) string
+	// encoders are the encoder args of the codecs other than h264, which uses encoderArgs.
+	encoders map[string][]string
 }
 
 //	func (h *HWAccel) String() string {
@@ -51,6 +58,13 @@ var allHWInfos = map[HWAccel]hwInfo{
 		1,
 		func(string) bool { return true },
 		scaleArgs,
+		tonemapArgs,
+		deinterlaceFilter,
+		map[string][]string{
+			CodecHEVC: {"libx265", "-preset", "fast", "-crf", "28"},
+			CodecAV1:  {"libsvtav1", "-preset", "8", "-crf", "35"},
+			CodecVP9:  {"libvpx-vp9", "-deadline", "realtime", "-cpu-used", "8", "-row-mt", "1", "-crf", "33", "-b:v", "0"},
+		},
 	},
 	HWAccelAuto: {
 		HWAccelAuto,
@@ -59,6 +73,9 @@ var allHWInfos = map[HWAccel]hwInfo{
 		1,
 		func(string) bool { return false },
 		scaleArgs,
+		tonemapArgs,
+		deinterlaceFilter,
+		nil,
 	},
 	HWAccelNVENC: {
 		HWAccelNVENC,
@@ -75,6 +92,12 @@ var allHWInfos = map[HWAccel]hwInfo{
 		2,
 		detectNVENC,
 		scaleNVENC,
+		tonemapNVENC,
+		deinterlaceNVENC,
+		map[string][]string{
+			CodecHEVC: {"hevc_nvenc", "-preset", "p6", "-tune", "ll", "-rc", "vbr", "-rc-lookahead", "30", "-cq", "28", "-temporal-aq", "1"},
+			CodecAV1:  {"av1_nvenc", "-preset", "p6", "-tune", "ll", "-rc", "vbr", "-rc-lookahead", "30", "-cq", "35"},
+		},
 	},
 	HWAccelVTB: {
 		HWAccelVTB,
@@ -84,6 +107,11 @@ var allHWInfos = map[HWAccel]hwInfo{
 		2,
 		detectVTB,
 		scaleArgs,
+		tonemapArgs,
+		deinterlaceFilter,
+		map[string][]string{
+			CodecHEVC: {"hevc_videotoolbox", "-q:v", "50"},
+		},
 	},
 	HWAccelQSV: {
 		HWAccelQSV,
@@ -93,6 +121,13 @@ var allHWInfos = map[HWAccel]hwInfo{
 		2,
 		detectQSV,
 		scaleArgs,
+		tonemapOpenCL,
+		deinterlaceQSV,
+		map[string][]string{
+			CodecHEVC: {"hevc_qsv"},
+			CodecAV1:  {"av1_qsv"},
+			CodecVP9:  {"vp9_qsv"},
+		},
 	},
 	HWAccelAMF: {
 		HWAccelAMF,
@@ -102,6 +137,12 @@ var allHWInfos = map[HWAccel]hwInfo{
 		2,
 		detectAMF,
 		scaleArgs,
+		tonemapOpenCL,
+		deinterlaceFilter,
+		map[string][]string{
+			CodecHEVC: {"hevc_amf"},
+			CodecAV1:  {"av1_amf"},
+		},
 	},
 	HWAccelVAAPI: {
 		HWAccelVAAPI,
@@ -111,6 +152,13 @@ var allHWInfos = map[HWAccel]hwInfo{
 		2,
 		detectVAAPI,
 		scaleVAAPI,
+		tonemapVAAPI,
+		deinterlaceVAAPI,
+		map[string][]string{
+			CodecHEVC: {"hevc_vaapi", "-global_quality", "25"},
+			CodecAV1:  {"av1_vaapi", "-global_quality", "30"},
+			CodecVP9:  {"vp9_vaapi", "-global_quality", "30"},
+		},
 	},
 	HWAccelVAAPILP: {
 		HWAccelVAAPILP,
@@ -120,6 +168,13 @@ var allHWInfos = map[HWAccel]hwInfo{
 		2,
 		detectVAAPI,
 		scaleVAAPI,
+		tonemapVAAPI,
+		deinterlaceVAAPI,
+		map[string][]string{
+			CodecHEVC: {"hevc_vaapi", "-low_power", "1"},
+			CodecAV1:  {"av1_vaapi", "-low_power", "1"},
+			CodecVP9:  {"vp9_vaapi", "-low_power", "1"},
+		},
 	},
 }
 
@@ -145,6 +200,119 @@ func scaleNVENC(w, h int) []string {
 	}
 }
 
+// sdrFilter are the options of the hardware tonemap filters to output bt709.
+const sdrFilter = "t=bt709:m=bt709:p=bt709"
+
+// tonemapFilter maps on the cpu.
+const tonemapFilter = "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709,tonemap=tonemap=hable:desat=0," +
+	"zscale=t=bt709:m=bt709:r=tv,format=nv12"
+
+func tonemapArgs(_ string, w, h int) []string {
+	filter := tonemapFilter
+	if w > 0 {
+		filter += fmt.Sprintf(",scale=force_original_aspect_ratio=decrease:w=%d:h=%d", w, h)
+	}
+
+	return []string{"-vf", filter}
+}
+
+// tonemapOpenCL maps on the gpu by opencl, the frames are downloaded for the encoder.
+func tonemapOpenCL(_ string, w, h int) []string {
+	filter := "format=p010,hwupload,tonemap_opencl=tonemap=hable:desat=0:format=nv12:" + sdrFilter + ",hwdownload,format=nv12"
+	if w > 0 {
+		filter += fmt.Sprintf(",scale=force_original_aspect_ratio=decrease:w=%d:h=%d", w, h)
+	}
+
+	return []string{"-init_hw_device", "opencl=ocl", "-filter_hw_device", "ocl", "-vf", filter}
+}
+
+// tonemapVAAPI maps HDR10 on the gpu, but HLG on the cpu as tonemap_vaapi doesn't support it,
+// the decoded frames are downloaded then uploaded again for the encoder.
+func tonemapVAAPI(transfer string, w, h int) []string {
+	filter := "format=p010|vaapi,hwupload,tonemap_vaapi=format=nv12:" + sdrFilter
+	if transfer == transferHLG {
+		filter = "hwdownload,format=p010le," + tonemapFilter + ",hwupload"
+	}
+	if w > 0 {
+		filter += fmt.Sprintf(",scale_vaapi=force_original_aspect_ratio=decrease:format=nv12:w=%d:h=%d", w, h)
+	}
+
+	return []string{"-vf", filter}
+}
+
+func tonemapNVENC(_ string, w, h int) []string {
+	filter := "format=p010|cuda,hwupload,tonemap_cuda=tonemap=hable:desat=0:format=nv12:" + sdrFilter
+	if w > 0 {
+		filter += fmt.Sprintf(",scale_cuda=force_original_aspect_ratio=decrease:passthrough=0:w=%d:h=%d", w, h)
+	}
+
+	return []string{"-vf", filter}
+}
+
+// fieldMode returns the mode of yadif and bwdif.
+func fieldMode(double bool) string {
+	if double {
+		return "send_field"
+	}
+
+	return "send_frame"
+}
+
+// hwFormat returns the pixel format the frames are uploaded in.
+func hwFormat(hdr bool) string {
+	if hdr {
+		return "p010"
+	}
+
+	return "nv12"
+}
+
+// deinterlaceFilter keeps the pixel format of the decoder, so the hdr frames are still 10-bit.
+func deinterlaceFilter(software string, double, _ bool) string {
+	if software != DeinterlaceYADIF {
+		software = DeinterlaceBWDIF
+	}
+
+	return software + "=mode=" + fieldMode(double) + ":deint=interlaced"
+}
+
+func deinterlaceVAAPI(_ string, double, hdr bool) string {
+	rate := "frame"
+	if double {
+		rate = "field"
+	}
+
+	return "format=" + hwFormat(hdr) + "|vaapi,hwupload,deinterlace_vaapi=rate=" + rate
+}
+
+// deinterlaceQSV can't double the frame rate. The hdr frames are deinterlaced on the cpu, since the opencl tonemap
+// sets the filter device, so the hwupload would go to opencl instead of qsv.
+func deinterlaceQSV(software string, _, hdr bool) string {
+	if hdr {
+		return deinterlaceFilter(software, false, hdr)
+	}
+
+	return "format=nv12,hwupload=extra_hw_frames=64,deinterlace_qsv=mode=advanced,hwdownload,format=nv12"
+}
+
+func deinterlaceNVENC(_ string, double, hdr bool) string {
+	return "format=" + hwFormat(hdr) + "|cuda,hwupload,yadif_cuda=mode=" + fieldMode(double) + ":deint=interlaced"
+}
+
+// prependFilter puts the filter before the -vf chain of the args, or adds the -vf if there is none.
+func prependFilter(args []string, filter string) []string {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "-vf" {
+			prepended := append([]string(nil), args...)
+			prepended[i+1] = filter + "," + args[i+1]
+
+			return prepended
+		}
+	}
+
+	return append(args, "-vf", filter)
+}
+
 func detectVTB(ffmpeg string) bool {
 	if runtime.GOOS == "darwin" {
 		cmd := exec.Command(ffmpeg, "-hide_banner", "-hwaccels")
@@ -229,3 +397,32 @@ func detectNVENC(ffmpeg string) bool {
 
 	return true
 }
+
+// encoder returns the encoder args of the codec, ok is false if the backend can't encode it.
+func (h hwInfo) encoder(codec string) ([]string, bool) {
+	if codec == "" || codec == CodecH264 {
+		return h.encoderArgs, len(h.encoderArgs) != 0
+	}
+
+	args, ok := h.encoders[codec]
+
+	return args, ok
+}
+
+// downloadFilter returns the filter which downloads the decoded frames of the pixel format to the system memory,
+// the frames of the 10-bit video are p010 in the gpu memory.
+// It's needed by the software filters if the decoder keeps the frames in the gpu memory.
+func (h hwInfo) downloadFilter(pixelFormat string) string {
+	for _, arg := range h.decoderArgs {
+		if arg != "-hwaccel_output_format" {
+			continue
+		}
+		if bitDepth(pixelFormat) > 8 {
+			return "hwdownload,format=p010le"
+		}
+
+		return "hwdownload,format=nv12"
+	}
+
+	return ""
+}
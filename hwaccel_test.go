@@ -61,3 +61,42 @@ func TestScaleNVENCHandlesZeroWidthAndHeight(t *testing.T) {
 	args := scaleNVENC(0, 0)
 	assert.Equal(t, []string{"-vf", "format=nv12|cuda,hwupload,scale_cuda=force_original_aspect_ratio=decrease:passthrough=0:w=0:h=0"}, args)
 }
+
+func TestTonemapArgsScalesAfterTonemap(t *testing.T) {
+	args := tonemapArgs(transferPQ, 1280, 720)
+	assert.Equal(t, "-vf", args[0])
+	assert.Regexp(t, `^zscale=t=linear.*,tonemap=tonemap=hable.*,format=nv12,scale=force_original_aspect_ratio=decrease:w=1280:h=720$`, args[1])
+	assert.NotContains(t, tonemapArgs(transferPQ, 0, 0)[1], "force_original_aspect_ratio")
+}
+
+func TestTonemapHardwareArgs(t *testing.T) {
+	assert.Equal(t, []string{"-vf", "format=p010|vaapi,hwupload,tonemap_vaapi=format=nv12:t=bt709:m=bt709:p=bt709," +
+		"scale_vaapi=force_original_aspect_ratio=decrease:format=nv12:w=1280:h=720"}, tonemapVAAPI(transferPQ, 1280, 720))
+	assert.Equal(t, []string{"-vf", "format=p010|cuda,hwupload,tonemap_cuda=tonemap=hable:desat=0:format=nv12:t=bt709:m=bt709:p=bt709"},
+		tonemapNVENC(transferPQ, 0, 0))
+
+	args := tonemapOpenCL(transferPQ, 1280, 720)
+	assert.Equal(t, []string{"-init_hw_device", "opencl=ocl", "-filter_hw_device", "ocl", "-vf"}, args[:5])
+	assert.Contains(t, args[5], "tonemap_opencl=")
+	assert.Contains(t, args[5], ",hwdownload,format=nv12,scale=")
+}
+
+func TestDeinterlaceFilters(t *testing.T) {
+	assert.Equal(t, "bwdif=mode=send_frame:deint=interlaced", deinterlaceFilter("", false, false))
+	assert.Equal(t, "yadif=mode=send_field:deint=interlaced", deinterlaceFilter(DeinterlaceYADIF, true, false))
+	assert.Equal(t, "format=nv12|vaapi,hwupload,deinterlace_vaapi=rate=field", deinterlaceVAAPI(DeinterlaceYADIF, true, false))
+	assert.Equal(t, "format=nv12|cuda,hwupload,yadif_cuda=mode=send_frame:deint=interlaced", deinterlaceNVENC("", false, false))
+	assert.Contains(t, deinterlaceQSV("", true, false), "deinterlace_qsv=mode=advanced")
+	// the hdr frames stay in p010 for the tonemap.
+	assert.Equal(t, "format=p010|vaapi,hwupload,deinterlace_vaapi=rate=frame", deinterlaceVAAPI("", false, true))
+	assert.Equal(t, "format=p010|cuda,hwupload,yadif_cuda=mode=send_field:deint=interlaced", deinterlaceNVENC("", true, true))
+	assert.Equal(t, "format=nv12,hwupload=extra_hw_frames=64,deinterlace_qsv=mode=advanced,hwdownload,format=nv12",
+		deinterlaceQSV("", false, false))
+	// the opencl tonemap owns the filter device, qsv still doesn't double the frame rate.
+	assert.Equal(t, "yadif=mode=send_frame:deint=interlaced", deinterlaceQSV(DeinterlaceYADIF, true, true))
+
+	assert.Equal(t, []string{"-vf", "yadif,scale=w=1"}, prependFilter([]string{"-vf", "scale=w=1"}, "yadif"))
+	assert.Equal(t, []string{"-init_hw_device", "opencl=ocl", "-vf", "yadif,tonemap"},
+		prependFilter([]string{"-init_hw_device", "opencl=ocl", "-vf", "tonemap"}, "yadif"))
+	assert.Equal(t, []string{"-vf", "yadif"}, prependFilter(nil, "yadif"))
+}
@@ -0,0 +1,641 @@
+package vod
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrJobsDisabled = errors.New("jobs are disabled without output path")
+	ErrJobNotFound  = errors.New("job not found")
+	ErrJobState     = errors.New("job can't be changed in its state")
+	ErrJobSource    = errors.New("job source is not available")
+	errJobStopped   = errors.New("job is stopped")
+)
+
+type JobState string
+
+const (
+	JobQueued   = JobState("queued")
+	JobRunning  = JobState("running")
+	JobPaused   = JobState("paused")
+	JobDone     = JobState("done")
+	JobFailed   = JobState("failed")
+	JobCanceled = JobState("canceled")
+)
+
+const (
+	jobsFile         = "jobs.json"
+	outputSegments   = "segments"
+	jobContextPrefix = "job-"
+)
+
+// Job pre-transcodes the hls renditions of a source to OutputPath, so the contexts of the source serve them
+// without ffmpeg. All the specs, audio and subtitle tracks are rendered with the config of the service.
+// Done and Total count the segments, Total is 0 until the job starts.
+type Job struct {
+	ID       string
+	Path     string
+	Priority int // the higher runs first, the earlier added wins the ties
+	State    JobState
+	Done     int
+	Total    int
+	Error    string // why the job failed
+	Created  time.Time
+	Updated  time.Time
+
+	run int // counts the starts, so an interrupted run can't change the job started again
+}
+
+// Progress returns the rendered ratio from 0 to 1.
+func (j Job) Progress() float64 {
+	if j.Total == 0 {
+		return 0
+	}
+
+	return float64(j.Done) / float64(j.Total)
+}
+
+// before returns true if the job runs before the other one.
+func (j *Job) before(other *Job) bool {
+	if j.Priority != other.Priority {
+		return j.Priority > other.Priority
+	}
+	if !j.Created.Equal(other.Created) {
+		return j.Created.Before(other.Created)
+	}
+
+	return j.ID < other.ID
+}
+
+// jobQueue runs the jobs by their priorities, they are saved to the json file on every change, so they survive
+// restarts. The running job is interrupted by closing its context, then it continues from the rendered segments.
+type jobQueue struct {
+	m        sync.Mutex
+	jobs     map[string]*Job
+	contexts map[string]*Context // the contexts of the running jobs
+	file     string
+	workers  int
+	render   func(job Job) error
+	wake     chan struct{}
+	done     chan struct{}
+	stop     sync.Once
+	wg       sync.WaitGroup
+	logger   Logger
+}
+
+func newJobQueue(file string, workers int, render func(Job) error, logger Logger) (*jobQueue, error) {
+	q := &jobQueue{
+		jobs:     make(map[string]*Job),
+		contexts: make(map[string]*Context),
+		file:     file,
+		workers:  workers,
+		render:   render,
+		wake:     make(chan struct{}, workers),
+		done:     make(chan struct{}),
+		logger:   logger,
+	}
+
+	return q, q.load()
+}
+
+// load restores the jobs saved by the previous run.
+func (q *jobQueue) load() error {
+	content, err := os.ReadFile(q.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	jobs := make([]*Job, 0)
+	if err = json.Unmarshal(content, &jobs); err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		// interrupted by a crash, it continues from the rendered segments.
+		if job.State == JobRunning {
+			job.State = JobQueued
+		}
+		q.jobs[job.ID] = job
+	}
+
+	return nil
+}
+
+// save writes a tmp file first, so a crash never leaves a partial file, q.m must be held.
+func (q *jobQueue) save() {
+	content, err := json.MarshalIndent(q.list(), "", "  ")
+	if err == nil {
+		tmp := q.file + cacheTmpSuffix
+		if err = os.WriteFile(tmp, content, 0o600); err == nil {
+			err = os.Rename(tmp, q.file)
+		}
+	}
+
+	if err != nil {
+		q.logger.Errorf("failed to save the jobs: %v", err)
+	}
+}
+
+// list returns the jobs in the running order, q.m must be held.
+func (q *jobQueue) list() []Job {
+	jobs := make([]*Job, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].before(jobs[j])
+	})
+
+	list := make([]Job, 0, len(jobs))
+	for _, job := range jobs {
+		list = append(list, *job)
+	}
+
+	return list
+}
+
+func (q *jobQueue) start() {
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+
+		go q.run()
+	}
+}
+
+func (q *jobQueue) run() {
+	defer q.wg.Done()
+
+	for {
+		select {
+		case <-q.done:
+			return
+		default:
+		}
+
+		job, ok := q.next()
+		if !ok {
+			select {
+			case <-q.wake:
+			case <-q.done:
+				return
+			}
+
+			continue
+		}
+
+		q.finish(job, q.render(job))
+	}
+}
+
+// notify wakes up an idle worker.
+func (q *jobQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *jobQueue) add(path string, priority int) Job {
+	now := time.Now()
+	job := &Job{ID: newJobID(), Path: path, Priority: priority, State: JobQueued, Created: now, Updated: now}
+
+	q.m.Lock()
+	q.jobs[job.ID] = job
+	q.save()
+	added := *job
+	q.m.Unlock()
+
+	q.notify()
+
+	return added
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+func (q *jobQueue) get(id string) (Job, error) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+
+	return *job, nil
+}
+
+// next marks the first queued job running.
+func (q *jobQueue) next() (Job, bool) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	var next *Job
+
+	for _, job := range q.jobs {
+		if job.State == JobQueued && (next == nil || job.before(next)) {
+			next = job
+		}
+	}
+
+	if next == nil {
+		return Job{}, false
+	}
+
+	next.State = JobRunning
+	next.Error = ""
+	next.run++
+	next.Updated = time.Now()
+	q.save()
+
+	return *next, true
+}
+
+// running returns the job if it's still running the same run.
+func (q *jobQueue) running(run Job) (*Job, bool) {
+	job, ok := q.jobs[run.ID]
+	if !ok || job.State != JobRunning || job.run != run.run {
+		return nil, false
+	}
+
+	return job, true
+}
+
+// attach keeps the context of the running job, so it could be interrupted.
+// It returns false if the job is no longer running.
+func (q *jobQueue) attach(run Job, context *Context) bool {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	if _, ok := q.running(run); !ok {
+		return false
+	}
+	q.contexts[run.ID] = context
+
+	return true
+}
+
+func (q *jobQueue) progress(run Job, done, total int) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	if job, ok := q.running(run); ok {
+		job.Done, job.Total = done, total
+		job.Updated = time.Now()
+		q.save()
+	}
+}
+
+// finish records the result of the run, unless the job is paused, canceled or queued again when interrupted.
+// The job could be running again by then, so the finish of an older run is ignored.
+func (q *jobQueue) finish(run Job, err error) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	job, ok := q.running(run)
+	if !ok {
+		return
+	}
+	delete(q.contexts, run.ID)
+
+	if err != nil {
+		q.logger.Errorf("job %s of %s failed: %v", job.ID, job.Path, err)
+		job.State = JobFailed
+		job.Error = err.Error()
+	} else {
+		job.State = JobDone
+	}
+	job.Updated = time.Now()
+	q.save()
+}
+
+// transition changes the state of the job if it's in one of the from states, the running job is interrupted.
+func (q *jobQueue) transition(id string, to JobState, from ...JobState) error {
+	q.m.Lock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		q.m.Unlock()
+
+		return ErrJobNotFound
+	}
+	if !slices.Contains(from, job.State) {
+		q.m.Unlock()
+
+		return ErrJobState
+	}
+
+	job.State = to
+	job.Updated = time.Now()
+	q.save()
+
+	context := q.contexts[id]
+	delete(q.contexts, id)
+	q.m.Unlock()
+
+	// closing waits for the streams, so it's out of the lock.
+	if context != nil {
+		_ = context.close(CloseUser, nil)
+	}
+
+	if to == JobQueued {
+		q.notify()
+	}
+
+	return nil
+}
+
+func (q *jobQueue) setPriority(id string, priority int) error {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return ErrJobNotFound
+	}
+
+	job.Priority = priority
+	job.Updated = time.Now()
+	q.save()
+
+	return nil
+}
+
+// close stops the workers, the running jobs are queued again to continue on the next start.
+func (q *jobQueue) close() {
+	q.stop.Do(func() {
+		q.m.Lock()
+		close(q.done)
+		for _, job := range q.jobs {
+			if job.State == JobRunning {
+				job.State = JobQueued
+			}
+		}
+		q.save()
+		contexts := q.contexts
+		q.contexts = make(map[string]*Context)
+		q.m.Unlock()
+
+		for _, context := range contexts {
+			_ = context.close(CloseShutdown, nil)
+		}
+
+		q.wg.Wait()
+	})
+}
+
+// startJobs loads the saved jobs and starts the workers.
+func (s *Service) startJobs() error {
+	output, err := NewDiskStore(filepath.Join(s.config.OutputPath, outputSegments))
+	if err != nil {
+		return err
+	}
+
+	workers := s.config.JobWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	jobs, err := newJobQueue(filepath.Join(s.config.OutputPath, jobsFile), workers, s.renderJob, s.logger)
+	if err != nil {
+		return err
+	}
+
+	s.output = output
+	s.jobs = jobs
+	jobs.start()
+
+	return nil
+}
+
+// AddJob queues a job to pre-transcode the source, the higher priority runs first.
+func (s *Service) AddJob(path string, priority int) (Job, error) {
+	if s.jobs == nil {
+		return Job{}, ErrJobsDisabled
+	}
+	if _, err := s.config.statSource(path); err != nil {
+		return Job{}, err
+	}
+
+	return s.jobs.add(path, priority), nil
+}
+
+// Jobs returns all the jobs in the running order, the finished ones are included.
+func (s *Service) Jobs() []Job {
+	if s.jobs == nil {
+		return nil
+	}
+
+	s.jobs.m.Lock()
+	defer s.jobs.m.Unlock()
+
+	return s.jobs.list()
+}
+
+func (s *Service) Job(id string) (Job, error) {
+	if s.jobs == nil {
+		return Job{}, ErrJobsDisabled
+	}
+
+	return s.jobs.get(id)
+}
+
+// PauseJob stops the queued or running job until ResumeJob, the rendered segments are kept.
+func (s *Service) PauseJob(id string) error {
+	if s.jobs == nil {
+		return ErrJobsDisabled
+	}
+
+	return s.jobs.transition(id, JobPaused, JobQueued, JobRunning)
+}
+
+// ResumeJob queues the paused or failed job again, it continues from the rendered segments.
+func (s *Service) ResumeJob(id string) error {
+	if s.jobs == nil {
+		return ErrJobsDisabled
+	}
+
+	return s.jobs.transition(id, JobQueued, JobPaused, JobFailed)
+}
+
+// CancelJob stops the job for good, the rendered segments are kept and still served.
+func (s *Service) CancelJob(id string) error {
+	if s.jobs == nil {
+		return ErrJobsDisabled
+	}
+
+	return s.jobs.transition(id, JobCanceled, JobQueued, JobRunning, JobPaused, JobFailed)
+}
+
+// SetJobPriority changes the priority, it only matters before the job runs.
+func (s *Service) SetJobPriority(id string, priority int) error {
+	if s.jobs == nil {
+		return ErrJobsDisabled
+	}
+
+	return s.jobs.setPriority(id, priority)
+}
+
+// renderJob renders the source with an internal context, which is not added to the service.
+func (s *Service) renderJob(job Job) error {
+	config := s.mergeConfig(&ContextConfig{Format: FormatHLS})
+	setHLSDefaultValue(config)
+	// the rendered segments are plain, the contexts encrypt them when served.
+	config.Encryption = ""
+	config.Trickplay = nil
+	config.IdleTimeout = 0
+
+	context, err := s.createContext(jobContextPrefix+job.ID, job.Path, config)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = context.close(CloseUser, nil) }()
+	context.background = true
+	context.emit(Event{Type: EventContextCreated})
+
+	if !s.jobs.attach(job, context) {
+		return errJobStopped
+	}
+
+	return renderContext(context, func(done, total int) {
+		s.jobs.progress(job, done, total)
+	})
+}
+
+// renderContext renders all the streams of the context to its output.
+func renderContext(context *Context, progress func(done, total int)) error {
+	streams := context.allStreams()
+	// a subtitle is rendered as a whole.
+	total := len(context.subtitles) + (len(streams)-len(context.subtitles))*len(context.chunks)
+	done := 0
+	progress(done, total)
+
+	for _, s := range streams {
+		err := s.render(func() {
+			done++
+			progress(done, total)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// render writes the segments missing in the output, the segments are requested one by one like a player,
+// so ffmpeg is suspended and resumed by the buffer as usual.
+func (s *Stream) render(progress func()) error {
+	if s.subtitle != nil {
+		err := s.renderSegment(-1, func() (io.ReadCloser, error) {
+			if err := s.extractSubtitle(); err != nil {
+				return nil, err
+			}
+
+			return os.Open(filepath.Join(s.dir(), subtitleFile))
+		})
+		if err == nil {
+			progress()
+		}
+
+		return err
+	}
+
+	if s.segmentContainer() == ContainerFMP4 {
+		if err := s.renderSegment(-1, s.Init); err != nil {
+			return err
+		}
+	}
+
+	for i := range s.context.chunks {
+		err := s.renderSegment(i, func() (io.ReadCloser, error) {
+			if r, ok := s.cachedChunk(i); ok {
+				return r, nil
+			}
+
+			return s.transcodeChunk(i)
+		})
+		if err != nil {
+			return err
+		}
+		progress()
+	}
+
+	return nil
+}
+
+func (s *Stream) renderSegment(index int, open func() (io.ReadCloser, error)) error {
+	if isClosed(s.context.closed) {
+		return errJobStopped
+	}
+
+	key, ok := s.cacheKey(index)
+	if !ok {
+		return ErrJobSource
+	}
+	if s.context.output.has(key) {
+		return nil
+	}
+
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return s.context.output.Put(key, r)
+}
+
+// rendered opens the segment rendered by a job.
+func (s *Stream) rendered(key string) (io.ReadCloser, bool) {
+	if s.context.output == nil {
+		return nil, false
+	}
+
+	r, err := s.context.output.Get(key)
+
+	return r, err == nil
+}
+
+// copyRendered copies the subtitle rendered by a job to the path, it returns false if it's not rendered.
+func (s *Stream) copyRendered(path string) bool {
+	key, ok := s.cacheKey(-1)
+	if !ok {
+		return false
+	}
+
+	r, ok := s.rendered(key)
+	if !ok {
+		return false
+	}
+	defer r.Close()
+
+	out, err := os.Create(path)
+	if err != nil {
+		return false
+	}
+
+	_, err = io.Copy(out, r)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err == nil
+}
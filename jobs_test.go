@@ -0,0 +1,225 @@
+package vod
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestJobQueue(t *testing.T, render func(Job) error) *jobQueue {
+	t.Helper()
+
+	jobs, err := newJobQueue(filepath.Join(t.TempDir(), jobsFile), 1, render, NewEmptyLogger())
+	assert.NoError(t, err)
+
+	return jobs
+}
+
+func waitJobState(t *testing.T, service *Service, id string, state JobState) {
+	t.Helper()
+
+	assert.Eventually(t, func() bool {
+		job, err := service.Job(id)
+
+		return err == nil && job.State == state
+	}, time.Second, time.Millisecond*10)
+}
+
+func TestJobsRunByPriority(t *testing.T) {
+	service := newTestService(t)
+	service.jobs = newTestJobQueue(t, nil)
+
+	low := service.jobs.add("low.mp4", 0)
+	high := service.jobs.add("high.mp4", 5)
+	later := service.jobs.add("later.mp4", 5)
+	assert.NoError(t, service.SetJobPriority(low.ID, 10))
+
+	for _, expected := range []string{low.ID, high.ID, later.ID} {
+		job, ok := service.jobs.next()
+		assert.True(t, ok)
+		assert.Equal(t, expected, job.ID)
+		assert.Equal(t, JobRunning, job.State)
+	}
+
+	_, ok := service.jobs.next()
+	assert.False(t, ok)
+}
+
+func TestJobsPauseResumeAndCancel(t *testing.T) {
+	service := newTestService(t)
+	runs := make(chan Job, 4)
+	service.jobs = newTestJobQueue(t, func(job Job) error {
+		context := newTestContext(t, job.ID, nil, testProbeInfo())
+		if !service.jobs.attach(job, context) {
+			return errJobStopped
+		}
+		runs <- job
+		<-context.closed
+
+		return ErrProcessStopped
+	})
+	service.jobs.start()
+
+	job := service.jobs.add("video.mp4", 0)
+	<-runs
+	waitJobState(t, service, job.ID, JobRunning)
+
+	assert.NoError(t, service.PauseJob(job.ID))
+	waitJobState(t, service, job.ID, JobPaused)
+	assert.Equal(t, ErrJobState, service.PauseJob(job.ID))
+
+	assert.NoError(t, service.ResumeJob(job.ID))
+	<-runs
+	waitJobState(t, service, job.ID, JobRunning)
+
+	assert.NoError(t, service.CancelJob(job.ID))
+	waitJobState(t, service, job.ID, JobCanceled)
+	assert.Equal(t, ErrJobState, service.ResumeJob(job.ID))
+	assert.Equal(t, ErrJobNotFound, service.CancelJob("missing"))
+}
+
+func TestJobsIgnoreTheFinishOfStaleRuns(t *testing.T) {
+	jobs := newTestJobQueue(t, nil)
+
+	job := jobs.add("video.mp4", 0)
+	stale, _ := jobs.next()
+	assert.NoError(t, jobs.transition(job.ID, JobPaused, JobRunning))
+	assert.NoError(t, jobs.transition(job.ID, JobQueued, JobPaused))
+	run, _ := jobs.next()
+	assert.False(t, jobs.attach(stale, newTestContext(t, "stale", nil, testProbeInfo())))
+	context := newTestContext(t, job.ID, nil, testProbeInfo())
+	assert.True(t, jobs.attach(run, context))
+
+	jobs.progress(stale, 9, 10)
+	jobs.finish(stale, errJobStopped)
+	job, err := jobs.get(job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, JobRunning, job.State)
+	assert.Equal(t, 0, job.Done)
+
+	assert.NoError(t, jobs.transition(job.ID, JobPaused, JobRunning))
+	<-context.closed
+	jobs.finish(run, errJobStopped)
+	job, err = jobs.get(job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, JobPaused, job.State)
+	assert.Empty(t, job.Error)
+}
+
+func TestJobsFailAndResume(t *testing.T) {
+	failed := true
+	service := newTestService(t)
+	service.jobs = newTestJobQueue(t, func(Job) error {
+		if failed {
+			failed = false
+
+			return ErrJobSource
+		}
+
+		return nil
+	})
+	service.jobs.start()
+
+	job := service.jobs.add("video.mp4", 0)
+	waitJobState(t, service, job.ID, JobFailed)
+
+	job, err := service.Job(job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrJobSource.Error(), job.Error)
+
+	assert.NoError(t, service.ResumeJob(job.ID))
+	waitJobState(t, service, job.ID, JobDone)
+}
+
+func TestJobsSurviveRestarts(t *testing.T) {
+	file := filepath.Join(t.TempDir(), jobsFile)
+	jobs, err := newJobQueue(file, 1, nil, NewEmptyLogger())
+	assert.NoError(t, err)
+
+	running := jobs.add("running.mp4", 1)
+	paused := jobs.add("paused.mp4", 0)
+	run, _ := jobs.next()
+	jobs.progress(run, 3, 10)
+	assert.NoError(t, jobs.transition(paused.ID, JobPaused, JobQueued))
+
+	restored, err := newJobQueue(file, 1, nil, NewEmptyLogger())
+	assert.NoError(t, err)
+
+	job, err := restored.get(running.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, JobQueued, job.State)
+	assert.Equal(t, 0.3, job.Progress())
+
+	job, err = restored.get(paused.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, JobPaused, job.State)
+}
+
+func TestJobsDisabled(t *testing.T) {
+	service := newTestService(t)
+
+	_, err := service.AddJob("video.mp4", 0)
+	assert.Equal(t, ErrJobsDisabled, err)
+	assert.Nil(t, service.Jobs())
+}
+
+// the fake ffmpeg writes every segment from the start number, or the subtitle.
+const renderFFMpeg = `for a in "$@"; do
+	[ "$last" = "-segment_start_number" ] && start=$a
+	last=$a
+done
+case "$*" in *webvtt*) printf 'WEBVTT\n\n00:00.000 --> 00:01.000\nhello\n' > "$last"; exit 0;; esac
+dir=$(dirname "$last")
+i=${start:-0}
+while [ $i -lt 4 ]; do
+	echo "segment $i" > "$dir/$i.ts"
+	echo "[segment @ 0x1] segment:'$dir/$i.ts' count:$i ended" >&2
+	i=$((i+1))
+done`
+
+func TestRenderedSegmentsAreServedWithoutFFMpeg(t *testing.T) {
+	ffmpeg, runs := newFakeFFMpeg(t, renderFFMpeg)
+	output, err := NewDiskStore(t.TempDir())
+	assert.NoError(t, err)
+
+	info := &ProbeInfo{
+		Duration: 20, Width: 1920, Height: 1080, VideoCodec: "h264", AudioCodec: "aac",
+		SubtitleTracks: []SubtitleTrack{{Index: 2, Codec: "subrip", Key: "subtitle-0"}},
+	}
+	newRenderContext := func(id, ffmpeg string) *Context {
+		context := newTestContext(t, id, &ContextConfig{FFMpegPath: ffmpeg, HWAccel: HWAccelNone}, info)
+		context.path = "testdata/test.mp3"
+		context.output = output
+		t.Cleanup(func() { _ = context.Close() })
+
+		return context
+	}
+
+	context := newRenderContext("job", ffmpeg)
+	assert.Len(t, context.chunks, 4)
+
+	var done, total int
+	assert.NoError(t, renderContext(context, func(d, n int) { done, total = d, n }))
+	assert.Equal(t, 5, total)
+	assert.Equal(t, 5, done)
+
+	keys, err := output.List("")
+	assert.NoError(t, err)
+	assert.Len(t, keys, 5)
+
+	// rendering again skips the rendered segments.
+	count := len(countRuns(t, runs))
+	assert.NoError(t, renderContext(newRenderContext("again", ffmpeg), func(int, int) {}))
+	assert.Len(t, countRuns(t, runs), count)
+
+	player := newRenderContext("player", "missing-ffmpeg")
+	stream := player.Stream(Origin.Name)
+	chunk, err := stream.Chunk(2, 2)
+	assert.Equal(t, "segment 2\n", readAll(t, chunk, err))
+	assert.Nil(t, stream.cmd)
+
+	subtitle, err := player.Subtitle("subtitle-0")
+	assert.Contains(t, readAll(t, subtitle, err), "hello")
+}
@@ -0,0 +1,162 @@
+package vod
+
+import (
+	"bufio"
+	"bytes"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxKeyframeCaches is how many sources the keyframes are cached for, the least recently used one is evicted.
+const maxKeyframeCaches = 256
+
+// keyframeCache caches the keyframes of the source, it's invalid once the source is modified.
+type keyframeCache struct {
+	stat      sourceStat
+	keyframes []float64
+	used      time.Time
+}
+
+// probeKeyframes returns the keyframe timestamps of the first video stream in seconds.
+// Only the packets are read, so it's much faster than decoding, and the result is cached per file.
+func (s *Service) probeKeyframes(path string, config *ContextConfig) ([]float64, error) {
+	stat, err := config.statSource(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s.km.Lock()
+	cache, ok := s.keyframes[path]
+	ok = ok && cache.stat.size == stat.size && cache.stat.modTime.Equal(stat.modTime) && cache.stat.etag == stat.etag
+	if ok {
+		cache.used = time.Now()
+		s.keyframes[path] = cache
+	}
+	s.km.Unlock()
+
+	if ok {
+		return cache.keyframes, nil
+	}
+
+	args := []string{
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "packet=pts_time,flags",
+		"-of", "csv=print_section=0",
+	}
+	args = append(args, config.inputArgs(path)...)
+	args = append(args, path)
+
+	probeCmd := exec.Command(config.FFProbePath, args...)
+	s.logger.Debugf("Running command: %s", probeCmd.String())
+
+	output, err := probeCmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	keyframes := parseKeyframes(output)
+	s.cacheKeyframes(path, keyframeCache{stat: stat, keyframes: keyframes, used: time.Now()})
+
+	return keyframes, nil
+}
+
+// cacheKeyframes keeps the keyframes of the path, the least recently used source is evicted once it's full.
+func (s *Service) cacheKeyframes(path string, cache keyframeCache) {
+	s.km.Lock()
+	defer s.km.Unlock()
+
+	if _, ok := s.keyframes[path]; !ok && len(s.keyframes) >= maxKeyframeCaches {
+		oldest := ""
+		for p, c := range s.keyframes {
+			if oldest == "" || c.used.Before(s.keyframes[oldest].used) {
+				oldest = p
+			}
+		}
+		delete(s.keyframes, oldest)
+	}
+
+	s.keyframes[path] = cache
+}
+
+// parseKeyframes parses the packets of ffprobe csv output, the line is like "12.345000,K__".
+// The packets are in decode order, so the keyframes are sorted by pts.
+func parseKeyframes(output []byte) []float64 {
+	keyframes := make([]float64, 0)
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		pts, flags, found := strings.Cut(strings.TrimSpace(scanner.Text()), ",")
+		if !found || !strings.HasPrefix(flags, "K") {
+			continue
+		}
+
+		// pts could be N/A
+		t, err := strconv.ParseFloat(pts, 64)
+		if err != nil {
+			continue
+		}
+
+		if len(keyframes) > 0 && t <= keyframes[len(keyframes)-1] {
+			continue
+		}
+
+		keyframes = append(keyframes, t)
+	}
+
+	return keyframes
+}
+
+// splitChunks splits the duration into chunks of about size seconds.
+// If keyframes are known, every chunk starts at a keyframe, which is the first keyframe after
+// the previous chunk start plus size, so remuxing with -c copy could cut exactly at the boundaries.
+// Otherwise, every chunk is exactly size seconds except the last one.
+func splitChunks(duration float64, keyframes []float64, size float64) []tsChunk {
+	starts := []float64{0}
+
+	if len(keyframes) > 0 {
+		next := size
+		for _, keyframe := range keyframes {
+			if keyframe >= next && keyframe < duration {
+				starts = append(starts, keyframe)
+				next = keyframe + size
+			}
+		}
+	} else {
+		for start := size; start < duration; start += size {
+			starts = append(starts, start)
+		}
+	}
+
+	chunks := make([]tsChunk, 0, len(starts))
+
+	for i, start := range starts {
+		end := duration
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+
+		if end <= start {
+			break
+		}
+
+		chunks = append(chunks, tsChunk{id: i, start: start, duration: end - start})
+	}
+
+	return chunks
+}
+
+// formatTimes formats the chunk starts after the index for -segment_times and -force_key_frames.
+func formatTimes(chunks []tsChunk, index int) string {
+	times := make([]string, 0, len(chunks))
+
+	for _, c := range chunks {
+		if c.id > index {
+			times = append(times, strconv.FormatFloat(c.start, 'f', 6, 64))
+		}
+	}
+
+	return strings.Join(times, ",")
+}
@@ -0,0 +1,139 @@
+package vod
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKeyframes(t *testing.T) {
+	output := []byte("0.000000,K__\n0.041708,___\n2.085417,K_\nN/A,K__\n1.000000,K__\n4.170833,K__\n")
+	assert.Equal(t, []float64{0, 2.085417, 4.170833}, parseKeyframes(output))
+}
+
+func TestSplitChunksAtKeyframes(t *testing.T) {
+	chunks := splitChunks(20, []float64{0, 2.5, 5.5, 7, 12, 13, 19}, 6)
+	if assert.Len(t, chunks, 4) {
+		assert.Equal(t, tsChunk{id: 0, start: 0, duration: 7}, chunks[0])
+		assert.Equal(t, tsChunk{id: 1, start: 7, duration: 6}, chunks[1])
+		assert.Equal(t, tsChunk{id: 2, start: 13, duration: 6}, chunks[2])
+		assert.Equal(t, tsChunk{id: 3, start: 19, duration: 1}, chunks[3])
+	}
+	assert.Equal(t, "7.000000,13.000000,19.000000", formatTimes(chunks, 0))
+	assert.Equal(t, "", formatTimes(chunks, 3))
+}
+
+func TestSplitChunksWithoutKeyframes(t *testing.T) {
+	chunks := splitChunks(14, nil, 6)
+	if assert.Len(t, chunks, 3) {
+		assert.Equal(t, 12.0, chunks[2].start)
+		assert.Equal(t, 2.0, chunks[2].duration)
+	}
+}
+
+func TestKeyframeAlignedSegments(t *testing.T) {
+	config := &ContextConfig{Format: FormatHLS, StreamSpec: []StreamSpec{Origin}}
+	info := &ProbeInfo{
+		Duration: 20, Width: 1920, Height: 1080, VideoCodec: "h264", AudioCodec: "aac",
+		Keyframes: []float64{0, 7, 13},
+	}
+	context := newTestContext(t, "keyframe", config, info)
+	stream := context.Stream("Origin")
+
+	r, err := stream.Content()
+	content := readAll(t, r, err)
+	assert.Contains(t, content, "#EXT-X-TARGETDURATION:7\n")
+	assert.Contains(t, content, "#EXTINF:6.000,\n")
+
+	args := stream.buildFFMpegArgs(1, false, FormatHLS, false)
+	assert.Subset(t, args, []string{"-ss", "7.000000", "-segment_times", "13.000000"})
+	assert.NotContains(t, args, "-segment_time")
+
+	d := dashTimeline(splitChunks(20, []float64{0, 6, 12, 18}, 6))
+	assert.Equal(t, []mpdSegment{{T: 0, D: 6000, Repeat: 2}, {T: 18000, D: 2000}}, d)
+}
+
+func TestFMP4SegmentsMatchUnevenKeyframes(t *testing.T) {
+	config := &ContextConfig{Format: FormatHLS, SegmentContainer: ContainerFMP4, ChunkDuration: 4}
+	info := &ProbeInfo{
+		Duration: 21, Width: 1920, Height: 1080, VideoCodec: "h264", AudioCodec: "aac",
+		Keyframes: []float64{0, 4.2, 8.4, 12.6, 16.8},
+	}
+	context := newTestContext(t, "uneven", config, info)
+	stream := context.Stream("Origin")
+	stream.goal = 10
+
+	// the segments are cut at the chunk starts, not after every multiple of the chunk duration.
+	assert.Len(t, context.chunks, 5)
+	args := stream.buildFFMpegArgs(1, false, FormatHLS, false)
+	assert.Subset(t, args, []string{"-ss", "4.200000", "-segment_start_number", "1",
+		"-segment_times", "8.400000,12.600000,16.800000"})
+
+	lines := make([]string, 0, len(context.chunks))
+	for _, c := range context.chunks[1:] {
+		lines = append(lines, fmt.Sprintf("[segment @ 0x1] segment:'%s' count:%d ended", filepath.Join(stream.dir(), fmt.Sprintf("%d.m4s", c.id)), c.id-1))
+	}
+	stream.monitorChunk(nil, io.NopCloser(strings.NewReader(strings.Join(lines, "\n")+"\n")))
+
+	for _, c := range context.chunks[1:] {
+		if assert.Contains(t, stream.chunks, c.id) {
+			assert.Equal(t, filepath.Join(stream.dir(), fmt.Sprintf("%d.m4s", c.id)), stream.chunks[c.id].path)
+		}
+	}
+
+	r, err := stream.Content()
+	content := readAll(t, r, err)
+	assert.Equal(t, 5, strings.Count(content, "#EXTINF:4.200,"))
+}
+
+// fakeProbeScript answers the keyframe probe by csv packets, and the stream probe by a 20s h264 video.
+const fakeProbeScript = `case "$*" in
+*packet=pts_time*) printf '0.000000,K__\n4.000000,K__\n' ;;
+*) echo '{"streams":[{"index":0,"codec_type":"video","codec_name":"h264","width":1920,"height":1080,"r_frame_rate":"24/1"}],"format":{"duration":"20.0","bit_rate":"1000000","format_name":"flv"}}' ;;
+esac`
+
+func TestContextProbesKeyframesOnlyForSegments(t *testing.T) {
+	ffprobe, runs := newFakeFFMpeg(t, fakeProbeScript)
+	service := newTestService(t)
+	service.config = ContextConfig{
+		Format: FormatHLS, FFMpegPath: ffprobe, FFProbePath: ffprobe, TmpPath: t.TempDir(), StreamSpec: []StreamSpec{Origin},
+		SupportVideoCodec: []string{"h264"}, SupportAudioCodec: []string{"aac"},
+	}
+	setHLSDefaultValue(&service.config)
+
+	_, err := service.CreateContext("hls", "testdata/test.mp3", nil)
+	assert.NoError(t, err)
+	assert.Len(t, countRuns(t, runs), 2)
+
+	// the mp4 content doesn't use the chunks, and the keyframes of the hls context are cached.
+	_, err = service.CreateContext("mp4", "testdata/test.mp3", &ContextConfig{Format: FormatMP4})
+	assert.NoError(t, err)
+	_, err = service.CreateContext("cached", "testdata/test.mp3", nil)
+	assert.NoError(t, err)
+	assert.Len(t, countRuns(t, runs), 4)
+	for _, run := range countRuns(t, runs)[2:] {
+		assert.NotContains(t, run, "packet=pts_time")
+	}
+}
+
+func TestKeyframeCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	service := newTestService(t)
+	now := time.Now()
+
+	for i := 0; i < maxKeyframeCaches; i++ {
+		service.cacheKeyframes(fmt.Sprintf("%d.mp4", i), keyframeCache{used: now.Add(time.Duration(i) * time.Second)})
+	}
+	service.cacheKeyframes("0.mp4", keyframeCache{used: now.Add(time.Hour)})
+	assert.Len(t, service.keyframes, maxKeyframeCaches)
+
+	service.cacheKeyframes("new.mp4", keyframeCache{used: now.Add(time.Hour)})
+	assert.Len(t, service.keyframes, maxKeyframeCaches)
+	assert.Contains(t, service.keyframes, "0.mp4")
+	assert.NotContains(t, service.keyframes, "1.mp4")
+	assert.Contains(t, service.keyframes, "new.mp4")
+}
@@ -0,0 +1,400 @@
+package vod
+
+import (
+	"bytes"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/v4/cpu"
+	"github.com/shirou/gopsutil/v4/mem"
+	"github.com/shirou/gopsutil/v4/process"
+)
+
+const (
+	defaultLoadInterval  = 5
+	defaultLoadThreshold = 90
+	// loadHysteresis is how far below the threshold the load must drop to recover, so the decisions don't flap.
+	loadHysteresis = 10
+)
+
+// overloadPresets are the presets of the software encoders used when the host is overloaded.
+var overloadPresets = map[string]string{
+	"libx264":   "ultrafast",
+	"libx265":   "ultrafast",
+	"libsvtav1": "12",
+}
+
+// LoadConfig enables the load aware scheduling. The host is sampled every Interval, once the cpu or the memory
+// is over the threshold, the new software transcodes use faster presets, the streams read ahead less, and the new
+// contexts of the software encoder are routed to the hardware one if any. Once the gpu is over the threshold, the new
+// contexts of the hardware encoder are routed to the software one if the cpu is not overloaded.
+// The gpu is only sampled by nvidia-smi.
+type LoadConfig struct {
+	Interval        int     // in second, default is 5
+	CPUThreshold    float64 // in percent, default is 90
+	MemoryThreshold float64 // in percent, default is 90
+	GPUThreshold    float64 // in percent, default is 90
+}
+
+func (l LoadConfig) withDefault() LoadConfig {
+	if l.Interval <= 0 {
+		l.Interval = defaultLoadInterval
+	}
+	if l.CPUThreshold <= 0 {
+		l.CPUThreshold = defaultLoadThreshold
+	}
+	if l.MemoryThreshold <= 0 {
+		l.MemoryThreshold = defaultLoadThreshold
+	}
+	if l.GPUThreshold <= 0 {
+		l.GPUThreshold = defaultLoadThreshold
+	}
+
+	return l
+}
+
+// LoadStats is the last sample of the host.
+type LoadStats struct {
+	Time          time.Time
+	CPU           float64 // in percent of all cores
+	Memory        float64 // in percent
+	GPU           float64 // the max of the gpu and encoder utilization in percent, -1 if unknown
+	Overloaded    bool    // the cpu or the memory is over the threshold
+	GPUOverloaded bool
+	Processes     []ProcessLoad
+}
+
+// ProcessLoad is the usage of a running ffmpeg process.
+type ProcessLoad struct {
+	ContextID string
+	Stream    string
+	PID       int
+	CPU       float64 // in percent of a core
+	Memory    uint64  // resident bytes
+}
+
+// loadMonitor samples the host, the decisions are made by the overloaded states.
+type loadMonitor struct {
+	m         sync.Mutex
+	config    LoadConfig
+	stats     LoadStats
+	spare     HWAccel // the hardware encoder the software contexts are routed to, HWAccelNone if there is none
+	processes map[int]*process.Process
+	host      func() (float64, float64, error)
+	gpu       func() (float64, error) // nil if the gpu is unknown
+	running   func() []ProcessLoad    // the running ffmpeg processes without the usage
+	logger    Logger
+	done      chan struct{}
+	stop      sync.Once
+}
+
+func newLoadMonitor(config LoadConfig, spare HWAccel, running func() []ProcessLoad, logger Logger) *loadMonitor {
+	l := &loadMonitor{
+		config:    config.withDefault(),
+		stats:     LoadStats{GPU: -1},
+		spare:     spare,
+		processes: make(map[int]*process.Process),
+		host:      sampleHost,
+		running:   running,
+		logger:    logger,
+		done:      make(chan struct{}),
+	}
+	if path, err := exec.LookPath("nvidia-smi"); err == nil {
+		l.gpu = func() (float64, error) {
+			return sampleNvidia(path)
+		}
+	}
+
+	return l
+}
+
+func (l *loadMonitor) run() {
+	ticker := time.NewTicker(time.Duration(l.config.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		l.sample()
+
+		select {
+		case <-ticker.C:
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *loadMonitor) close() {
+	l.stop.Do(func() {
+		close(l.done)
+	})
+}
+
+// sample updates the stats and logs the changes of the overloaded states.
+func (l *loadMonitor) sample() {
+	stats := LoadStats{Time: time.Now(), GPU: -1}
+
+	cpuLoad, memory, err := l.host()
+	if err != nil {
+		l.logger.Warnf("failed to sample the host load: %v", err)
+
+		return
+	}
+	stats.CPU, stats.Memory = cpuLoad, memory
+
+	if l.gpu != nil {
+		if stats.GPU, err = l.gpu(); err != nil {
+			l.logger.Warnf("failed to sample the gpu load: %v", err)
+			stats.GPU = -1
+		}
+	}
+
+	stats.Processes = l.sampleProcesses()
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	stats.Overloaded = overloaded(l.stats.Overloaded, l.config.CPUThreshold, stats.CPU) ||
+		overloaded(l.stats.Overloaded, l.config.MemoryThreshold, stats.Memory)
+	stats.GPUOverloaded = stats.GPU >= 0 && overloaded(l.stats.GPUOverloaded, l.config.GPUThreshold, stats.GPU)
+
+	switch {
+	case stats.Overloaded && !l.stats.Overloaded:
+		l.logger.Warnf("host is overloaded, cpu %.1f%%, memory %.1f%%, %d ffmpeg processes: "+
+			"the software encoders use faster presets and the streams read ahead less", stats.CPU, stats.Memory, len(stats.Processes))
+	case !stats.Overloaded && l.stats.Overloaded:
+		l.logger.Infof("host is recovered, cpu %.1f%%, memory %.1f%%: the presets and the read ahead are restored",
+			stats.CPU, stats.Memory)
+	}
+
+	switch {
+	case stats.GPUOverloaded && !l.stats.GPUOverloaded:
+		l.logger.Warnf("gpu is overloaded at %.1f%%: the new contexts may use the software encoder", stats.GPU)
+	case !stats.GPUOverloaded && l.stats.GPUOverloaded:
+		l.logger.Infof("gpu is recovered at %.1f%%", stats.GPU)
+	}
+
+	l.stats = stats
+}
+
+// overloaded applies the hysteresis, the overloaded state stays until the value drops well below the threshold.
+func overloaded(was bool, threshold, value float64) bool {
+	if was {
+		return value >= threshold-loadHysteresis
+	}
+
+	return value >= threshold
+}
+
+// sampleProcesses measures the running ffmpeg processes, the handles are kept so the cpu is measured between
+// the samples.
+func (l *loadMonitor) sampleProcesses() []ProcessLoad {
+	running := l.running()
+	alive := make(map[int]*process.Process, len(running))
+
+	for i := range running {
+		p, ok := l.processes[running[i].PID]
+		if !ok {
+			var err error
+			if p, err = process.NewProcess(int32(running[i].PID)); err != nil {
+				continue
+			}
+		}
+		alive[running[i].PID] = p
+
+		if percent, err := p.Percent(0); err == nil {
+			running[i].CPU = percent
+		}
+		if info, err := p.MemoryInfo(); err == nil {
+			running[i].Memory = info.RSS
+		}
+	}
+	l.processes = alive
+
+	return running
+}
+
+func sampleHost() (float64, float64, error) {
+	percents, err := cpu.Percent(0, false)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	memory, err := mem.VirtualMemory()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var cpuLoad float64
+	if len(percents) > 0 {
+		cpuLoad = percents[0]
+	}
+
+	return cpuLoad, memory.UsedPercent, nil
+}
+
+// sampleNvidia returns the busiest gpu or encoder utilization of all nvidia gpus.
+func sampleNvidia(path string) (float64, error) {
+	out, err := exec.Command(path, "--query-gpu=utilization.gpu,utilization.encoder",
+		"--format=csv,noheader,nounits").Output()
+	if err != nil {
+		return -1, err
+	}
+
+	return parseNvidiaUtilization(out)
+}
+
+func parseNvidiaUtilization(out []byte) (float64, error) {
+	busiest := -1.0
+
+	for _, line := range bytes.Split(bytes.TrimSpace(out), []byte("\n")) {
+		for _, field := range strings.Split(string(line), ",") {
+			value, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+			if err != nil {
+				// [N/A] of the unsupported queries.
+				continue
+			}
+			busiest = max(busiest, value)
+		}
+	}
+
+	return busiest, nil
+}
+
+func (l *loadMonitor) overloaded() bool {
+	if l == nil {
+		return false
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	return l.stats.Overloaded
+}
+
+func (l *loadMonitor) route(accel HWAccel) HWAccel {
+	if l == nil {
+		return accel
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	switch {
+	case accel == HWAccelNone && l.stats.Overloaded && l.spare != HWAccelNone:
+		return l.spare
+	case accel != HWAccelNone && l.stats.GPUOverloaded && !l.stats.Overloaded:
+		return HWAccelNone
+	}
+
+	return accel
+}
+
+// Load returns the last sample of the host, ok is false if LoadConfig is not set.
+func (s *Service) Load() (LoadStats, bool) {
+	if s.load == nil {
+		return LoadStats{}, false
+	}
+
+	s.load.m.Lock()
+	defer s.load.m.Unlock()
+
+	stats := s.load.stats
+	stats.Processes = append([]ProcessLoad(nil), stats.Processes...)
+
+	return stats, true
+}
+
+// startLoadMonitor samples the host until the service stops.
+// The spare hardware encoder is only detected if the service uses the software one on purpose.
+func (s *Service) startLoadMonitor(requested HWAccel) {
+	spare := HWAccelNone
+	if requested == HWAccelNone {
+		spare = probeHWAccel(s.config.FFMpegPath, HWAccelAuto)
+	}
+
+	s.load = newLoadMonitor(*s.config.Load, spare, s.runningProcesses, s.logger)
+	go s.load.run()
+}
+
+// runningProcesses returns the segmenting processes of the contexts and the jobs.
+func (s *Service) runningProcesses() []ProcessLoad {
+	s.m.Lock()
+	contexts := make([]*Context, 0, len(s.contexts))
+	for _, c := range s.contexts {
+		contexts = append(contexts, c)
+	}
+	s.m.Unlock()
+
+	if s.jobs != nil {
+		s.jobs.m.Lock()
+		for _, c := range s.jobs.contexts {
+			contexts = append(contexts, c)
+		}
+		s.jobs.m.Unlock()
+	}
+
+	processes := make([]ProcessLoad, 0)
+
+	for _, c := range contexts {
+		for _, stream := range c.allStreams() {
+			stream.m.Lock()
+			if stream.cmd != nil {
+				processes = append(processes, ProcessLoad{ContextID: c.id, Stream: stream.spec.Name, PID: stream.cmd.Process.Pid})
+			}
+			stream.m.Unlock()
+		}
+	}
+
+	return processes
+}
+
+// routeHWAccel moves the new context to another encoder if its own is saturated,
+// only the contexts using the encoder of the service are routed.
+func (s *Service) routeHWAccel(id string, accel HWAccel) HWAccel {
+	if accel != s.config.HWAccel {
+		return accel
+	}
+
+	routed := s.load.route(accel)
+	if routed != accel {
+		s.logger.Infof("context %s is routed from %s to %s under load", id, accel, routed)
+	}
+
+	return routed
+}
+
+// maxBuffer returns how many segments the stream reads ahead, it's halved when the host is overloaded,
+// but still more than MinBuffer, so the goal moves.
+func (s *Stream) maxBuffer() int {
+	config := s.context.contextConfig
+	if !s.context.load.overloaded() {
+		return config.MaxBuffer
+	}
+
+	return max(config.MaxBuffer/2, config.MinBuffer+1)
+}
+
+// fasterPreset replaces the preset of the software encoder when the host is overloaded.
+func (s *Stream) fasterPreset(args []string) []string {
+	if len(args) == 0 || !s.context.load.overloaded() {
+		return args
+	}
+
+	preset, ok := overloadPresets[args[0]]
+	if !ok {
+		return args
+	}
+
+	faster := append([]string(nil), args...)
+	for i := 1; i+1 < len(faster); i++ {
+		if faster[i] == "-preset" {
+			s.logger.Infof("stream %s uses the %s preset of %s under load", s.spec.Name, preset, args[0])
+			faster[i+1] = preset
+		}
+	}
+
+	return faster
+}
@@ -0,0 +1,109 @@
+package vod
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLoadMonitor(spare HWAccel, cpu, gpu *float64) *loadMonitor {
+	l := newLoadMonitor(LoadConfig{}, spare, func() []ProcessLoad { return nil }, NewEmptyLogger())
+	l.host = func() (float64, float64, error) {
+		return *cpu, 40, nil
+	}
+	l.gpu = func() (float64, error) {
+		return *gpu, nil
+	}
+
+	return l
+}
+
+func TestLoadHysteresis(t *testing.T) {
+	cpu, gpu := 85.0, -1.0
+	l := newTestLoadMonitor(HWAccelNone, &cpu, &gpu)
+
+	l.sample()
+	assert.False(t, l.overloaded())
+
+	cpu = 95
+	l.sample()
+	assert.True(t, l.overloaded())
+
+	// it stays overloaded until the cpu drops well below the threshold.
+	cpu = 85
+	l.sample()
+	assert.True(t, l.overloaded())
+	cpu = 79
+	l.sample()
+	assert.False(t, l.overloaded())
+
+	var nilMonitor *loadMonitor
+	assert.False(t, nilMonitor.overloaded())
+	assert.Equal(t, HWAccelVAAPI, nilMonitor.route(HWAccelVAAPI))
+
+	value, err := parseNvidiaUtilization([]byte("35, 92\n10, [N/A]\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 92.0, value)
+}
+
+func TestLoadAdaptsSoftwareTranscode(t *testing.T) {
+	cpu, gpu := 95.0, -1.0
+	l := newTestLoadMonitor(HWAccelNone, &cpu, &gpu)
+	config := &ContextConfig{HWAccel: HWAccelNone, StreamSpec: []StreamSpec{{Name: "HEVC", Codec: CodecHEVC}}}
+	info := testProbeInfo()
+	context := newTestContext(t, "load", config, info)
+	context.load = l
+	stream := context.Stream("HEVC")
+
+	assert.Subset(t, stream.buildFFMpegArgs(0, true, FormatHLS, false), []string{"libx265", "-preset", "fast"})
+	assert.Equal(t, config.MaxBuffer, stream.maxBuffer())
+
+	l.sample()
+	args := stream.buildFFMpegArgs(0, true, FormatHLS, false)
+	assert.Subset(t, args, []string{"libx265", "-preset", "ultrafast"})
+	assert.NotContains(t, args, "fast")
+	assert.Equal(t, config.MaxBuffer/2, stream.maxBuffer())
+	assert.Greater(t, stream.maxBuffer(), config.MinBuffer)
+
+	// the hardware encoders keep their args.
+	context.contextConfig.HWAccel = HWAccelVAAPI
+	assert.Subset(t, stream.buildFFMpegArgs(0, true, FormatHLS, false), []string{"-c:v", "hevc_vaapi"})
+}
+
+func TestLoadRoutesHWAccel(t *testing.T) {
+	cpu, gpu := 50.0, 95.0
+	service := newTestService(t)
+	service.config.HWAccel = HWAccelNVENC
+	service.load = newTestLoadMonitor(HWAccelNone, &cpu, &gpu)
+	service.load.sample()
+
+	// the saturated gpu routes to the software encoder while the cpu has room.
+	assert.Equal(t, HWAccelNone, service.routeHWAccel("a", HWAccelNVENC))
+	// the context asked for another encoder on purpose.
+	assert.Equal(t, HWAccelVAAPI, service.routeHWAccel("b", HWAccelVAAPI))
+
+	cpu = 95
+	service.load.sample()
+	assert.Equal(t, HWAccelNVENC, service.routeHWAccel("c", HWAccelNVENC))
+
+	// the saturated cpu routes to the spare hardware encoder.
+	service.config.HWAccel = HWAccelNone
+	service.load = newTestLoadMonitor(HWAccelVAAPI, &cpu, &gpu)
+	service.load.sample()
+	assert.Equal(t, HWAccelVAAPI, service.routeHWAccel("d", HWAccelNone))
+
+	// the routed backend is kept by the context, the caller's config is not changed.
+	config := &ContextConfig{HWAccel: HWAccelNone, TmpPath: "/tmp/vod"}
+	owned := service.contextConfig("e", config)
+	assert.Equal(t, HWAccelVAAPI, owned.HWAccel)
+	assert.Equal(t, filepath.Join("/tmp/vod", "e"), owned.TmpPath)
+	assert.Equal(t, HWAccelNone, config.HWAccel)
+	assert.Equal(t, "/tmp/vod", config.TmpPath)
+
+	stats, ok := service.Load()
+	assert.True(t, ok)
+	assert.True(t, stats.Overloaded)
+	assert.True(t, stats.GPUOverloaded)
+	assert.Equal(t, 95.0, stats.CPU)
+}
@@ -0,0 +1,260 @@
+package vod
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The sources of the served segments.
+const (
+	sourceCache  = "cache"
+	sourceFFMpeg = "ffmpeg"
+)
+
+// waitBuckets are the upper bounds of the segment wait histogram, in second.
+var waitBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// metrics collects the counters of the service, the gauges are read from the contexts when scraped.
+// All methods are safe to call with a nil metrics, which is the case when ContextConfig.Metrics is false.
+type metrics struct {
+	produced atomic.Int64
+	restarts atomic.Int64
+	content  atomic.Int64 // the running mp4 processes, they are not tracked by the streams
+
+	m      sync.Mutex
+	served map[string]int64
+	starts map[[2]string]int64 // by decision and hwaccel
+	waits  []int64             // count per bucket, the last one is +Inf
+	waitN  int64
+	waitS  float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		served: make(map[string]int64),
+		starts: make(map[[2]string]int64),
+		waits:  make([]int64, len(waitBuckets)+1),
+	}
+}
+
+func (m *metrics) segmentProduced() {
+	if m == nil {
+		return
+	}
+	m.produced.Add(1)
+}
+
+func (m *metrics) segmentServed(source string) {
+	if m == nil {
+		return
+	}
+	m.m.Lock()
+	m.served[source]++
+	m.m.Unlock()
+}
+
+func (m *metrics) restarted() {
+	if m == nil {
+		return
+	}
+	m.restarts.Add(1)
+}
+
+// processStarted counts the transcode or copy decision of the started ffmpeg, with the backend of the encoder.
+func (m *metrics) processStarted(transcode bool, hwAccel string) {
+	if m == nil {
+		return
+	}
+
+	decision := "copy"
+	if transcode {
+		decision = "transcode"
+	} else {
+		hwAccel = HWAccelNone.String()
+	}
+
+	m.m.Lock()
+	m.starts[[2]string{decision, hwAccel}]++
+	m.m.Unlock()
+}
+
+func (m *metrics) contentStarted() {
+	if m == nil {
+		return
+	}
+	m.content.Add(1)
+}
+
+func (m *metrics) contentExited() {
+	if m == nil {
+		return
+	}
+	m.content.Add(-1)
+}
+
+func (m *metrics) observeWait(d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	seconds := d.Seconds()
+	bucket := sort.SearchFloat64s(waitBuckets, seconds)
+
+	m.m.Lock()
+	m.waits[bucket]++
+	m.waitN++
+	m.waitS += seconds
+	m.m.Unlock()
+}
+
+// MetricsHandler returns a http.Handler which serves the metrics in the prometheus text format.
+// It responds 404 if ContextConfig.Metrics is false.
+func (s *Service) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.metrics == nil {
+			http.NotFound(w, r)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = w.Write(s.exposeMetrics())
+	})
+}
+
+func (s *Service) exposeMetrics() []byte {
+	s.m.Lock()
+	contexts := make([]*Context, 0, len(s.contexts))
+	for _, c := range s.contexts {
+		contexts = append(contexts, c)
+	}
+	s.m.Unlock()
+
+	streams, running, suspended := 0, int(s.metrics.content.Load()), 0
+	for _, c := range contexts {
+		for _, stream := range c.allStreams() {
+			streams++
+
+			stream.m.Lock()
+			if stream.cmd != nil {
+				if stream.suspended {
+					suspended++
+				} else {
+					running++
+				}
+			}
+			stream.m.Unlock()
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	m := s.metrics
+
+	writeMetric(buf, "vod_contexts", "gauge", "Active contexts.")
+	writeSample(buf, "vod_contexts", "", float64(len(contexts)))
+	writeMetric(buf, "vod_streams", "gauge", "Streams of the active contexts.")
+	writeSample(buf, "vod_streams", "", float64(streams))
+	writeMetric(buf, "vod_ffmpeg_processes", "gauge", "Running ffmpeg processes by state.")
+	writeSample(buf, "vod_ffmpeg_processes", `state="running"`, float64(running))
+	writeSample(buf, "vod_ffmpeg_processes", `state="suspended"`, float64(suspended))
+	writeMetric(buf, "vod_hwaccel_info", "gauge", "The configured hardware acceleration.")
+	writeSample(buf, "vod_hwaccel_info", fmt.Sprintf("hwaccel=%q", s.config.HWAccel.String()), 1)
+	writeMetric(buf, "vod_tmp_bytes", "gauge", "Bytes in the tmp path.")
+	writeSample(buf, "vod_tmp_bytes", "", float64(dirSize(s.config.TmpPath)))
+
+	if load, ok := s.Load(); ok {
+		writeMetric(buf, "vod_host_load_percent", "gauge", "The last sample of the host load, gpu is -1 if unknown.")
+		writeSample(buf, "vod_host_load_percent", `resource="cpu"`, load.CPU)
+		writeSample(buf, "vod_host_load_percent", `resource="memory"`, load.Memory)
+		writeSample(buf, "vod_host_load_percent", `resource="gpu"`, load.GPU)
+		writeMetric(buf, "vod_host_overloaded", "gauge", "1 if the resource is over the threshold.")
+		writeSample(buf, "vod_host_overloaded", `resource="host"`, boolGauge(load.Overloaded))
+		writeSample(buf, "vod_host_overloaded", `resource="gpu"`, boolGauge(load.GPUOverloaded))
+	}
+
+	writeMetric(buf, "vod_segments_produced_total", "counter", "Segments written by ffmpeg.")
+	writeSample(buf, "vod_segments_produced_total", "", float64(m.produced.Load()))
+	writeMetric(buf, "vod_ffmpeg_restarts_total", "counter", "Segment processes restarted at a new position.")
+	writeSample(buf, "vod_ffmpeg_restarts_total", "", float64(m.restarts.Load()))
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	writeMetric(buf, "vod_segments_served_total", "counter", "Segments served by source.")
+	for _, source := range []string{sourceCache, sourceFFMpeg} {
+		writeSample(buf, "vod_segments_served_total", fmt.Sprintf("source=%q", source), float64(m.served[source]))
+	}
+
+	writeMetric(buf, "vod_ffmpeg_starts_total", "counter", "Started ffmpeg processes by transcode or copy decision and hardware acceleration.")
+	keys := make([][2]string, 0, len(m.starts))
+	for k := range m.starts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+
+		return keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		writeSample(buf, "vod_ffmpeg_starts_total", fmt.Sprintf("decision=%q,hwaccel=%q", k[0], k[1]), float64(m.starts[k]))
+	}
+
+	writeMetric(buf, "vod_segment_wait_seconds", "histogram", "Time waited for a segment to be written.")
+	var cumulative int64
+	for i, le := range waitBuckets {
+		cumulative += m.waits[i]
+		writeSample(buf, "vod_segment_wait_seconds_bucket", fmt.Sprintf("le=%q", strconv.FormatFloat(le, 'g', -1, 64)), float64(cumulative))
+	}
+	writeSample(buf, "vod_segment_wait_seconds_bucket", `le="+Inf"`, float64(m.waitN))
+	writeSample(buf, "vod_segment_wait_seconds_sum", "", m.waitS)
+	writeSample(buf, "vod_segment_wait_seconds_count", "", float64(m.waitN))
+
+	return buf.Bytes()
+}
+
+func writeMetric(buf *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSample(buf *bytes.Buffer, name, labels string, value float64) {
+	if labels != "" {
+		name = name + "{" + labels + "}"
+	}
+	fmt.Fprintf(buf, "%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// dirSize returns the total size of the files in the dir, the files removed while walking are ignored.
+func dirSize(dir string) int64 {
+	var size int64
+
+	_ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
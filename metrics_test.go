@@ -0,0 +1,73 @@
+package vod
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	tmp := t.TempDir()
+	service := newTestService(t)
+	service.config = ContextConfig{TmpPath: tmp, HWAccel: HWAccelNone}
+	service.metrics = newMetrics()
+	addTestContext(t, service, "metrics", nil, testProbeInfo())
+	assert.Nil(t, os.WriteFile(filepath.Join(tmp, "0.ts"), make([]byte, 100), 0o600))
+
+	m := service.metrics
+	m.segmentProduced()
+	m.segmentProduced()
+	m.segmentServed(sourceCache)
+	m.segmentServed(sourceFFMpeg)
+	m.restarted()
+	m.processStarted(true, "nvenc")
+	m.processStarted(false, "nvenc")
+	m.observeWait(time.Millisecond * 300)
+	m.observeWait(time.Minute)
+
+	w := httptest.NewRecorder()
+	service.MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE vod_contexts gauge\n",
+		"vod_contexts 1\n",
+		"vod_streams 1\n",
+		"vod_ffmpeg_processes{state=\"running\"} 0\n",
+		"vod_hwaccel_info{hwaccel=\"none\"} 1\n",
+		"vod_tmp_bytes 100\n",
+		"vod_segments_produced_total 2\n",
+		"vod_segments_served_total{source=\"cache\"} 1\n",
+		"vod_segments_served_total{source=\"ffmpeg\"} 1\n",
+		"vod_ffmpeg_restarts_total 1\n",
+		"vod_ffmpeg_starts_total{decision=\"copy\",hwaccel=\"none\"} 1\n",
+		"vod_ffmpeg_starts_total{decision=\"transcode\",hwaccel=\"nvenc\"} 1\n",
+		"vod_segment_wait_seconds_bucket{le=\"0.25\"} 0\n",
+		"vod_segment_wait_seconds_bucket{le=\"0.5\"} 1\n",
+		"vod_segment_wait_seconds_bucket{le=\"30\"} 1\n",
+		"vod_segment_wait_seconds_bucket{le=\"+Inf\"} 2\n",
+		"vod_segment_wait_seconds_sum 60.3\n",
+		"vod_segment_wait_seconds_count 2\n",
+	} {
+		assert.Contains(t, body, line)
+	}
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	service := newTestService(t)
+
+	// the nil metrics is a no-op.
+	service.metrics.segmentProduced()
+	service.metrics.observeWait(time.Second)
+
+	w := httptest.NewRecorder()
+	service.MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,173 @@
+package vod
+
+import (
+	"container/heap"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reaper closes the idle contexts of the service, it replaces a polling goroutine per context.
+// The contexts are kept in a min-heap by the time they may expire. Accessing a context doesn't touch the heap,
+// the expired entry checks the last access instead, and is pushed back if the context is still in use.
+type reaper struct {
+	m     sync.Mutex
+	items expiryHeap
+	wake  chan struct{}
+	done  chan struct{}
+	stop  sync.Once
+}
+
+type expiryItem struct {
+	at      time.Time
+	context *Context
+}
+
+type expiryHeap []expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *expiryHeap) Push(x any) {
+	*h = append(*h, x.(expiryItem))
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return item
+}
+
+func newReaper() *reaper {
+	r := &reaper{
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	go r.run()
+
+	return r
+}
+
+// add schedules the context, the contexts without IdleTimeout never expire.
+func (r *reaper) add(c *Context) {
+	if c.contextConfig.IdleTimeout <= 0 {
+		return
+	}
+
+	r.schedule(c, c.idleDeadline())
+}
+
+func (r *reaper) schedule(c *Context, at time.Time) {
+	r.m.Lock()
+	heap.Push(&r.items, expiryItem{at: at, context: c})
+	r.m.Unlock()
+
+	// the new item may be the first one.
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *reaper) close() {
+	r.stop.Do(func() {
+		close(r.done)
+	})
+}
+
+func (r *reaper) run() {
+	for {
+		now := time.Now()
+		due := make([]*Context, 0)
+		wait := time.Hour
+
+		r.m.Lock()
+		for r.items.Len() > 0 && !r.items[0].at.After(now) {
+			due = append(due, heap.Pop(&r.items).(expiryItem).context)
+		}
+		if r.items.Len() > 0 {
+			wait = r.items[0].at.Sub(now)
+		}
+		r.m.Unlock()
+
+		for _, c := range due {
+			r.expire(c, now)
+		}
+
+		if len(due) > 0 {
+			// the rescheduled contexts may change the wait.
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-r.wake:
+			timer.Stop()
+		case <-r.done:
+			timer.Stop()
+
+			return
+		}
+	}
+}
+
+// expire closes the context if it's idle, otherwise it's scheduled again.
+func (r *reaper) expire(c *Context, now time.Time) {
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+
+	deadline := c.idleDeadline()
+	if deadline.After(now) {
+		r.schedule(c, deadline)
+
+		return
+	}
+
+	c.logger.Infof("context %s is idle for %d seconds, closing", c.id, c.contextConfig.IdleTimeout)
+	_ = c.close(CloseIdle, ErrIdleTimeout)
+}
+
+// idleDeadline returns when the context becomes idle. The context is never idle while it has open readers,
+// a long mp4 response doesn't access the context again after it's started.
+func (c *Context) idleDeadline() time.Time {
+	timeout := time.Duration(c.contextConfig.IdleTimeout) * time.Second
+	if atomic.LoadInt32(&c.readers) > 0 {
+		return time.Now().Add(timeout)
+	}
+
+	return time.Unix(atomic.LoadInt64(&c.lastAccess), 0).Add(timeout)
+}
+
+// acquire marks a reader open until the returned release is called, release could be called multiple times.
+func (c *Context) acquire() func() {
+	atomic.AddInt32(&c.readers, 1)
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			atomic.AddInt32(&c.readers, -1)
+			c.access()
+		})
+	}
+}
+
+// activeSource releases the context when the source is closed.
+type activeSource struct {
+	io.ReadSeekCloser
+	release func()
+}
+
+func (a *activeSource) Close() error {
+	a.release()
+
+	return a.ReadSeekCloser.Close()
+}
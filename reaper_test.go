@@ -0,0 +1,47 @@
+package vod
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReaperClosesIdleContext(t *testing.T) {
+	service := newTestService(t)
+	service.reaper = newReaper()
+	context := addTestContext(t, service, "idle", &ContextConfig{Format: FormatMP4, IdleTimeout: 1}, testProbeInfo())
+	atomic.StoreInt64(&context.lastAccess, time.Now().Add(-time.Minute).Unix())
+	service.reaper.add(context)
+
+	select {
+	case <-context.closed:
+	case <-time.After(time.Second * 3):
+		t.Fatal("context is not closed")
+	}
+
+	assert.Nil(t, service.Context("idle"))
+	assert.Equal(t, ErrIdleTimeout, context.Close())
+}
+
+func TestReaperKeepsContextWithOpenReaders(t *testing.T) {
+	service := newTestService(t)
+	service.reaper = newReaper()
+	context := addTestContext(t, service, "idle", &ContextConfig{Format: FormatHLS, IdleTimeout: 1}, testProbeInfo())
+	atomic.StoreInt64(&context.lastAccess, time.Now().Add(-time.Minute).Unix())
+
+	release := context.acquire()
+	service.reaper.expire(context, time.Now())
+	assert.NotNil(t, service.Context("idle"))
+
+	release()
+	release()
+	assert.Equal(t, int32(0), atomic.LoadInt32(&context.readers))
+
+	// release accesses the context, so it expires a timeout later.
+	service.reaper.expire(context, time.Now())
+	assert.NotNil(t, service.Context("idle"))
+	service.reaper.expire(context, time.Now().Add(time.Second*2))
+	assert.Nil(t, service.Context("idle"))
+}
@@ -3,6 +3,8 @@ package vod
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -29,10 +31,11 @@ func NewService(config ContextConfig) (*Service, error) {
 	if err != nil {
 		return nil, err
 	}
-	if config.Format == FormatHLS {
+	if segmented(config.Format) {
 		setHLSDefaultValue(&config)
 	}
 
+	requested := config.HWAccel
 	accel := probeHWAccel(config.FFMpegPath, config.HWAccel)
 	if accel != config.HWAccel {
 		if config.HWAccel == HWAccelAuto {
@@ -67,11 +70,46 @@ func NewService(config ContextConfig) (*Service, error) {
 		config.Logger = NewEmptyLogger()
 	}
 
-	return &Service{
-		logger:   logger,
-		config:   config,
-		contexts: make(map[string]*Context),
-	}, nil
+	var cache *segmentCache
+	if config.CachePath != "" && config.CacheSize > 0 {
+		cache, err = newSegmentCache(config.CachePath, config.CacheSize, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var m *metrics
+	if config.Metrics {
+		m = newMetrics()
+	}
+
+	service := &Service{
+		logger:    logger,
+		config:    config,
+		contexts:  make(map[string]*Context),
+		keyframes: make(map[string]keyframeCache),
+		cache:     cache,
+		reaper:    newReaper(),
+		events:    newEventBus(logger),
+		metrics:   m,
+		admission: newAdmission(&config),
+	}
+
+	if config.Load != nil {
+		service.startLoadMonitor(requested)
+	}
+
+	if config.OutputPath != "" {
+		if err = service.startJobs(); err != nil {
+			if service.load != nil {
+				service.load.close()
+			}
+
+			return nil, err
+		}
+	}
+
+	return service, nil
 }
 
 func setHLSDefaultValue(config *ContextConfig) {
@@ -81,6 +119,18 @@ func setHLSDefaultValue(config *ContextConfig) {
 	if config.TSGenerator == nil {
 		config.TSGenerator = DefaultTSGenerator
 	}
+	if config.InitGenerator == nil {
+		config.InitGenerator = DefaultInitGenerator
+	}
+	if config.KeyGenerator == nil {
+		config.KeyGenerator = DefaultKeyGenerator
+	}
+	if config.TemplateGenerator == nil {
+		config.TemplateGenerator = DefaultTemplateGenerator
+	}
+	if config.SegmentContainer == "" {
+		config.SegmentContainer = ContainerTS
+	}
 	if config.ChunkDuration == 0 {
 		config.ChunkDuration = defaultChunkDuration
 	}
@@ -121,22 +171,70 @@ type Service struct {
 	contexts map[string]*Context
 	config   ContextConfig
 	logger   Logger
+
+	km        sync.Mutex
+	keyframes map[string]keyframeCache
+	cache     *segmentCache // shared by all contexts, nil if disabled
+	reaper    *reaper
+	events    *eventBus
+	metrics   *metrics     // nil if disabled
+	output    *DiskStore   // nil if the jobs are disabled
+	admission *admission   // nil if the ffmpeg processes are not limited
+	jobs      *jobQueue    // nil if the jobs are disabled
+	load      *loadMonitor // nil if the load is not sampled
 }
 
 const (
-	FormatMP4 = "mp4"
-	FormatHLS = "hls"
-	FormatTS  = "ts"
+	FormatMP4  = "mp4"
+	FormatHLS  = "hls"
+	FormatTS   = "ts"
+	FormatDASH = "dash"
+)
+
+// The containers of hls segments.
+const (
+	ContainerTS   = "ts"
+	ContainerFMP4 = "fmp4"
+)
+
+// The software deinterlace filters of the interlaced sources, the hardware encoders use their own.
+const (
+	DeinterlaceBWDIF = "bwdif"
+	DeinterlaceYADIF = "yadif"
+	DeinterlaceNone  = "none"
 )
 
 func supportedFormat(format string) bool {
-	return format == FormatMP4 || format == FormatHLS || format == FormatTS
+	return format == FormatMP4 || format == FormatHLS || format == FormatTS || format == FormatDASH
+}
+
+// segmented returns true if the format is served by segments.
+func segmented(format string) bool {
+	return format == FormatHLS || format == FormatDASH
 }
 
 var ErrInvalidFormat = errors.New("invalid format")
 
 func (s *Service) CreateContext(id, path string, config *ContextConfig) (*Context, error) {
-	config = s.mergeConfig(config)
+	context, err := s.createContext(id, path, s.mergeConfig(config))
+	if err != nil {
+		return nil, err
+	}
+
+	s.m.Lock()
+	s.contexts[id] = context
+	s.m.Unlock()
+
+	if s.reaper != nil {
+		s.reaper.add(context)
+	}
+	context.emit(Event{Type: EventContextCreated})
+
+	return context, nil
+}
+
+// createContext creates the context without adding it to the service, the jobs use it directly.
+func (s *Service) createContext(id, path string, config *ContextConfig) (*Context, error) {
 	if err := config.valid(); err != nil {
 		return nil, err
 	}
@@ -145,13 +243,19 @@ func (s *Service) CreateContext(id, path string, config *ContextConfig) (*Contex
 		return nil, ErrInvalidFormat
 	}
 
-	info, err := s.Probe(path)
+	// the source is probed with the options of the context, like SourceHeader.
+	info, err := s.probe(path, config)
 	if err != nil {
 		return nil, err
 	}
+	// the mp4 content is not split, so it doesn't need the keyframes,
+	// and the remote source is split by the chunk duration, as probing the keyframes downloads the whole file.
+	if config.Format != FormatMP4 && !isRemote(path) {
+		s.resolveKeyframes(path, config, info)
+	}
 
+	config = s.contextConfig(id, config)
 	// even if the same path, we still create a new context
-	config.TmpPath = filepath.Join(config.TmpPath, id)
 	_ = os.RemoveAll(config.TmpPath)
 	err = os.MkdirAll(config.TmpPath, os.ModePerm)
 	if err != nil {
@@ -161,14 +265,25 @@ func (s *Service) CreateContext(id, path string, config *ContextConfig) (*Contex
 	if err != nil {
 		return nil, err
 	}
-
-	s.m.Lock()
-	s.contexts[id] = context
-	s.m.Unlock()
+	context.cache = s.cache
+	context.output = s.output
+	context.admission = s.admission
+	context.load = s.load
+	context.events = s.events
+	context.metrics = s.metrics
 
 	return context, nil
 }
 
+// contextConfig returns the copy of the config owned by the context, so the caller could reuse its config.
+func (s *Service) contextConfig(id string, config *ContextConfig) *ContextConfig {
+	owned := *config
+	owned.TmpPath = filepath.Join(config.TmpPath, id)
+	owned.HWAccel = s.routeHWAccel(id, config.HWAccel)
+
+	return &owned
+}
+
 func (s *Service) mergeConfig(config *ContextConfig) *ContextConfig {
 	if config == nil {
 		config = &ContextConfig{}
@@ -179,6 +294,42 @@ func (s *Service) mergeConfig(config *ContextConfig) *ContextConfig {
 	if config.TSGenerator == nil {
 		config.TSGenerator = s.config.TSGenerator
 	}
+	if config.InitGenerator == nil {
+		config.InitGenerator = s.config.InitGenerator
+	}
+	if config.TemplateGenerator == nil {
+		config.TemplateGenerator = s.config.TemplateGenerator
+	}
+	if config.SegmentContainer == "" {
+		config.SegmentContainer = s.config.SegmentContainer
+	}
+	if config.Encryption == "" {
+		config.Encryption = s.config.Encryption
+	}
+	if config.KeyProvider == nil {
+		config.KeyProvider = s.config.KeyProvider
+	}
+	if config.KeyGenerator == nil {
+		config.KeyGenerator = s.config.KeyGenerator
+	}
+	if config.Trickplay == nil {
+		config.Trickplay = s.config.Trickplay
+	}
+	if config.SegmentStore == nil {
+		config.SegmentStore = s.config.SegmentStore
+	}
+	if config.SourceHeader == nil {
+		config.SourceHeader = s.config.SourceHeader
+	}
+	if config.SourceClient == nil {
+		config.SourceClient = s.config.SourceClient
+	}
+	if config.SpriteGenerator == nil {
+		config.SpriteGenerator = s.config.SpriteGenerator
+	}
+	if config.Signer == nil {
+		config.Signer = s.config.Signer
+	}
 	if config.TmpPath == "" {
 		config.TmpPath = s.config.TmpPath
 	}
@@ -212,14 +363,32 @@ func (s *Service) mergeConfig(config *ContextConfig) *ContextConfig {
 	if config.MinBuffer == 0 {
 		config.MinBuffer = s.config.MinBuffer
 	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = s.config.IdleTimeout
+	}
+	if config.Deinterlace == "" {
+		config.Deinterlace = s.config.Deinterlace
+	}
+	if config.DeinterlaceDoubleRate == nil {
+		config.DeinterlaceDoubleRate = s.config.DeinterlaceDoubleRate
+	}
 
 	return config
 }
 
+// AudioTrack is an audio stream of the source.
+// Index is the absolute stream index in the source, Key is the name of the rendition serving it.
 type AudioTrack struct {
-	Index int
-	Codec string
-	Key   string
+	Index    int
+	Codec    string
+	Key      string
+	Language string
+	Title    string
+	Channels int
+	Default  bool
+	Forced   bool
+	Profile  string // like LC or HE-AAC
+	Bitrate  int    // 0 if unknown
 }
 
 type ProbeInfo struct {
@@ -231,21 +400,146 @@ type ProbeInfo struct {
 	FrameRate    float64
 	Width        int
 	Height       int
+	Rotation     int // clockwise degrees to display the video, 0, 90, 180 or 270
 	AudioCodec   string
 	VideoCodec   string
+	// VideoProfile, VideoLevel and PixelFormat are used to build the codec strings, the level is the ffprobe value,
+	// like 40 for h264 level 4.0 and 120 for hevc level 4.0.
+	VideoProfile string
+	VideoLevel   int
+	PixelFormat  string
+	// ColorTransfer, ColorPrimaries and ColorSpace are the ffprobe values, like smpte2084, bt2020 and bt2020nc of HDR10.
+	ColorTransfer  string
+	ColorPrimaries string
+	ColorSpace     string
+	// FieldOrder is the ffprobe value, progressive or the field order of the interlaced video like tt and bb.
+	FieldOrder string
 
 	// AudioBitrate int // Not always available
-	Format      string
-	AudioTracks []AudioTrack
+	Format string
+	// Keyframes are the keyframe timestamps of the video in seconds, used to split the segments.
+	Keyframes      []float64 `json:"-"`
+	AudioTracks    []AudioTrack
+	SubtitleTracks []SubtitleTrack
+}
+
+// SubtitleTrack is a text subtitle stream of the source, it's served as WebVTT.
+// Index is the absolute stream index in the source, Key is the name of the rendition serving it.
+type SubtitleTrack struct {
+	Index    int
+	Codec    string
+	Key      string
+	Language string
+	Title    string
+	Default  bool
+	Forced   bool
+}
+
+// textSubtitleCodecs are the subtitle codecs could be converted to WebVTT,
+// bitmap subtitles like pgs or dvd need to burn in which is not supported.
+var textSubtitleCodecs = map[string]bool{
+	"subrip":   true,
+	"ass":      true,
+	"ssa":      true,
+	"mov_text": true,
+	"webvtt":   true,
+}
+
+// probeSideData is the side data of the stream, only the display matrix is used.
+type probeSideData struct {
+	Rotation float64 `json:"rotation"`
+}
+
+// resolveRotation returns the clockwise rotation of the video.
+// The display matrix is counter-clockwise, while the legacy rotate tag is clockwise.
+func resolveRotation(tag string, sideData []probeSideData) int {
+	var degrees float64
+
+	if rotate, err := strconv.ParseFloat(tag, 64); err == nil {
+		degrees = rotate
+	}
+
+	for _, data := range sideData {
+		if data.Rotation != 0 {
+			degrees = -data.Rotation
+		}
+	}
+
+	rotation := int(math.Round(degrees/90)) * 90 % 360
+	if rotation < 0 {
+		rotation += 360
+	}
+
+	return rotation
+}
+
+// displaySize returns the size of the video after rotation.
+func (p *ProbeInfo) displaySize() (int, int) {
+	if p.Rotation == 90 || p.Rotation == 270 {
+		return p.Height, p.Width
+	}
+
+	return p.Width, p.Height
+}
+
+// The color transfers of the HDR videos.
+const (
+	transferPQ  = "smpte2084"
+	transferHLG = "arib-std-b67"
+)
+
+// HDR returns true if the video is HDR10 (PQ) or HLG.
+func (p *ProbeInfo) HDR() bool {
+	return p.ColorTransfer == transferPQ || p.ColorTransfer == transferHLG
+}
+
+// Interlaced returns true if the fields of the video are interlaced.
+func (p *ProbeInfo) Interlaced() bool {
+	switch p.FieldOrder {
+	case "tt", "bb", "tb", "bt":
+		return true
+	}
+
+	return false
+}
+
+// DefaultAudioTrack returns the track marked as default, or the first track if none is marked.
+// It returns nil if the source has no audio.
+func (p *ProbeInfo) DefaultAudioTrack() *AudioTrack {
+	for i := range p.AudioTracks {
+		if p.AudioTracks[i].Default {
+			return &p.AudioTracks[i]
+		}
+	}
+
+	if len(p.AudioTracks) > 0 {
+		return &p.AudioTracks[0]
+	}
+
+	return nil
 }
 
 func (s *Service) Stop() error {
+	if s.reaper != nil {
+		s.reaper.close()
+	}
+	if s.load != nil {
+		s.load.close()
+	}
+	// the running jobs are queued again, so they resume on the next start.
+	if s.jobs != nil {
+		s.jobs.close()
+	}
+
 	s.m.Lock()
-	contexts := s.contexts
+	contexts := make([]*Context, 0, len(s.contexts))
+	for _, c := range s.contexts {
+		contexts = append(contexts, c)
+	}
 	s.m.Unlock()
 
 	for _, c := range contexts {
-		err := c.Close()
+		err := c.close(CloseShutdown, nil)
 		if err != nil {
 			return err
 		}
@@ -261,15 +555,40 @@ var (
 	ErrNoVideoFound   = errors.New("no video stream found")
 )
 
+// Probe returns the streams and the keyframes of the source, which is read with the source options of the service.
 func (s *Service) Probe(path string) (*ProbeInfo, error) {
-	if _, err := os.Stat(path); err != nil {
+	probe, err := s.probe(path, &s.config)
+	if err != nil {
+		return nil, err
+	}
+	s.resolveKeyframes(path, &s.config, probe)
+
+	return probe, nil
+}
+
+// resolveKeyframes sets the keyframes of the probe,
+// without keyframes, we still could split the segments by the chunk duration.
+func (s *Service) resolveKeyframes(path string, config *ContextConfig, probe *ProbeInfo) {
+	var err error
+
+	probe.Keyframes, err = s.probeKeyframes(path, config)
+	if err != nil {
+		s.logger.Warnf("failed to probe keyframes of %s: %v", path, err)
+	}
+}
+
+// probe returns the streams of the source without the keyframes, which need to read the whole file.
+func (s *Service) probe(path string, config *ContextConfig) (*ProbeInfo, error) {
+	if _, err := config.statSource(path); err != nil {
 		return nil, err
 	}
 	args := []string{
-		"-v", "error", "-show_entries", "format:stream", "-of", "json", path,
+		"-v", "error", "-show_entries", "format:stream", "-of", "json",
 	}
+	args = append(args, config.inputArgs(path)...)
+	args = append(args, path)
 
-	probeCmd := exec.Command(s.config.FFProbePath, args...)
+	probeCmd := exec.Command(config.FFProbePath, args...)
 	s.logger.Debugf("Running command: %s", probeCmd.String())
 	output, err := probeCmd.Output()
 	if err != nil {
@@ -332,16 +651,54 @@ func (s *Service) resolveProbeStream(info *ProbeResult, videoCount int, probe *P
 				probe.VideoBitrate = bitrate
 			}
 			probe.VideoCodec = stream.CodecName
+			probe.VideoProfile = stream.Profile
+			probe.VideoLevel = stream.Level
+			probe.PixelFormat = stream.PixFmt
+			probe.ColorTransfer = stream.ColorTransfer
+			probe.ColorPrimaries = stream.ColorPrimaries
+			probe.ColorSpace = stream.ColorSpace
+			probe.FieldOrder = stream.FieldOrder
 			probe.Width = stream.Width
 			probe.Height = stream.Height
+			probe.Rotation = resolveRotation(stream.Tags.Rotate, stream.SideDataList)
 			probe.FrameRate = s.resolveFrameRate(stream.RFrameRate)
 			if probe.FrameRate == 0 {
 				probe.FrameRate = s.resolveFrameRate(stream.AvgFrameRate)
 			}
 		}
 		if stream.CodecType == "audio" {
-			probe.AudioCodec = stream.CodecName
+			track := AudioTrack{
+				Index:    stream.Index,
+				Codec:    stream.CodecName,
+				Key:      fmt.Sprintf("audio-%d", len(probe.AudioTracks)),
+				Language: stream.Tags.Language,
+				Title:    stream.Tags.Title,
+				Channels: stream.Channels,
+				Default:  stream.Disposition.Default > 0,
+				Forced:   stream.Disposition.Forced > 0,
+				Profile:  stream.Profile,
+			}
+			if bitrate, err := strconv.Atoi(stream.BitRate); err == nil && bitrate > 0 {
+				track.Bitrate = bitrate
+			}
+			probe.AudioTracks = append(probe.AudioTracks, track)
 		}
+		if stream.CodecType == "subtitle" && textSubtitleCodecs[stream.CodecName] {
+			probe.SubtitleTracks = append(probe.SubtitleTracks, SubtitleTrack{
+				Index:    stream.Index,
+				Codec:    stream.CodecName,
+				Key:      fmt.Sprintf("subtitle-%d", len(probe.SubtitleTracks)),
+				Language: stream.Tags.Language,
+				Title:    stream.Tags.Title,
+				Default:  stream.Disposition.Default > 0,
+				Forced:   stream.Disposition.Forced > 0,
+			})
+		}
+	}
+
+	if track := probe.DefaultAudioTrack(); track != nil {
+		probe.AudioCodec = track.Codec
+		probe.AudioBitrate = track.Bitrate
 	}
 
 	return videoCount
@@ -380,8 +737,8 @@ func probeHWAccel(ffmpeg string, accel HWAccel) HWAccel {
 	return HWAccelNone
 }
 
-// Why do we keep the contexts any way.
-func (s *Service) stopContext(id string, normal CloseReason) {
+// stopContext removes the closed context from the service.
+func (s *Service) stopContext(id string, _ CloseReason) {
 	s.m.Lock()
 	defer s.m.Unlock()
 	delete(s.contexts, id)
@@ -398,14 +755,33 @@ func (s *Service) Context(id string) *Context {
 //nolint:tagliatelle
 type ProbeResult struct {
 	Streams []struct {
-		CodecType    string `json:"codec_type"`
-		CodecName    string `json:"codec_name"`
-		BitRate      string `json:"bit_rate"`
-		Width        int    `json:"width,omitempty"`
-		Height       int    `json:"height,omitempty"`
-		HasBFrames   int    `json:"has_b_frames,omitempty"`
-		RFrameRate   string `json:"r_frame_rate"`
-		AvgFrameRate string `json:"avg_frame_rate"`
+		Index          int    `json:"index"`
+		CodecType      string `json:"codec_type"`
+		CodecName      string `json:"codec_name"`
+		Profile        string `json:"profile"`
+		Level          int    `json:"level"`
+		PixFmt         string `json:"pix_fmt"`
+		ColorTransfer  string `json:"color_transfer"`
+		ColorPrimaries string `json:"color_primaries"`
+		ColorSpace     string `json:"color_space"`
+		FieldOrder     string `json:"field_order"`
+		BitRate        string `json:"bit_rate"`
+		Width          int    `json:"width,omitempty"`
+		Height         int    `json:"height,omitempty"`
+		HasBFrames     int    `json:"has_b_frames,omitempty"`
+		RFrameRate     string `json:"r_frame_rate"`
+		AvgFrameRate   string `json:"avg_frame_rate"`
+		Channels       int    `json:"channels,omitempty"`
+		Tags           struct {
+			Language string `json:"language"`
+			Title    string `json:"title"`
+			Rotate   string `json:"rotate"`
+		} `json:"tags"`
+		SideDataList []probeSideData `json:"side_data_list"`
+		Disposition  struct {
+			Default int `json:"default"`
+			Forced  int `json:"forced"`
+		} `json:"disposition"`
 	} `json:"streams"`
 	Format struct {
 		FormatName string `json:"format_name"`
@@ -2,6 +2,7 @@ package vod
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -400,3 +401,52 @@ func TestProbeParsesAudioStreamInfo(t *testing.T) {
 	}
 	assert.NoError(t, service.Stop())
 }
+
+func TestResolveProbeStreamCollectsAudioTracks(t *testing.T) {
+	service := newTestService(t)
+	result := &ProbeResult{}
+	err := json.Unmarshal([]byte(`{"streams":[
+		{"index":0,"codec_type":"video","codec_name":"h264","width":1920,"height":1080,"r_frame_rate":"24/1"},
+		{"index":1,"codec_type":"audio","codec_name":"ac3","channels":6,"tags":{"language":"jpn"}},
+		{"index":2,"codec_type":"audio","codec_name":"aac","channels":2,"tags":{"language":"eng","title":"Commentary"},
+			"disposition":{"default":1,"forced":0}}
+	]}`), result)
+	assert.NoError(t, err)
+
+	var probe ProbeInfo
+	assert.Equal(t, 1, service.resolveProbeStream(result, 0, &probe))
+	assert.Equal(t, []AudioTrack{
+		{Index: 1, Codec: "ac3", Key: "audio-0", Language: "jpn", Channels: 6},
+		{Index: 2, Codec: "aac", Key: "audio-1", Language: "eng", Title: "Commentary", Channels: 2, Default: true},
+	}, probe.AudioTracks)
+	assert.Equal(t, "aac", probe.AudioCodec)
+	assert.False(t, probe.HDR())
+	assert.False(t, probe.Interlaced())
+}
+
+func TestResolveProbeStreamParsesColorAndFieldOrder(t *testing.T) {
+	service := newTestService(t)
+	result := &ProbeResult{}
+	err := json.Unmarshal([]byte(`{"streams":[
+		{"index":0,"codec_type":"video","codec_name":"hevc","width":3840,"height":2160,"r_frame_rate":"25/1",
+			"pix_fmt":"yuv420p10le","color_transfer":"arib-std-b67","color_primaries":"bt2020","color_space":"bt2020nc",
+			"field_order":"bb"}
+	]}`), result)
+	assert.NoError(t, err)
+
+	var probe ProbeInfo
+	service.resolveProbeStream(result, 0, &probe)
+	assert.Equal(t, "yuv420p10le", probe.PixelFormat)
+	assert.Equal(t, transferHLG, probe.ColorTransfer)
+	assert.Equal(t, "bt2020", probe.ColorPrimaries)
+	assert.Equal(t, "bt2020nc", probe.ColorSpace)
+	assert.True(t, probe.HDR())
+	assert.True(t, probe.Interlaced())
+
+	// the progressive SDR video.
+	probe = ProbeInfo{}
+	result.Streams[0].ColorTransfer, result.Streams[0].FieldOrder = "bt709", "progressive"
+	service.resolveProbeStream(result, 0, &probe)
+	assert.False(t, probe.HDR())
+	assert.False(t, probe.Interlaced())
+}
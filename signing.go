@@ -0,0 +1,194 @@
+package vod
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSignTTL = time.Hour * 6
+	queryExpires   = "exp"
+	querySignature = "sig"
+)
+
+var (
+	ErrSignatureInvalid = errors.New("url signature is invalid")
+	ErrSignatureExpired = errors.New("url signature is expired")
+)
+
+// URLSigner signs the urls of the contexts by HMAC-SHA256.
+// A token grants access to all resources of a context until it expires, the segment index and the spec are not
+// signed, so the dash segment template works. If BindIP is true, the token only works for the client which it's
+// issued to.
+//
+// The handler verifies the token of every request, and appends the token of the request to the urls in the
+// playlists, so only the url given to the player needs to be signed by SignURL.
+type URLSigner struct {
+	Secret []byte
+	TTL    time.Duration // default is 6 hours
+	BindIP bool
+	// ClientIP returns the ip of the request, default is the host of RemoteAddr.
+	// Set it if the service is behind a proxy.
+	ClientIP func(r *http.Request) string
+
+	now func() time.Time
+}
+
+// SignURL appends the token of the context to the url, ip is ignored unless BindIP is true.
+func (u *URLSigner) SignURL(rawURL, contextID, ip string) string {
+	ttl := u.TTL
+	if ttl <= 0 {
+		ttl = defaultSignTTL
+	}
+	expires := u.clock().Add(ttl).Unix()
+
+	return appendToken(rawURL, u.token(contextID, ip, expires))
+}
+
+// Verify checks the token in the query of the request.
+func (u *URLSigner) Verify(r *http.Request, contextID string) error {
+	query := r.URL.Query()
+
+	expires, err := strconv.ParseInt(query.Get(queryExpires), 10, 64)
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(query.Get(querySignature))
+	if err != nil || !hmac.Equal(signature, u.sign(contextID, u.clientIP(r), expires)) {
+		return ErrSignatureInvalid
+	}
+
+	if u.clock().Unix() > expires {
+		return ErrSignatureExpired
+	}
+
+	return nil
+}
+
+func (u *URLSigner) token(contextID, ip string, expires int64) string {
+	values := url.Values{}
+	values.Set(queryExpires, strconv.FormatInt(expires, 10))
+	values.Set(querySignature, base64.RawURLEncoding.EncodeToString(u.sign(contextID, ip, expires)))
+
+	return values.Encode()
+}
+
+func (u *URLSigner) sign(contextID, ip string, expires int64) []byte {
+	if !u.BindIP {
+		ip = ""
+	}
+
+	mac := hmac.New(sha256.New, u.Secret)
+	mac.Write([]byte(contextID + "\n" + strconv.FormatInt(expires, 10) + "\n" + ip))
+
+	return mac.Sum(nil)
+}
+
+func (u *URLSigner) clientIP(r *http.Request) string {
+	if u.ClientIP != nil {
+		return u.ClientIP(r)
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func (u *URLSigner) clock() time.Time {
+	if u.now != nil {
+		return u.now()
+	}
+
+	return time.Now()
+}
+
+// requestToken returns the token of the verified request, which is passed to the urls in the playlists.
+// The expiry is kept, so fetching the playlist again doesn't extend it.
+func requestToken(r *http.Request) string {
+	query := r.URL.Query()
+	values := url.Values{}
+	values.Set(queryExpires, query.Get(queryExpires))
+	values.Set(querySignature, query.Get(querySignature))
+
+	return values.Encode()
+}
+
+// appendToken appends the token to the query of the uri, before the fragment.
+func appendToken(uri, token string) string {
+	fragment := ""
+	if i := strings.Index(uri, "#"); i >= 0 {
+		uri, fragment = uri[:i], uri[i:]
+	}
+
+	separator := "?"
+	if strings.Contains(uri, "?") {
+		separator = "&"
+	}
+
+	return uri + separator + token + fragment
+}
+
+var (
+	// the URI attributes of the hls tags, like EXT-X-MAP, EXT-X-KEY and EXT-X-MEDIA.
+	hlsURIAttribute = regexp.MustCompile(`URI="([^"]*)"`)
+	// the url attributes of the dash SegmentTemplate.
+	dashURLAttribute = regexp.MustCompile(`(media|initialization)="([^"]*)"`)
+)
+
+// signPlaylist appends the token to the uris in the hls playlist or the WebVTT thumbnail track.
+func signPlaylist(content []byte, token string) []byte {
+	out := &bytes.Buffer{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, "#"):
+			line = hlsURIAttribute.ReplaceAllStringFunc(line, func(attr string) string {
+				uri := hlsURIAttribute.FindStringSubmatch(attr)[1]
+
+				return `URI="` + appendToken(uri, token) + `"`
+			})
+		case line == "", strings.HasPrefix(line, "WEBVTT"), strings.Contains(line, "-->"):
+		default:
+			line = appendToken(line, token)
+		}
+
+		out.WriteString(line + "\n")
+	}
+
+	return out.Bytes()
+}
+
+// signManifest appends the token to the segment urls in the dash manifest, the xml escapes the ampersand.
+func signManifest(content []byte, token string) []byte {
+	token = strings.ReplaceAll(token, "&", "&amp;")
+
+	return dashURLAttribute.ReplaceAllFunc(content, func(attr []byte) []byte {
+		match := dashURLAttribute.FindSubmatch(attr)
+		uri := string(match[2])
+
+		separator := "?"
+		if strings.Contains(uri, "?") {
+			separator = "&amp;"
+		}
+
+		return []byte(string(match[1]) + `="` + uri + separator + token + `"`)
+	})
+}
@@ -0,0 +1,120 @@
+package vod
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSigner(now time.Time) *URLSigner {
+	return &URLSigner{Secret: []byte("secret"), TTL: time.Hour, now: func() time.Time { return now }}
+}
+
+func TestURLSignerVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	signer := newTestSigner(now)
+	signed := signer.SignURL("/video/index.m3u8?id=a", "a", "10.0.0.1")
+	assert.Equal(t, "/video/index.m3u8?id=a&exp=1700003600&sig=", signed[:len("/video/index.m3u8?id=a&exp=1700003600&sig=")])
+
+	request := httptest.NewRequest(http.MethodGet, signed, nil)
+	assert.NoError(t, signer.Verify(request, "a"))
+	assert.Equal(t, ErrSignatureInvalid, signer.Verify(request, "b"))
+
+	// the expiry is signed.
+	tampered := httptest.NewRequest(http.MethodGet, strings.Replace(signed, "exp=1700003600", "exp=1800000000", 1), nil)
+	assert.Equal(t, ErrSignatureInvalid, signer.Verify(tampered, "a"))
+	assert.Equal(t, ErrSignatureInvalid, signer.Verify(httptest.NewRequest(http.MethodGet, "/video/ts?id=a", nil), "a"))
+
+	signer.now = func() time.Time { return now.Add(time.Hour * 2) }
+	assert.Equal(t, ErrSignatureExpired, signer.Verify(request, "a"))
+}
+
+func TestURLSignerBindIP(t *testing.T) {
+	signer := newTestSigner(time.Now())
+	signer.BindIP = true
+	signed := signer.SignURL("/video/ts?id=a&index=1", "a", "10.0.0.1")
+
+	request := httptest.NewRequest(http.MethodGet, signed, nil)
+	request.RemoteAddr = "10.0.0.1:4000"
+	assert.NoError(t, signer.Verify(request, "a"))
+
+	request.RemoteAddr = "10.0.0.2:4000"
+	assert.Equal(t, ErrSignatureInvalid, signer.Verify(request, "a"))
+
+	// the index is not signed.
+	request = httptest.NewRequest(http.MethodGet, strings.Replace(signed, "index=1", "index=2", 1), nil)
+	request.RemoteAddr = "10.0.0.1:4000"
+	assert.NoError(t, signer.Verify(request, "a"))
+}
+
+func TestSignPlaylist(t *testing.T) {
+	playlist := "#EXTM3U\n#EXT-X-MAP:URI=\"/video/init?id=a\"\n#EXTINF:6.000,\n/video/ts?id=a&index=0\n\n"
+	assert.Equal(t, "#EXTM3U\n#EXT-X-MAP:URI=\"/video/init?id=a&t=1\"\n#EXTINF:6.000,\n/video/ts?id=a&index=0&t=1\n\n",
+		string(signPlaylist([]byte(playlist), "t=1")))
+
+	vtt := "WEBVTT\n\n00:00:00.000 --> 00:00:10.000\n/video/sprite?id=a&index=0#xywh=0,0,320,180\n"
+	assert.Equal(t, "WEBVTT\n\n00:00:00.000 --> 00:00:10.000\n/video/sprite?id=a&index=0&t=1#xywh=0,0,320,180\n",
+		string(signPlaylist([]byte(vtt), "t=1")))
+
+	trickplay := "#EXTM3U\ntrickplay.m3u8\n"
+	assert.Equal(t, "#EXTM3U\ntrickplay.m3u8?t=1\n", string(signPlaylist([]byte(trickplay), "t=1")))
+}
+
+func TestSignManifest(t *testing.T) {
+	manifest := `<SegmentTemplate media="/video/ts?id=a&amp;index=$Number$" initialization="/video/init?id=a"></SegmentTemplate>`
+	assert.Equal(t,
+		`<SegmentTemplate media="/video/ts?id=a&amp;index=$Number$&amp;exp=1&amp;sig=x" initialization="/video/init?id=a&amp;exp=1&amp;sig=x"></SegmentTemplate>`,
+		string(signManifest([]byte(manifest), "exp=1&sig=x")))
+}
+
+func TestHandlerVerifiesSignedURLs(t *testing.T) {
+	service := newTestService(t, "test")
+	service.config.Signer = newTestSigner(time.Now())
+	handler := service.Handler("/video")
+
+	// the unknown ids are verified by the signer of the service.
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/video/index.m3u8?id=other", nil))
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+	// the context is served unsigned as it's created without a signer.
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/video/index.m3u8?id=test", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// the context signs by its own signer.
+	signer := newTestSigner(time.Now())
+	signer.Secret = []byte("context secret")
+	addTestContext(t, service, "signed", &ContextConfig{Signer: signer}, testProbeInfo())
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/video/index.m3u8?id=signed", nil))
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet,
+		service.config.Signer.SignURL("/video/index.m3u8?id=signed", "signed", ""), nil))
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+	signed := signer.SignURL("/video/index.m3u8?id=signed", "signed", "")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, signed, nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	token := signed[strings.Index(signed, "&exp=")+1:]
+	assert.Contains(t, recorder.Body.String(), "/video/ts?id=signed&index=3&spec=Origin&"+token+"\n")
+
+	// the urls in the playlist carry the same token.
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		if strings.HasPrefix(line, "/video/") {
+			u, err := url.Parse(line)
+			assert.NoError(t, err)
+			assert.NoError(t, signer.Verify(httptest.NewRequest(http.MethodGet, u.String(), nil), "signed"))
+		}
+	}
+}
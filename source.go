@@ -0,0 +1,244 @@
+package vod
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrRemoteSource = errors.New("remote source responds an unexpected status")
+
+// SourceHeader returns the http headers of the remote source, like Authorization or Cookie.
+type SourceHeader func(source string) http.Header
+
+// isRemote returns true if the source is a http(s) url rather than a local file.
+func isRemote(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// sourceStat identifies the version of the source, the caches are invalid once it changes.
+type sourceStat struct {
+	size    int64
+	modTime time.Time
+	etag    string // remote only
+}
+
+// statSource returns the stat of the source, the remote one is requested by HEAD, or by a range request
+// if the server doesn't allow HEAD.
+func (c *ContextConfig) statSource(path string) (sourceStat, error) {
+	if !isRemote(path) {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return sourceStat{}, err
+		}
+
+		return sourceStat{size: stat.Size(), modTime: stat.ModTime()}, nil
+	}
+
+	// without Content-Length, the size is asked by a range request.
+	resp, err := c.requestSource(http.MethodHead, path, "")
+	if err == nil && resp.StatusCode == http.StatusOK && resp.ContentLength >= 0 {
+		_ = resp.Body.Close()
+
+		return remoteStat(resp, resp.ContentLength), nil
+	}
+	if err == nil {
+		_ = resp.Body.Close()
+	}
+
+	resp, err = c.requestSource(http.MethodGet, path, "bytes=0-0")
+	if err != nil {
+		return sourceStat{}, err
+	}
+	_ = resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// Content-Range: bytes 0-0/12345
+		_, total, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+		if size, err := strconv.ParseInt(total, 10, 64); err == nil {
+			return remoteStat(resp, size), nil
+		}
+	case http.StatusOK:
+		if resp.ContentLength >= 0 {
+			return remoteStat(resp, resp.ContentLength), nil
+		}
+	case http.StatusNotFound:
+		return sourceStat{}, fmt.Errorf("%w: %s", os.ErrNotExist, path)
+	}
+
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+		return sourceStat{}, fmt.Errorf("%w: unknown size of %s", ErrRemoteSource, path)
+	}
+
+	return sourceStat{}, fmt.Errorf("%w: %s %s", ErrRemoteSource, resp.Status, path)
+}
+
+func remoteStat(resp *http.Response, size int64) sourceStat {
+	stat := sourceStat{size: size, etag: resp.Header.Get("ETag")}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		stat.modTime = modTime
+	}
+
+	return stat
+}
+
+func (c *ContextConfig) requestSource(method, path, byteRange string) (*http.Response, error) {
+	req, err := http.NewRequest(method, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.SourceHeader != nil {
+		for key, values := range c.SourceHeader(path) {
+			for _, value := range values {
+				req.Header.Add(key, value)
+			}
+		}
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+
+	client := c.SourceClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return client.Do(req)
+}
+
+// openSource opens the source for passthrough, the remote one is read by range requests, so it's seekable.
+func (c *ContextConfig) openSource(path string) (io.ReadSeekCloser, time.Time, error) {
+	if !isRemote(path) {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+
+		stat, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+
+			return nil, time.Time{}, err
+		}
+
+		return file, stat.ModTime(), nil
+	}
+
+	stat, err := c.statSource(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return &remoteFile{config: c, url: path, size: stat.size}, stat.modTime, nil
+}
+
+// inputArgs returns the input options of ffmpeg and ffprobe for the source, they must be before -i.
+// The remote source reconnects after the network errors, and carries the headers.
+func (c *ContextConfig) inputArgs(path string) []string {
+	if !isRemote(path) {
+		return nil
+	}
+
+	args := []string{
+		"-reconnect", "1",
+		"-reconnect_on_network_error", "1",
+		"-reconnect_delay_max", "10",
+	}
+
+	if c.SourceHeader != nil {
+		header := c.SourceHeader(path)
+		keys := make([]string, 0, len(header))
+		for key := range header {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		lines := &strings.Builder{}
+		for _, key := range keys {
+			for _, value := range header[key] {
+				lines.WriteString(key + ": " + value + "\r\n")
+			}
+		}
+		if lines.Len() > 0 {
+			args = append(args, "-headers", lines.String())
+		}
+	}
+
+	return args
+}
+
+// remoteFile reads the remote source from the offset by a range request, seeking drops the response.
+type remoteFile struct {
+	config *ContextConfig
+	url    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *remoteFile) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.body == nil {
+		resp, err := r.config.requestSource(http.MethodGet, r.url, fmt.Sprintf("bytes=%d-", r.offset))
+		if err != nil {
+			return 0, err
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusPartialContent:
+		case resp.StatusCode == http.StatusOK && r.offset == 0:
+		default:
+			_ = resp.Body.Close()
+
+			return 0, fmt.Errorf("%w: %s %s", ErrRemoteSource, resp.Status, r.url)
+		}
+		r.body = resp.Body
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+
+	return n, err
+}
+
+func (r *remoteFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+
+	if offset < 0 {
+		return 0, ErrInvalidSeek
+	}
+
+	if offset != r.offset {
+		_ = r.Close()
+		r.offset = offset
+	}
+
+	return offset, nil
+}
+
+func (r *remoteFile) Close() error {
+	if r.body == nil {
+		return nil
+	}
+
+	err := r.body.Close()
+	r.body = nil
+
+	return err
+}
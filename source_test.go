@@ -0,0 +1,193 @@
+package vod
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testSourceModTime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// newTestSourceServer serves the content at /video.mp4 to the requests with the token.
+func newTestSourceServer(t *testing.T, content []byte, allowHead bool) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("Authorization") != "Bearer token":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path != "/video.mp4":
+			http.NotFound(w, r)
+		case r.Method == http.MethodHead && !allowHead:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		default:
+			http.ServeContent(w, r, "video.mp4", testSourceModTime, bytes.NewReader(content))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func newTestSourceConfig() *ContextConfig {
+	return &ContextConfig{
+		SourceHeader: func(string) http.Header {
+			return http.Header{"Authorization": []string{"Bearer token"}, "X-Trace": []string{"1"}}
+		},
+	}
+}
+
+func TestStatRemoteSource(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+
+	for _, allowHead := range []bool{true, false} {
+		server := newTestSourceServer(t, content, allowHead)
+		config := newTestSourceConfig()
+
+		stat, err := config.statSource(server.URL + "/video.mp4")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(content)), stat.size)
+		assert.True(t, testSourceModTime.Equal(stat.modTime))
+
+		_, err = config.statSource(server.URL + "/missing.mp4")
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+
+		_, err = (&ContextConfig{}).statSource(server.URL + "/video.mp4")
+		assert.True(t, errors.Is(err, ErrRemoteSource))
+	}
+}
+
+func TestRemoteFileSeeksByRange(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	server := newTestSourceServer(t, content, true)
+
+	file, modTime, err := newTestSourceConfig().openSource(server.URL + "/video.mp4")
+	assert.NoError(t, err)
+	assert.True(t, testSourceModTime.Equal(modTime))
+	defer file.Close()
+
+	size, err := file.Seek(0, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), size)
+
+	_, err = file.Seek(995, io.SeekStart)
+	assert.NoError(t, err)
+	tail, err := io.ReadAll(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "56789", string(tail))
+
+	_, err = file.Seek(-985, io.SeekCurrent)
+	assert.NoError(t, err)
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(file, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "567", string(buf))
+}
+
+func TestRemoteInputArgs(t *testing.T) {
+	config := newTestSourceConfig()
+
+	assert.Nil(t, config.inputArgs("/data/video.mp4"))
+	assert.Equal(t, []string{
+		"-reconnect", "1",
+		"-reconnect_on_network_error", "1",
+		"-reconnect_delay_max", "10",
+		"-headers", "Authorization: Bearer token\r\nX-Trace: 1\r\n",
+	}, config.inputArgs("https://nas.local/video.mp4"))
+}
+
+func TestHandlerProxiesRemotePassthroughMP4(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	server := newTestSourceServer(t, content, true)
+
+	service := newTestService(t)
+	info := &ProbeInfo{Duration: 20, Format: "mov,mp4,m4a,3gp,3g2,mj2", VideoCodec: "h264", AudioCodec: "aac"}
+	config := newTestSourceConfig()
+	config.Format = FormatMP4
+	context := addTestContext(t, service, "remote", config, info)
+	context.path = server.URL + "/video.mp4"
+
+	request := httptest.NewRequest(http.MethodGet, "/video/mp4?id=remote", nil)
+	request.Header.Set("Range", "bytes=10-19")
+	recorder := httptest.NewRecorder()
+	service.Handler("/video").ServeHTTP(recorder, request)
+
+	assert.Equal(t, http.StatusPartialContent, recorder.Code)
+	assert.Equal(t, "bytes 10-19/1000", recorder.Header().Get("Content-Range"))
+	assert.Equal(t, "0123456789", recorder.Body.String())
+}
+
+func TestStatRemoteSourceWithoutContentLength(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			http.ServeContent(w, r, "video.mp4", testSourceModTime, bytes.NewReader(content))
+
+			return
+		}
+		// the flushed response is chunked, without Content-Length.
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+	}))
+	t.Cleanup(server.Close)
+
+	stat, err := (&ContextConfig{}).statSource(server.URL + "/video.mp4")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), stat.size)
+}
+
+func TestCacheKeyStatsRemoteSourceOnce(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	var heads atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads.Add(1)
+		}
+		http.ServeContent(w, r, "video.mp4", testSourceModTime, bytes.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+
+	info := testProbeInfo()
+	context := newTestContext(t, "remote", &ContextConfig{SegmentStore: NewMemoryStore(0)}, info)
+	context.path = server.URL + "/video.mp4"
+	stream := context.Stream(Origin.Name)
+
+	for i := 0; i < 3; i++ {
+		_, ok := stream.cacheKey(i)
+		assert.True(t, ok)
+	}
+	assert.Equal(t, int32(1), heads.Load())
+}
+
+func TestCreateRemoteContextProbesWithContextHeader(t *testing.T) {
+	server := newTestSourceServer(t, bytes.Repeat([]byte("0123456789"), 100), true)
+	ffprobe, runs := newFakeFFMpeg(t, fakeProbeScript)
+	service := newTestService(t)
+	service.config = ContextConfig{
+		Format: FormatHLS, FFMpegPath: ffprobe, FFProbePath: ffprobe, TmpPath: t.TempDir(), StreamSpec: []StreamSpec{Origin},
+		SupportVideoCodec: []string{"h264"}, SupportAudioCodec: []string{"aac"},
+	}
+	setHLSDefaultValue(&service.config)
+
+	// the service has no header, only the context is authorized.
+	_, err := service.CreateContext("remote", server.URL+"/video.mp4", nil)
+	assert.ErrorIs(t, err, ErrRemoteSource)
+
+	context, err := service.CreateContext("remote", server.URL+"/video.mp4", newTestSourceConfig())
+	assert.NoError(t, err)
+
+	// the keyframes are not probed, which downloads the whole file, the chunks are split by the duration.
+	probes := strings.Join(countRuns(t, runs), "\n")
+	assert.Contains(t, probes, "Authorization: Bearer token")
+	assert.NotContains(t, probes, "packet=pts_time")
+	assert.Len(t, context.chunks, 4)
+}
@@ -0,0 +1,215 @@
+package vod
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrSegmentNotFound = errors.New("segment not found")
+
+// SegmentStore keeps the finished segments by their cache keys, so they outlive the process, or are shared by
+// the nodes of a fleet. The keys are like "<sha256>.ts" and may contain "/".
+// ffmpeg still writes the segments to TmpPath, they are put into the store once finished.
+type SegmentStore interface {
+	// Put stores the segment, the existing one is replaced.
+	Put(key string, r io.Reader) error
+	// Get returns ErrSegmentNotFound if the segment is not stored.
+	Get(key string) (io.ReadCloser, error)
+	// Delete doesn't return an error if the segment is not stored.
+	Delete(key string) error
+	// List returns the keys with the prefix.
+	List(prefix string) ([]string, error)
+}
+
+// DiskStore stores the segments as files in Dir.
+type DiskStore struct {
+	Dir string
+}
+
+func NewDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	return &DiskStore{Dir: dir}, nil
+}
+
+func (d *DiskStore) path(key string) string {
+	return filepath.Join(d.Dir, filepath.FromSlash(key))
+}
+
+// Put writes a tmp file first, so a partial segment is never read.
+func (d *DiskStore) Put(key string, r io.Reader) error {
+	path := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := path + cacheTmpSuffix
+
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(out, r); err != nil {
+		_ = out.Close()
+		_ = os.Remove(tmp)
+
+		return err
+	}
+
+	if err = out.Close(); err != nil {
+		_ = os.Remove(tmp)
+
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (d *DiskStore) has(key string) bool {
+	_, err := os.Stat(d.path(key))
+
+	return err == nil
+}
+
+func (d *DiskStore) Get(key string) (io.ReadCloser, error) {
+	f, err := os.Open(d.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrSegmentNotFound
+	}
+
+	return f, err
+}
+
+func (d *DiskStore) Delete(key string) error {
+	if err := os.Remove(d.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (d *DiskStore) List(prefix string) ([]string, error) {
+	keys := make([]string, 0)
+
+	err := filepath.WalkDir(d.Dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || strings.HasSuffix(path, cacheTmpSuffix) {
+			return err
+		}
+
+		rel, err := filepath.Rel(d.Dir, path)
+		if err != nil {
+			return err
+		}
+
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+
+		return nil
+	})
+
+	sort.Strings(keys)
+
+	return keys, err
+}
+
+// MemoryStore keeps the segments in memory, the least recently used ones are dropped once the total size is
+// over the limit. It's for the small boxes without a fast disk.
+type MemoryStore struct {
+	m       sync.Mutex
+	limit   int64
+	size    int64
+	lru     *list.List // front is the most recently used
+	entries map[string]*list.Element
+}
+
+type memorySegment struct {
+	key  string
+	data []byte
+}
+
+func NewMemoryStore(limit int64) *MemoryStore {
+	return &MemoryStore{
+		limit:   limit,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (m *MemoryStore) Put(key string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	m.remove(key)
+	m.entries[key] = m.lru.PushFront(&memorySegment{key: key, data: data})
+	m.size += int64(len(data))
+
+	for m.size > m.limit && m.lru.Len() > 0 {
+		m.remove(m.lru.Back().Value.(*memorySegment).key)
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) Get(key string) (io.ReadCloser, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	e, ok := m.entries[key]
+	if !ok {
+		return nil, ErrSegmentNotFound
+	}
+	m.lru.MoveToFront(e)
+
+	// the data is never modified, a new put replaces the slice.
+	return io.NopCloser(bytes.NewReader(e.Value.(*memorySegment).data)), nil
+}
+
+func (m *MemoryStore) Delete(key string) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	m.remove(key)
+
+	return nil
+}
+
+func (m *MemoryStore) List(prefix string) ([]string, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	keys := make([]string, 0, len(m.entries))
+	for key := range m.entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// remove drops the segment, m.m must be held.
+func (m *MemoryStore) remove(key string) {
+	if e, ok := m.entries[key]; ok {
+		m.lru.Remove(e)
+		delete(m.entries, key)
+		m.size -= int64(len(e.Value.(*memorySegment).data))
+	}
+}
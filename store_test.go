@@ -0,0 +1,97 @@
+package vod
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testSegmentStore checks the behaviors shared by all stores.
+func testSegmentStore(t *testing.T, store SegmentStore) {
+	t.Helper()
+
+	_, err := store.Get("missing.ts")
+	assert.Equal(t, ErrSegmentNotFound, err)
+
+	assert.NoError(t, store.Put("a/1.ts", strings.NewReader("one")))
+	assert.NoError(t, store.Put("a/2.ts", strings.NewReader("two")))
+	assert.NoError(t, store.Put("b/1.ts", strings.NewReader("other")))
+	assert.NoError(t, store.Put("a/1.ts", strings.NewReader("replaced")))
+
+	r, err := store.Get("a/1.ts")
+	assert.Equal(t, "replaced", readAll(t, r, err))
+
+	keys, err := store.List("a/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a/1.ts", "a/2.ts"}, keys)
+
+	assert.NoError(t, store.Delete("a/1.ts"))
+	assert.NoError(t, store.Delete("a/1.ts"))
+	_, err = store.Get("a/1.ts")
+	assert.Equal(t, ErrSegmentNotFound, err)
+
+	keys, err = store.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a/2.ts", "b/1.ts"}, keys)
+}
+
+func TestDiskStore(t *testing.T) {
+	store, err := NewDiskStore(t.TempDir())
+	assert.NoError(t, err)
+
+	testSegmentStore(t, store)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testSegmentStore(t, NewMemoryStore(1<<20))
+}
+
+func TestMemoryStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	store := NewMemoryStore(10)
+	assert.NoError(t, store.Put("a", strings.NewReader("aaaa")))
+	assert.NoError(t, store.Put("b", strings.NewReader("bbbb")))
+
+	r, err := store.Get("a")
+	assert.NoError(t, err)
+	_ = r.Close()
+
+	assert.NoError(t, store.Put("c", strings.NewReader("cccc")))
+
+	keys, err := store.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "c"}, keys)
+	assert.Equal(t, int64(8), store.size)
+}
+
+func TestServeChunkFromStore(t *testing.T) {
+	info := testProbeInfo()
+	store := NewMemoryStore(1 << 20)
+	context := newTestContext(t, "store", &ContextConfig{Format: FormatHLS, SegmentStore: store}, info)
+	context.path = "testdata/test.mp3"
+	stream := context.Stream(Origin.Name)
+
+	segment := filepath.Join(t.TempDir(), "1.ts")
+	assert.NoError(t, os.WriteFile(segment, []byte("stored segment"), 0o600))
+	stream.cacheChunk(1, segment)
+	assert.NoError(t, os.Remove(segment))
+
+	// the upload is asynchronous.
+	key, _ := stream.cacheKey(1)
+	assert.Eventually(t, func() bool {
+		_, err := store.Get(key)
+
+		return err == nil
+	}, time.Second, time.Millisecond*10)
+
+	r, err := stream.Chunk(1, 1)
+	assert.NoError(t, err)
+	content, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "stored segment", string(content))
+	assert.Nil(t, stream.cmd)
+}
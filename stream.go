@@ -6,44 +6,88 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/shirou/gopsutil/v4/process"
 )
 
 type Stream struct {
-	spec    StreamSpec
-	context *Context
-	format  string
-	probe   *ProbeInfo
-	bitrate int
-	width   int
-	height  int
-
-	m      sync.Mutex
-	chunks map[int]*tsChunk
-	goal   int
-	cmd    *exec.Cmd
-	logger Logger
+	spec     StreamSpec
+	audio    *AudioTrack    // not nil if the stream is an audio only rendition
+	subtitle *SubtitleTrack // not nil if the stream is a subtitle rendition
+	vtt      *vttDocument   // guarded by vm
+	vm       sync.Mutex
+	context  *Context
+	format   string
+	probe    *ProbeInfo
+	bitrate  int
+	width    int
+	height   int
+
+	m         sync.Mutex
+	chunks    map[int]*tsChunk
+	sizes     map[int]int64 // the sizes of the produced segments, used to measure the bandwidth
+	initReady chan bool     // closed when the init segment of the running process is written, fmp4 only
+	goal      int
+	cmd       *exec.Cmd
+	slot      *slot // the budget held by cmd
+	suspended bool  // the running process is suspended by chunkReady
+	failures  int   // the consecutive crashes of ffmpeg
+	// softwareOnly is set once the hardware encoder keeps crashing.
+	softwareOnly atomic.Bool
+	started      sync.Once
+	logger       Logger
 }
 
 func newStream(spec StreamSpec, context *Context, info *ProbeInfo, logger Logger) *Stream {
-	return &Stream{
+	stream := &Stream{
 		logger:  logger,
 		spec:    spec,
 		probe:   info,
 		context: context,
 		format:  context.contextConfig.Format,
 		chunks:  map[int]*tsChunk{},
+		sizes:   map[int]int64{},
+		bitrate: info.VideoBitrate,
+		width:   spec.Width,
+		height:  spec.Height,
+	}
+	if stream.width == 0 || stream.height == 0 {
+		stream.width, stream.height = info.Width, info.Height
 	}
+
+	return stream
+}
+
+// newAudioStream creates the audio only rendition of the track, the track key is used as the spec name.
+func newAudioStream(track *AudioTrack, context *Context, info *ProbeInfo, logger Logger) *Stream {
+	stream := newStream(StreamSpec{Name: track.Key}, context, info, logger)
+	stream.audio = track
+
+	return stream
+}
+
+// AudioTrack returns the track of the audio rendition, or nil if the stream has video.
+func (s *Stream) AudioTrack() *AudioTrack {
+	return s.audio
+}
+
+// dir is where the segments of the stream are written.
+func (s *Stream) dir() string {
+	return filepath.Join(s.context.contextConfig.TmpPath, s.spec.Name)
 }
 
 func (s *Stream) Content() (io.ReadCloser, error) {
+	s.start()
+
 	switch s.format {
 	case FormatMP4:
 		return s.content()
@@ -54,56 +98,247 @@ func (s *Stream) Content() (io.ReadCloser, error) {
 	return nil, ErrInvalidFormat
 }
 
+// start emits EventStreamStarted on the first request of the stream.
+func (s *Stream) start() {
+	s.started.Do(func() {
+		s.emit(Event{Type: EventStreamStarted})
+	})
+}
+
+// Chunk returns the chunk of the stream.
+// For FormatHLS and FormatDASH, start is the index of the segment and end is ignored.
+// For FormatMP4, it's the byte range of the source, only supported when the source is passed through.
 func (s *Stream) Chunk(start, end int) (io.ReadCloser, error) {
 	s.context.access()
+	s.start()
 
 	switch s.format {
 	case FormatMP4:
+		return s.rangeChunk(start, end)
 	case FormatHLS:
+		if s.subtitle != nil {
+			return s.subtitleChunk(start)
+		}
+		r, err := s.serveChunk(start)
+
+		return s.encrypt(start, r, err)
+	case FormatDASH:
 		return s.serveChunk(start)
 	}
 
 	return nil, ErrInvalidFormat
 }
 
+// ChunkMimeType returns the mime type of the chunks returned by Chunk.
+func (s *Stream) ChunkMimeType() string {
+	switch {
+	case s.subtitle != nil:
+		return "text/vtt"
+	case s.format == FormatMP4, s.segmentContainer() == ContainerFMP4:
+		return MimeType(FormatMP4)
+	}
+
+	return MimeType(FormatTS)
+}
+
+// segmentContainer returns the container of the segments, it's empty for subtitles.
+func (s *Stream) segmentContainer() string {
+	if s.subtitle != nil {
+		return ""
+	}
+	if s.format == FormatDASH {
+		return ContainerFMP4
+	}
+	// mpegts can't carry them.
+	if s.audio == nil && (s.spec.Codec == CodecAV1 || s.spec.Codec == CodecVP9) {
+		return ContainerFMP4
+	}
+
+	return s.context.contextConfig.SegmentContainer
+}
+
+// Init returns the init segment of the stream, only available with ContainerFMP4 or FormatDASH.
+// The init segment is written with the first segment, if no process is running, we start from the first chunk.
+func (s *Stream) Init() (io.ReadCloser, error) {
+	if !segmented(s.format) || s.segmentContainer() != ContainerFMP4 {
+		return nil, ErrInvalidFormat
+	}
+	s.context.access()
+
+	s.m.Lock()
+	ready := s.initReady
+	s.m.Unlock()
+
+	if ready == nil {
+		if r, ok := s.cachedChunk(-1); ok {
+			return r, nil
+		}
+
+		chunk, err := s.serveChunk(0)
+		if err != nil {
+			return nil, err
+		}
+		_ = chunk.Close()
+
+		s.m.Lock()
+		ready = s.initReady
+		s.m.Unlock()
+	}
+	<-ready
+
+	return os.Open(filepath.Join(s.dir(), initSegmentFile))
+}
+
 func (s *Stream) ChunkLength() int {
 	return len(s.generateChunks())
 }
 
-// Seek to the timestamp, expected used for HTTP range request
-// TODO NOT IMPLEMENTED YET
-//func (s *Stream) Seek(timestamp int64) (io.ReadCloser, error) {
-//	return nil, nil
-//}
+var (
+	ErrRangeNotSupported = errors.New("byte range is only supported when the source is passed through")
+	ErrInvalidSeek       = errors.New("seek position is out of range")
+)
+
+// Seek returns a new fragmented mp4 content starting at the time offset,
+// ffmpeg starts at the keyframe before the offset. It's only supported by FormatMP4.
+// The timestamps are kept as in the source, so players show the right position.
+func (s *Stream) Seek(at time.Duration) (io.ReadCloser, error) {
+	if s.format != FormatMP4 {
+		return nil, ErrInvalidFormat
+	}
+	if at < 0 || at.Seconds() >= s.probe.Duration {
+		return nil, ErrInvalidSeek
+	}
+	s.context.access()
+	s.start()
+
+	return s.startContent(at.Seconds())
+}
+
+// Passthrough returns true if the source is served as it is, which supports byte range requests.
+func (s *Stream) Passthrough() bool {
+	return s.format == FormatMP4 && !s.needTranscode() && containsFormat(s.probe.Format, s.format)
+}
+
+// source opens the source file for passthrough, the modify time is used by http.ServeContent.
+// The remote source is proxied by range requests.
+func (s *Stream) source() (io.ReadSeekCloser, time.Time, error) {
+	file, modTime, err := s.context.contextConfig.openSource(s.context.path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return &activeSource{ReadSeekCloser: file, release: s.context.acquire()}, modTime, nil
+}
+
+// rangeChunk returns the bytes from start to end of the source, end is inclusive and end < 0 means to the end.
+func (s *Stream) rangeChunk(start, end int) (io.ReadCloser, error) {
+	if !s.Passthrough() {
+		return nil, ErrRangeNotSupported
+	}
+
+	file, _, err := s.source()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = file.Seek(int64(start), io.SeekStart); err != nil {
+		_ = file.Close()
+
+		return nil, err
+	}
+
+	if end < 0 {
+		return file, nil
+	}
+
+	return readCloser{Reader: io.LimitReader(file, int64(end-start+1)), Closer: file}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// containsFormat checks the format name of ffprobe, which could be a list like "mov,mp4,m4a,3gp,3g2,mj2".
+func containsFormat(formatName, format string) bool {
+	for _, name := range strings.Split(formatName, ",") {
+		if name == format {
+			return true
+		}
+	}
+
+	return false
+}
 
 // content return the FormatMP4 or FormatFLV content
 func (s *Stream) content() (io.ReadCloser, error) {
-	format := s.context.contextConfig.Format
-	if !s.needTranscode() && s.probe.Format == format {
-		file, err := os.Open(s.context.path)
+	if s.Passthrough() {
+		file, _, err := s.source()
 
 		return file, err
 	}
 
-	args := s.buildFFMpegArgs(0, s.needTranscode(), format, true)
+	return s.startContent(0)
+}
+
+// startContent starts ffmpeg at the seconds to write the content to stdout, the process is killed when the content is closed.
+func (s *Stream) startContent(at float64) (io.ReadCloser, error) {
+	slot, err := s.admit()
+	if err != nil {
+		return nil, err
+	}
+
+	format := s.context.contextConfig.Format
+	args := s.buildSeekArgs(at, 0, s.needTranscode(), format, true)
 	contentCMD := exec.Command(s.context.contextConfig.FFMpegPath, args...)
 	s.logger.Debugf("content command: %v", contentCMD.String())
 	stdOut, err := contentCMD.StdoutPipe()
 	if err != nil {
+		slot.release()
+
 		return nil, err
 	}
 	stdErr, err := contentCMD.StderrPipe()
 	if err != nil {
+		slot.release()
+
 		return nil, err
 	}
 
 	go s.debugFFMpeg(stdErr)
 	err = contentCMD.Start()
 	if err != nil {
+		slot.release()
+		s.emit(Event{Type: EventTranscodeError, Err: err})
+
 		return nil, err
 	}
+	s.emit(Event{Type: EventProcessStarted, PID: contentCMD.Process.Pid})
+	s.context.metrics.processStarted(s.needTranscode(), s.encoderHWInfo().name)
+	s.context.metrics.contentStarted()
 
-	return stdOut, nil
+	return &processReader{ReadCloser: stdOut, cmd: contentCMD, release: s.context.acquire(), slot: slot, stream: s}, nil
+}
+
+// processReader kills and waits the process when closed, so it does not become a zombie.
+type processReader struct {
+	io.ReadCloser
+	cmd     *exec.Cmd
+	release func()
+	slot    *slot
+	stream  *Stream
+}
+
+func (p *processReader) Close() error {
+	err := p.ReadCloser.Close()
+	_ = p.cmd.Process.Kill()
+	_ = p.cmd.Wait()
+	p.release()
+	p.slot.release()
+	p.stream.emit(Event{Type: EventProcessExited, PID: p.cmd.Process.Pid})
+	p.stream.context.metrics.contentExited()
+
+	return err
 }
 
 func (s *Stream) supportVideoCodec(codec string) bool {
@@ -129,11 +364,23 @@ func (s *Stream) supportAudioCodec(codec string) bool {
 func (s *Stream) contentHLS() (io.ReadCloser, error) {
 	buf := &bytes.Buffer{}
 	buf.WriteString("#EXTM3U\n")
-	buf.WriteString("#EXT-X-VERSION:4\n")
+	if s.segmentContainer() == ContainerFMP4 {
+		// EXT-X-MAP in media playlist requires version 6
+		buf.WriteString("#EXT-X-VERSION:7\n")
+	} else {
+		buf.WriteString("#EXT-X-VERSION:4\n")
+	}
 	buf.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
 	buf.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
-	// chunk max duration, this is a config value.
-	buf.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", s.context.contextConfig.ChunkDuration))
+	// the keyframe aligned chunks could be longer than the config value.
+	buf.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", s.targetDuration()))
+	if s.segmentContainer() == ContainerFMP4 {
+		buf.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n", s.context.contextConfig.InitGenerator(s, s.context)))
+	}
+	// after EXT-X-MAP, so the init segment is not encrypted.
+	if s.context.key != nil && s.subtitle == nil {
+		buf.WriteString(s.context.keyLine())
+	}
 
 	for i, c := range s.generateChunks() {
 		buf.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", c.duration))
@@ -145,34 +392,50 @@ func (s *Stream) contentHLS() (io.ReadCloser, error) {
 	return io.NopCloser(buf), nil
 }
 
-func (s *Stream) generateChunks() []tsChunk {
-	duration := s.probe.Duration
-	chunks := make([]tsChunk, 0)
-	id := 0
-
-	for duration > 0 {
-		size := float64(s.context.contextConfig.ChunkDuration)
-		if duration < size {
-			size = duration
+// targetDuration returns the max chunk duration rounded up.
+func (s *Stream) targetDuration() int {
+	target := s.context.contextConfig.ChunkDuration
+	for _, c := range s.generateChunks() {
+		if d := int(math.Ceil(c.duration)); d > target {
+			target = d
 		}
-
-		chunks = append(chunks, tsChunk{id: id, duration: size})
-		id++
-		duration -= size
 	}
 
-	return chunks
+	return target
+}
+
+func (s *Stream) generateChunks() []tsChunk {
+	return s.context.chunks
 }
 
 func (s *Stream) serveChunk(index int) (io.ReadCloser, error) {
+	// the cached segment doesn't need ffmpeg at all.
+	if r, ok := s.cachedChunk(index); ok {
+		s.context.metrics.segmentServed(sourceCache)
+
+		return r, nil
+	}
+
+	r, err := s.transcodeChunk(index)
+	if err == nil {
+		s.context.metrics.segmentServed(sourceFFMpeg)
+	}
+
+	return r, err
+}
+
+// transcodeChunk returns the chunk produced by ffmpeg, the process is restarted if the chunk is far away.
+func (s *Stream) transcodeChunk(index int) (io.ReadCloser, error) {
 	s.checkGoal(index)
 	s.m.Lock()
 	c, ok := s.chunks[index]
 	s.m.Unlock()
 	if ok {
-		<-c.done
+		if err := s.wait(c); err != nil {
+			return nil, err
+		}
 
-		return c, nil
+		return c.reader(), nil
 	}
 	// almost there, 3 should be configurable
 	for i := index - 3; i < index; i++ {
@@ -195,14 +458,43 @@ func (s *Stream) waitForChunk(index int) (io.ReadCloser, error) {
 		s.chunks[index] = chunk
 	}
 	s.m.Unlock()
+	if err := s.wait(chunk); err != nil {
+		return nil, err
+	}
+
+	return chunk.reader(), nil
+}
+
+// wait waits for the chunk to be written, the time is observed by the metrics.
+// It returns the error if the chunk failed, that is ffmpeg can't produce it.
+func (s *Stream) wait(chunk *tsChunk) error {
+	start := time.Now()
 	<-chunk.done
+	s.context.metrics.observeWait(time.Since(start))
 
-	return chunk, nil
+	return chunk.err
 }
 
 func (s *Stream) restartAtChunk(index int) (io.ReadCloser, error) {
 	s.stopProcess()
-	s.goal = index + s.context.contextConfig.MaxBuffer
+	s.goal = index + s.maxBuffer()
+
+	if err := s.startProcess(index); err != nil {
+		s.failPending(err)
+
+		return nil, err
+	}
+
+	return s.waitForChunk(index)
+}
+
+// startProcess starts ffmpeg at the chunk, the chunks already requested are kept for their waiters.
+// It waits in the queue if the service is out of the ffmpeg budget.
+func (s *Stream) startProcess(index int) error {
+	slot, err := s.admit()
+	if err != nil {
+		return err
+	}
 
 	args := s.buildFFMpegArgs(index, s.needTranscode(), s.context.contextConfig.Format, false)
 
@@ -211,34 +503,65 @@ func (s *Stream) restartAtChunk(index int) (io.ReadCloser, error) {
 	// Capture standard error
 	stderr, err := restartCMD.StderrPipe()
 	if err != nil {
-		return nil, err
+		slot.release()
+
+		return err
 	}
 	stdout, err := restartCMD.StdoutPipe()
 	if err != nil {
-		return nil, err
+		slot.release()
+
+		return err
 	}
 
 	s.m.Lock()
-	c := &tsChunk{id: index, done: make(chan bool)}
-	s.chunks[index] = c
+	if _, ok := s.chunks[index]; !ok {
+		s.chunks[index] = &tsChunk{id: index, done: make(chan bool)}
+	}
+	// the waiters of the init segment are kept if the previous process crashed before writing it.
+	if s.initReady == nil || isClosed(s.initReady) {
+		s.initReady = make(chan bool)
+	}
 	s.m.Unlock()
 
 	if err = restartCMD.Start(); err != nil {
-		return nil, err
+		slot.release()
+		s.emit(Event{Type: EventTranscodeError, Segment: index, Err: err})
+
+		return err
 	}
+	s.emit(Event{Type: EventProcessStarted, Segment: index, PID: restartCMD.Process.Pid})
+	s.context.metrics.restarted()
+	s.context.metrics.processStarted(s.needTranscode(), s.encoderHWInfo().name)
 
-	go s.monitorChunk(stdout, stderr)
-	go s.monitorProcess(restartCMD)
+	// set before monitoring, so monitorProcess knows the exit is not caused by stopProcess.
+	s.m.Lock()
 	s.cmd = restartCMD
+	s.slot = slot
+	s.suspended = false
+	s.m.Unlock()
 
-	return s.waitForChunk(index)
+	go s.superviseProcess(restartCMD, stdout, stderr)
+
+	return nil
 }
 
 func (s *Stream) needTranscode() bool {
-	if s.spec.Force {
+	if s.audio != nil {
+		return !s.supportAudioCodec(s.audio.Codec)
+	}
+	if s.spec.Force || s.deinterlace() {
 		return true
 	}
-	if !s.supportVideoCodec(s.probe.VideoCodec) || !s.supportAudioCodec(s.probe.AudioCodec) {
+	if s.spec.Codec != "" {
+		if s.spec.Codec != s.probe.VideoCodec {
+			return true
+		}
+	} else if !s.supportVideoCodec(s.probe.VideoCodec) {
+		return true
+	}
+	// audio is served by the audio renditions
+	if len(s.context.audios) == 0 && !s.supportAudioCodec(s.probe.AudioCodec) {
 		return true
 	}
 	if s.spec.Width > 0 && s.spec.Width != s.probe.Width {
@@ -282,8 +605,16 @@ func (s *Stream) resolveChunkID(line []byte) (int, string, error) {
 	return -1, "", ErrNoChunkID
 }
 
-func (s *Stream) monitorChunk(_ io.ReadCloser, stderr io.ReadCloser) {
+// monitorChunk marks the chunks ready by the ffmpeg output, it returns the last lines of the output once it ends.
+func (s *Stream) monitorChunk(_ io.ReadCloser, stderr io.ReadCloser) []string {
 	out := bufio.NewReader(stderr)
+	tail := make([]string, 0, stderrTail)
+	initCached := false
+
+	ext := []byte(".ts")
+	if s.segmentContainer() == ContainerFMP4 {
+		ext = []byte(".m4s")
+	}
 
 	for {
 		line, err := out.ReadBytes('\n')
@@ -295,11 +626,16 @@ func (s *Stream) monitorChunk(_ io.ReadCloser, stderr io.ReadCloser) {
 			break
 		}
 
-		if !bytes.Contains(line, []byte(".ts")) || !bytes.Contains(line, []byte("ended")) {
+		if len(tail) == stderrTail {
+			tail = tail[1:]
+		}
+		tail = append(tail, string(bytes.TrimSpace(line)))
+
+		if !bytes.Contains(line, ext) || !bytes.Contains(line, []byte("ended")) {
 			continue
 		}
 		// ffmpeg-error: [segment @ 0x15b004080] segment:'0.ts' count:0 ended
-		// ffmpeg-error: [segment @ 0x146e05e50] segment:'/tmp/0.ts' count:0 ended
+		// ffmpeg-error: [segment @ 0x146e05e50] segment:'/tmp/0.m4s' count:0 ended
 		id, segment, err := s.resolveChunkID(line)
 		if err != nil {
 			s.logger.Errorf("failed to resolve chunk id: %v", err)
@@ -307,42 +643,72 @@ func (s *Stream) monitorChunk(_ io.ReadCloser, stderr io.ReadCloser) {
 			continue
 		}
 
-		s.m.Lock()
-		chunk, ok := s.chunks[id]
+		s.chunkReady(id, segment)
+		s.cacheChunk(id, segment)
 
-		if ok {
-			chunk.path = segment
-			s.logger.Infof("chunk %d is ready with file:%s", id, segment)
-			close(chunk.done)
-		} else {
-			chunk = &tsChunk{id: id, path: segment, done: make(chan bool)}
-			s.chunks[id] = chunk
-			close(chunk.done)
+		if s.segmentContainer() == ContainerFMP4 && !initCached {
+			s.cacheChunk(-1, filepath.Join(s.dir(), initSegmentFile))
+			initCached = true
 		}
-		if id >= s.goal {
-			err = suspendProcess(s.cmd.Process.Pid)
-			// pause the process
-			if err != nil {
-				s.logger.Error(err)
-			}
+	}
+
+	return tail
+}
+
+func (s *Stream) chunkReady(id int, segment string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	// the progress resets the crash count of the supervisor.
+	s.failures = 0
+
+	chunk, ok := s.chunks[id]
+
+	switch {
+	case ok && chunk.finished():
+		// the restarted process may write the chunk again.
+		chunk.path = segment
+	case ok:
+		chunk.path = segment
+		s.logger.Infof("chunk %d is ready with file:%s", id, segment)
+		close(chunk.done)
+	default:
+		chunk = &tsChunk{id: id, path: segment, done: make(chan bool)}
+		s.chunks[id] = chunk
+		close(chunk.done)
+	}
+
+	if info, err := os.Stat(segment); err == nil {
+		s.sizes[id] = info.Size()
+	}
+	s.emit(Event{Type: EventSegmentReady, Segment: id})
+	s.context.metrics.segmentProduced()
+
+	// the init segment is written before the first segment ends.
+	if s.initReady != nil {
+		select {
+		case <-s.initReady:
+		default:
+			close(s.initReady)
 		}
+	}
 
-		for id := range s.chunks {
-			if id < s.goal-s.context.contextConfig.MaxBuffer {
-				co := s.chunks[id]
-				co.destroy()
-				delete(s.chunks, id)
-			}
+	if id >= s.goal && s.cmd != nil {
+		// pause the process
+		if err := suspendProcess(s.cmd.Process.Pid); err != nil {
+			s.logger.Error(err)
+		} else if !s.suspended {
+			s.suspended = true
+			s.emit(Event{Type: EventProcessSuspended, Segment: id, PID: s.cmd.Process.Pid})
 		}
-		s.m.Unlock()
 	}
-}
 
-// monitor unexpected exit
-func (s *Stream) monitorProcess(cmd *exec.Cmd) {
-	err := cmd.Wait()
-	if err != nil {
-		s.logger.Error(err)
+	for id := range s.chunks {
+		if id < s.goal-s.context.contextConfig.MaxBuffer {
+			co := s.chunks[id]
+			co.destroy()
+			delete(s.chunks, id)
+		}
 	}
 }
 
@@ -350,17 +716,24 @@ func (s *Stream) stopProcess() {
 	s.m.Lock()
 	chunks := s.chunks
 	s.chunks = map[int]*tsChunk{}
+	cmd := s.cmd
+	s.cmd = nil
+	slot := s.slot
+	s.slot = nil
+	s.suspended = false
 	s.m.Unlock()
 
+	slot.release()
+
 	for _, c := range chunks {
+		if !c.finished() {
+			c.fail(ErrProcessStopped)
+		}
 		c.destroy()
 	}
-	if s.cmd != nil {
-		// TODO it may already exit, but we kill it anyway
-		_ = s.cmd.Process.Kill()
-		// TODO data race
-		//_ = s.cmd.Wait()
-		s.cmd = nil
+	if cmd != nil {
+		// it may already exit, but we kill it anyway, monitorProcess waits it.
+		_ = cmd.Process.Kill()
 	}
 }
 
@@ -373,13 +746,20 @@ func (s *Stream) Close() error {
 func (s *Stream) checkGoal(index int) {
 	goal := index + s.context.contextConfig.MinBuffer
 	if goal > s.goal {
-		s.goal = index + s.context.contextConfig.MaxBuffer
+		s.goal = index + s.maxBuffer()
 	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
 	if s.cmd != nil {
-		// TODO if there is an error, we should restart the process
+		// if the process is gone, monitorProcess restarts it.
 		err := resumeProcess(s.cmd.Process.Pid)
 		if err != nil {
 			s.logger.Error("failed to resume ffmpeg process", err)
+		} else if s.suspended {
+			s.suspended = false
+			s.emit(Event{Type: EventProcessResumed, PID: s.cmd.Process.Pid})
 		}
 	}
 }
@@ -420,6 +800,13 @@ func DefaultTSGenerator(index int, stream *Stream, context *Context) string {
 	return fmt.Sprintf("/video/ts?id=%s&index=%d&spec=%s\n", context.ID(), index, stream.spec.Name)
 }
 
+// InitGenerator generates the uri of the init segment, used by the EXT-X-MAP tag.
+type InitGenerator func(stream *Stream, context *Context) string
+
+func DefaultInitGenerator(stream *Stream, context *Context) string {
+	return fmt.Sprintf("/video/init?id=%s&spec=%s", context.ID(), stream.spec.Name)
+}
+
 func formatTime(seconds int) string {
 	h := seconds / 3600
 	m := (seconds % 3600) / 60
@@ -427,3 +814,87 @@ func formatTime(seconds int) string {
 
 	return fmt.Sprintf("%02d:%02d:%02d.000", h, m, s)
 }
+
+const (
+	defaultAudioBitrate = 128000 // the default of the ffmpeg aac encoder
+	// the estimated peak of the variable bitrate, apple suggests the peak is no more than 200% of the average.
+	peakFactor = 1.5
+)
+
+// Bandwidth returns the peak and the average bandwidth of the stream in bits per second, the muxed audio is included.
+// Once segments are produced, they are measured by the sizes, otherwise it's estimated by the target bitrate
+// or the probed bitrate.
+func (s *Stream) Bandwidth() (int, int) {
+	if peak, average, ok := s.measuredBandwidth(); ok {
+		return peak, average
+	}
+
+	if s.audio != nil {
+		bitrate := s.audioBitrate()
+
+		return bitrate, bitrate
+	}
+
+	video := s.probe.VideoBitrate
+	if s.needTranscode() && s.spec.Bitrate > 0 {
+		video = s.spec.Bitrate
+	}
+
+	average := video
+	if average == 0 {
+		// the bitrate of the format includes the audio.
+		average = s.probe.Bitrate
+	} else if len(s.context.audios) == 0 && s.probe.AudioCodec != "" {
+		average += s.audioBitrate()
+	}
+
+	peak := average
+	if s.needTranscode() {
+		peak = int(float64(average) * peakFactor)
+	}
+
+	return peak, average
+}
+
+func (s *Stream) measuredBandwidth() (int, int, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var (
+		peak     float64
+		bytes    int64
+		duration float64
+	)
+
+	for id, size := range s.sizes {
+		if id < 0 || id >= len(s.context.chunks) || s.context.chunks[id].duration <= 0 {
+			continue
+		}
+
+		d := s.context.chunks[id].duration
+		peak = math.Max(peak, float64(size)*8/d)
+		bytes += size
+		duration += d
+	}
+
+	if duration == 0 {
+		return 0, 0, false
+	}
+
+	return int(peak), int(float64(bytes) * 8 / duration), true
+}
+
+// audioBitrate returns the bitrate of the audio in the output.
+func (s *Stream) audioBitrate() int {
+	track := s.audio
+	if track == nil {
+		track = s.probe.DefaultAudioTrack()
+	}
+
+	// the muxed audio is copied only if the stream is not transcoded.
+	if track != nil && track.Bitrate > 0 && !s.needTranscode() {
+		return track.Bitrate
+	}
+
+	return defaultAudioBitrate
+}
@@ -1,9 +1,14 @@
 package vod
 
 import (
+	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -35,3 +40,81 @@ func TestResumeProcessReturnsErrorWhenProcessNotFound(t *testing.T) {
 	err := resumeProcess(-1)
 	assert.Error(t, err)
 }
+
+func TestResolveChunkIDReturnsM4SIndex(t *testing.T) {
+	stream := &Stream{}
+	id, segment, err := stream.resolveChunkID([]byte("[segment @ 0x55f0c2a3c040] segment:'/tmp/Origin/12.m4s' count:12 ended\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 12, id)
+	assert.Equal(t, "/tmp/Origin/12.m4s", segment)
+}
+
+func TestMonitorChunkDetectsFMP4Segments(t *testing.T) {
+	config := &ContextConfig{SegmentContainer: ContainerFMP4}
+	context := newTestContext(t, "fmp4", config, &ProbeInfo{Duration: 20, VideoCodec: "h264", AudioCodec: "aac"})
+	stream := context.Stream("Origin")
+	stream.goal = 10
+	stream.initReady = make(chan bool)
+
+	log := strings.Join([]string{
+		"[segment @ 0x1] Opening '/tmp/Origin/init.mp4' for writing",
+		"[segment @ 0x1] Opening '/tmp/Origin/4.m4s' for writing",
+		"[segment @ 0x1] segment:'/tmp/Origin/4.ts' count:0 ended",
+		"[segment @ 0x1] segment:'/tmp/Origin/4.m4s' count:0 ended",
+		"[segment @ 0x1] Opening '/tmp/Origin/5.m4s' for writing",
+		"",
+	}, "\n")
+	stream.monitorChunk(nil, io.NopCloser(strings.NewReader(log)))
+
+	assert.Len(t, stream.chunks, 1)
+	assert.Equal(t, "/tmp/Origin/4.m4s", stream.chunks[4].path)
+	assert.Equal(t, "video/mp4", stream.ChunkMimeType())
+	select {
+	case <-stream.initReady:
+	default:
+		t.Error("expected init segment to be ready")
+	}
+}
+
+func TestContentHLSWritesInitSegmentMap(t *testing.T) {
+	config := &ContextConfig{SegmentContainer: ContainerFMP4}
+	context := newTestContext(t, "fmp4", config, &ProbeInfo{Duration: 20, VideoCodec: "h264", AudioCodec: "aac"})
+	r, err := context.Content()
+	content := readAll(t, r, err)
+	assert.Contains(t, content, "#EXT-X-VERSION:7\n")
+	assert.Contains(t, content, "#EXT-X-MAP:URI=\"/video/init?id=fmp4&spec=Origin\"\n")
+
+	args := context.Stream("Origin").buildFFMpegArgs(2, false, FormatHLS, false)
+	assert.Subset(t, args, []string{"-segment_format", "mp4", "-segment_start_number", "2"})
+	assert.Contains(t, args, filepath.Join(context.Stream("Origin").dir(), initSegmentFile))
+	assert.NotContains(t, args, "mpegts")
+}
+
+func TestRangeChunkReturnsBytesOfPassthroughSource(t *testing.T) {
+	info := &ProbeInfo{Duration: 20, Format: "mov,mp4,m4a,3gp,3g2,mj2", VideoCodec: "h264", AudioCodec: "aac"}
+	context := newTestContext(t, "mp4", &ContextConfig{Format: FormatMP4}, info)
+	context.path = "testdata/test.mp3"
+	stream := context.Stream("Origin")
+	assert.True(t, stream.Passthrough())
+
+	source, err := os.ReadFile(context.path)
+	assert.NoError(t, err)
+
+	r, err := stream.Chunk(2, 5)
+	assert.Equal(t, string(source[2:6]), readAll(t, r, err))
+
+	info.Format = "flv"
+	assert.False(t, stream.Passthrough())
+	_, err = stream.Chunk(0, 10)
+	assert.ErrorIs(t, err, ErrRangeNotSupported)
+}
+
+func TestSeekKeepsFractionalOffset(t *testing.T) {
+	ffmpeg, runs := newFakeFFMpeg(t, "echo content")
+	info := &ProbeInfo{Duration: 20, Format: "flv", VideoCodec: "h264", AudioCodec: "aac"}
+	context := newTestContext(t, "seek", &ContextConfig{Format: FormatMP4, FFMpegPath: ffmpeg, HWAccel: HWAccelNone}, info)
+
+	r, err := context.Stream("Origin").Seek(1500 * time.Millisecond)
+	assert.Equal(t, "content\n", readAll(t, r, err))
+	assert.Contains(t, countRuns(t, runs)[0], "-ss 1.500000 ")
+}
@@ -0,0 +1,285 @@
+package vod
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	subtitleFile    = "subtitle.vtt"
+	subtitleGroupID = "subtitles"
+	// The segments keep the source timestamps(-copyts), so the local time maps to the same mpegts time.
+	subtitleTimestampMap = "X-TIMESTAMP-MAP=MPEGTS:0,LOCAL:00:00:00.000"
+)
+
+var ErrInvalidSubtitle = errors.New("invalid webvtt content")
+
+// newSubtitleStream creates the subtitle rendition of the track, the track key is used as the spec name.
+func newSubtitleStream(track *SubtitleTrack, context *Context, info *ProbeInfo, logger Logger) *Stream {
+	stream := newStream(StreamSpec{Name: track.Key}, context, info, logger)
+	stream.subtitle = track
+
+	return stream
+}
+
+// SubtitleTrack returns the track of the subtitle rendition, or nil if the stream is not a subtitle.
+func (s *Stream) SubtitleTrack() *SubtitleTrack {
+	return s.subtitle
+}
+
+// Subtitle returns the whole subtitle track converted to WebVTT.
+// The track is extracted by ffmpeg on the first call.
+func (c *Context) Subtitle(key string) (io.ReadCloser, error) {
+	c.access()
+
+	for _, s := range c.subtitles {
+		if s.subtitle.Key == key {
+			if err := s.extractSubtitle(); err != nil {
+				return nil, err
+			}
+
+			return os.Open(filepath.Join(s.dir(), subtitleFile))
+		}
+	}
+
+	return nil, ErrStreamNotFound
+}
+
+// SubtitleStreams returns the subtitle renditions.
+func (c *Context) SubtitleStreams() []*Stream {
+	return c.subtitles
+}
+
+// vttCue is a cue block of the WebVTT file, the times are in seconds.
+type vttCue struct {
+	start float64
+	end   float64
+	text  string
+}
+
+// vttDocument is the parsed WebVTT file, header keeps the STYLE and REGION blocks.
+type vttDocument struct {
+	header []string
+	cues   []vttCue
+}
+
+// extractSubtitle converts the track to WebVTT and keeps the parsed cues for the segments.
+// It's guarded by s.vm rather than s.m, as ffmpeg reads the whole file.
+func (s *Stream) extractSubtitle() error {
+	s.vm.Lock()
+	defer s.vm.Unlock()
+
+	if s.vtt != nil {
+		return nil
+	}
+
+	output := filepath.Join(s.dir(), subtitleFile)
+	if err := os.MkdirAll(s.dir(), os.ModePerm); err != nil {
+		return err
+	}
+
+	// the subtitle rendered by a job doesn't need ffmpeg.
+	if !s.copyRendered(output) {
+		slot, err := s.admit()
+		if err != nil {
+			return err
+		}
+		defer slot.release()
+
+		args := []string{"-loglevel", "error"}
+		args = append(args, s.context.contextConfig.inputArgs(s.context.path)...)
+		args = append(args,
+			"-i", s.context.path,
+			"-y",
+			"-map", "0:"+strconv.Itoa(s.subtitle.Index),
+			"-c:s", "webvtt",
+			"-f", "webvtt",
+			output,
+		)
+		cmd := exec.Command(s.context.contextConfig.FFMpegPath, args...)
+		s.logger.Debugf("subtitle command: %v", cmd.String())
+
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("extract subtitle %s: %w: %s", s.subtitle.Key, err, bytes.TrimSpace(out))
+		}
+	}
+
+	content, err := os.ReadFile(output)
+	if err != nil {
+		return err
+	}
+
+	s.vtt, err = parseVTT(content)
+
+	return err
+}
+
+// subtitleChunk returns the WebVTT segment with the cues overlap the chunk.
+func (s *Stream) subtitleChunk(index int) (io.ReadCloser, error) {
+	if err := s.extractSubtitle(); err != nil {
+		return nil, err
+	}
+
+	chunks := s.generateChunks()
+	if index < 0 || index >= len(chunks) {
+		return nil, ErrInvalidIndex
+	}
+
+	start := chunks[index].start
+	end := start + chunks[index].duration
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("WEBVTT\n")
+	buf.WriteString(subtitleTimestampMap + "\n\n")
+
+	for _, block := range s.vtt.header {
+		buf.WriteString(block + "\n\n")
+	}
+
+	for _, cue := range s.vtt.cues {
+		if cue.end > start && cue.start < end {
+			buf.WriteString(cue.text + "\n\n")
+		}
+	}
+
+	return io.NopCloser(buf), nil
+}
+
+func parseVTT(content []byte) (*vttDocument, error) {
+	content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	if !bytes.HasPrefix(bytes.TrimPrefix(content, []byte("\xef\xbb\xbf")), []byte("WEBVTT")) {
+		return nil, ErrInvalidSubtitle
+	}
+
+	doc := &vttDocument{}
+	// the first block is the WEBVTT header.
+	blocks := strings.Split(strings.TrimSpace(string(content)), "\n\n")
+	for _, block := range blocks[1:] {
+		block = strings.Trim(block, "\n")
+		if block == "" {
+			continue
+		}
+
+		if strings.HasPrefix(block, "STYLE") || strings.HasPrefix(block, "REGION") {
+			doc.header = append(doc.header, block)
+
+			continue
+		}
+
+		cue, ok := parseVTTCue(block)
+		if !ok {
+			// NOTE block or something we don't understand.
+			continue
+		}
+
+		doc.cues = append(doc.cues, cue)
+	}
+
+	return doc, nil
+}
+
+func parseVTTCue(block string) (vttCue, bool) {
+	scanner := bufio.NewScanner(strings.NewReader(block))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		before, after, found := strings.Cut(line, "-->")
+		if !found {
+			// cue identifier
+			continue
+		}
+
+		start, err := parseVTTTime(strings.TrimSpace(before))
+		if err != nil {
+			return vttCue{}, false
+		}
+
+		// the end time may be followed by cue settings.
+		fields := strings.Fields(after)
+		if len(fields) == 0 {
+			return vttCue{}, false
+		}
+
+		end, err := parseVTTTime(fields[0])
+		if err != nil {
+			return vttCue{}, false
+		}
+
+		return vttCue{start: start, end: end, text: block}, true
+	}
+
+	return vttCue{}, false
+}
+
+// parseVTTTime parses hh:mm:ss.ttt or mm:ss.ttt to seconds.
+func parseVTTTime(value string) (float64, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, ErrInvalidSubtitle
+	}
+
+	var seconds float64
+
+	for _, part := range parts[:len(parts)-1] {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, ErrInvalidSubtitle
+		}
+
+		seconds = seconds*60 + float64(n)
+	}
+
+	last, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil {
+		return 0, ErrInvalidSubtitle
+	}
+
+	return seconds*60 + last, nil
+}
+
+// subtitleNames returns the NAME of the subtitle renditions like audioNames,
+// the colliding names are suffixed by forced, then by the key.
+func subtitleNames(streams []*Stream) []string {
+	names := make([]string, len(streams))
+	for i, s := range streams {
+		names[i] = renditionName(s.subtitle.Title, s.subtitle.Language, s.subtitle.Key)
+	}
+
+	return uniqueNames(names,
+		func(i int) string {
+			if streams[i].subtitle.Forced {
+				return "forced"
+			}
+
+			return ""
+		},
+		func(i int) string { return streams[i].subtitle.Key },
+	)
+}
+
+// subtitleMediaLine returns the EXT-X-MEDIA line of the subtitle rendition.
+func subtitleMediaLine(stream *Stream, name string) string {
+	track := stream.subtitle
+	l := fmt.Sprintf("#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"%s\",NAME=\"%s\"", subtitleGroupID, name)
+	if track.Language != "" && track.Language != "und" {
+		l = l + fmt.Sprintf(",LANGUAGE=\"%s\"", track.Language)
+	}
+	if track.Default {
+		l = l + ",DEFAULT=YES,AUTOSELECT=YES"
+	} else {
+		l = l + ",DEFAULT=NO,AUTOSELECT=YES"
+	}
+	if track.Forced {
+		l = l + ",FORCED=YES"
+	}
+
+	return l + fmt.Sprintf(",URI=\"%s\"\n", playlistURI(stream))
+}
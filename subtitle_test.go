@@ -0,0 +1,116 @@
+package vod
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testVTT = "WEBVTT\r\n\r\nSTYLE\r\n::cue { color: yellow }\r\n\r\n" +
+	"1\r\n00:01.000 --> 00:04.000\r\nfirst\r\n\r\n" +
+	"00:00:05.500 --> 00:00:07.000 align:start\r\nsecond\r\n\r\n" +
+	"NOTE this is ignored\r\n\r\n" +
+	"00:00:13.000 --> 00:00:14.000\r\nthird\r\n"
+
+func TestParseVTTParsesCuesAndHeader(t *testing.T) {
+	doc, err := parseVTT([]byte(testVTT))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"STYLE\n::cue { color: yellow }"}, doc.header)
+	assert.Equal(t, []vttCue{
+		{start: 1, end: 4, text: "1\n00:01.000 --> 00:04.000\nfirst"},
+		{start: 5.5, end: 7, text: "00:00:05.500 --> 00:00:07.000 align:start\nsecond"},
+		{start: 13, end: 14, text: "00:00:13.000 --> 00:00:14.000\nthird"},
+	}, doc.cues)
+}
+
+func TestParseVTTReturnsErrorForInvalidContent(t *testing.T) {
+	_, err := parseVTT([]byte("1\n00:01.000 --> 00:04.000\nfirst"))
+	assert.ErrorIs(t, err, ErrInvalidSubtitle)
+}
+
+func TestSubtitleChunkContainsOverlappedCues(t *testing.T) {
+	info := &ProbeInfo{
+		Duration: 20, Width: 1920, Height: 1080, VideoCodec: "h264", AudioCodec: "aac",
+		SubtitleTracks: []SubtitleTrack{{Index: 2, Codec: "subrip", Key: "subtitle-0", Language: "eng", Forced: true}},
+	}
+	context := newTestContext(t, "subtitle", nil, info)
+	stream := context.Stream("subtitle-0")
+	assert.NotNil(t, stream)
+	assert.Equal(t, "text/vtt", stream.ChunkMimeType())
+
+	var err error
+	stream.vtt, err = parseVTT([]byte(testVTT))
+	assert.NoError(t, err)
+
+	r, err := stream.Chunk(1, 1)
+	chunk := readAll(t, r, err)
+	assert.True(t, strings.HasPrefix(chunk, "WEBVTT\n"+subtitleTimestampMap+"\n\nSTYLE"))
+	assert.NotContains(t, chunk, "first")
+	assert.Contains(t, chunk, "second")
+	assert.NotContains(t, chunk, "third")
+
+	r, err = context.Content()
+	content := readAll(t, r, err)
+	assert.Contains(t, content,
+		`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subtitles",NAME="eng",LANGUAGE="eng",DEFAULT=NO,AUTOSELECT=YES,FORCED=YES,URI="index.m3u8?id=subtitle&spec=subtitle-0"`)
+	assert.Contains(t, content, `SUBTITLES="subtitles"`)
+}
+
+func TestSubtitleNamesAreUnique(t *testing.T) {
+	info := &ProbeInfo{
+		Duration: 20, Width: 1920, Height: 1080, VideoCodec: "h264", AudioCodec: "aac",
+		SubtitleTracks: []SubtitleTrack{
+			{Index: 2, Codec: "subrip", Key: "subtitle-0", Language: "eng"},
+			{Index: 3, Codec: "subrip", Key: "subtitle-1", Language: "eng", Forced: true},
+			{Index: 4, Codec: "subrip", Key: "subtitle-2", Language: "eng"},
+			{Index: 5, Codec: "subrip", Key: "subtitle-3", Language: "jpn", Title: "Signs"},
+		},
+	}
+	context := newTestContext(t, "subtitle-names", nil, info)
+
+	assert.Equal(t, []string{"eng (subtitle-0)", "eng (forced)", "eng (subtitle-2)", "Signs"}, subtitleNames(context.subtitles))
+
+	r, err := context.Content()
+	content := readAll(t, r, err)
+	assert.Contains(t, content, `NAME="eng (forced)",LANGUAGE="eng"`)
+	assert.Contains(t, content, `NAME="Signs",LANGUAGE="jpn"`)
+}
+
+func TestExtractSubtitleDoesNotHoldTheStream(t *testing.T) {
+	ffmpeg, runs := newFakeFFMpeg(t, "for last; do :; done\nsleep 0.3\nprintf 'WEBVTT\\n\\n00:01.000 --> 00:02.000\\nhi\\n' > \"$last\"")
+	info := &ProbeInfo{
+		Duration: 20, Width: 1920, Height: 1080, VideoCodec: "h264", AudioCodec: "aac",
+		SubtitleTracks: []SubtitleTrack{{Index: 2, Codec: "subrip", Key: "subtitle-0", Language: "eng"}},
+	}
+	context := newTestContext(t, "subtitle-lock", &ContextConfig{FFMpegPath: ffmpeg}, info)
+	context.admission = newAdmission(&ContextConfig{MaxTranscodes: 1})
+	stream := context.Stream("subtitle-0")
+
+	done := make(chan string)
+	go func() {
+		r, err := context.Subtitle("subtitle-0")
+		done <- readAll(t, r, err)
+	}()
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(runs)
+
+		return err == nil
+	}, time.Second, time.Millisecond*10)
+
+	// the stream is not locked by the running ffmpeg, which holds a slot of the budget.
+	assert.True(t, stream.m.TryLock())
+	stream.m.Unlock()
+	context.admission.m.Lock()
+	assert.Equal(t, classRemux.cost(), context.admission.used)
+	context.admission.m.Unlock()
+
+	assert.Contains(t, <-done, "hi")
+	assert.Len(t, countRuns(t, runs), 1)
+	context.admission.m.Lock()
+	assert.Equal(t, 0, context.admission.used)
+	context.admission.m.Unlock()
+}
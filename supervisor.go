@@ -0,0 +1,223 @@
+package vod
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+)
+
+const (
+	// maxRestarts is how many times ffmpeg is restarted after consecutive crashes, a ready segment resets it.
+	maxRestarts = 3
+	// hwFallbackAfter is how many consecutive crashes of a hardware encoder fall back to HWAccelNone.
+	hwFallbackAfter = 2
+	// stderrTail is how many lines of the ffmpeg output are kept for TranscodeError.
+	stderrTail = 5
+)
+
+// restartBackoff is doubled on every consecutive crash.
+var restartBackoff = time.Millisecond * 500
+
+var (
+	ErrTranscodeFailed = errors.New("ffmpeg exits unexpectedly")
+	ErrProcessStopped  = errors.New("ffmpeg process is stopped")
+	errMissingSegment  = errors.New("ffmpeg exits without writing the segment")
+)
+
+// TranscodeError is returned to the waiters of the segments once ffmpeg keeps crashing and the retries are exhausted.
+// It matches ErrTranscodeFailed with errors.Is.
+type TranscodeError struct {
+	Stream  string
+	Segment int // the first missing segment
+	HWAccel string
+	Err     error    // the exit error of ffmpeg
+	Stderr  []string // the last lines of the ffmpeg output
+}
+
+func (e *TranscodeError) Error() string {
+	return fmt.Sprintf("transcode segment %d of %s by %s: %v", e.Segment, e.Stream, e.HWAccel, e.Err)
+}
+
+func (e *TranscodeError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TranscodeError) Is(target error) bool {
+	return target == ErrTranscodeFailed
+}
+
+// superviseProcess monitors the segments of the process, and handles the exit once the output is drained.
+// The pipes must be read to the end before Wait.
+func (s *Stream) superviseProcess(cmd *exec.Cmd, stdout, stderr io.ReadCloser) {
+	tail := s.monitorChunk(stdout, stderr)
+	s.monitorProcess(cmd, tail)
+}
+
+// monitorProcess waits the process, the process killed by stopProcess is expected.
+// Otherwise ffmpeg is restarted from the first missing segment, or the waiters fail if it keeps crashing.
+func (s *Stream) monitorProcess(cmd *exec.Cmd, tail []string) {
+	err := cmd.Wait()
+	pid := cmd.Process.Pid
+
+	var slot *slot
+
+	s.m.Lock()
+	expected := s.cmd != cmd
+	if !expected {
+		s.cmd = nil
+		slot = s.slot
+		s.slot = nil
+		s.suspended = false
+	}
+	next := s.nextMissing()
+	s.m.Unlock()
+
+	// the process killed by stopProcess is released there.
+	slot.release()
+
+	if expected {
+		s.emit(Event{Type: EventProcessExited, PID: pid})
+
+		return
+	}
+
+	if err == nil {
+		if next < 0 {
+			// all the buffered segments are written.
+			s.emit(Event{Type: EventProcessExited, PID: pid})
+
+			return
+		}
+		err = errMissingSegment
+	}
+
+	cause := &TranscodeError{
+		Stream:  s.spec.Name,
+		Segment: next,
+		HWAccel: s.encoderHWInfo().name,
+		Err:     err,
+		Stderr:  tail,
+	}
+	s.logger.Errorf("%v, ffmpeg output: %v", cause, tail)
+	s.emit(Event{Type: EventTranscodeError, Segment: next, PID: pid, Err: cause})
+	s.emit(Event{Type: EventProcessExited, PID: pid, Err: cause})
+
+	s.recover(cause)
+}
+
+// recover restarts ffmpeg from the first missing segment after a backoff.
+// Once the retries are exhausted, only the waiters of the stream fail, the EventTranscodeError of the last crash
+// is already emitted. The context is closed only if the stream is its only video rendition, as nothing could be
+// played without it, the other renditions keep working otherwise.
+func (s *Stream) recover(cause *TranscodeError) {
+	if cause.Segment < 0 {
+		return
+	}
+
+	s.m.Lock()
+	s.failures++
+	failures := s.failures
+	if failures >= hwFallbackAfter && s.needTranscode() && s.encoderHWInfo().codec != HWAccelNone {
+		s.logger.Warnf("%s keeps failing on stream %s, fallback to software", cause.HWAccel, s.spec.Name)
+		s.softwareOnly.Store(true)
+		s.failures = 0
+	}
+	s.m.Unlock()
+
+	if failures > maxRestarts {
+		s.failPending(cause)
+		if !s.primary() {
+			s.logger.Errorf("stream %s gives up after %d restarts", s.spec.Name, maxRestarts)
+
+			return
+		}
+
+		s.logger.Errorf("stream %s gives up after %d restarts, close context %s", s.spec.Name, maxRestarts, s.context.id)
+		_ = s.context.close(CloseError, cause)
+
+		return
+	}
+
+	timer := time.NewTimer(restartBackoff << (failures - 1))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-s.context.closed:
+		return
+	}
+
+	s.m.Lock()
+	// a new request may have started the process during the backoff.
+	running := s.cmd != nil
+	next := s.nextMissing()
+	s.m.Unlock()
+
+	if running || next < 0 {
+		return
+	}
+
+	s.logger.Infof("restart ffmpeg of stream %s at segment %d, attempt %d", s.spec.Name, next, failures)
+
+	if err := s.startProcess(next); err != nil {
+		s.failPending(&TranscodeError{Stream: s.spec.Name, Segment: next, HWAccel: cause.HWAccel, Err: err})
+	}
+}
+
+// primary returns true if the stream is the only video rendition of the context.
+func (s *Stream) primary() bool {
+	return s.audio == nil && s.subtitle == nil && len(s.context.streams) == 1
+}
+
+// nextMissing returns the first requested segment not written yet, or the segment after the last written one
+// if the buffer is not full, or -1 if nothing is missing. It must be called with s.m locked.
+func (s *Stream) nextMissing() int {
+	pending, last := -1, -1
+
+	for id, c := range s.chunks {
+		if !c.finished() {
+			if pending < 0 || id < pending {
+				pending = id
+			}
+		} else if id > last {
+			last = id
+		}
+	}
+
+	switch {
+	case pending >= 0:
+		return pending
+	case last >= 0 && last < s.goal && last+1 < len(s.context.chunks):
+		return last + 1
+	}
+
+	return -1
+}
+
+// failPending fails the waiters of the segments not written yet.
+func (s *Stream) failPending(err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for id, c := range s.chunks {
+		if !c.finished() {
+			c.fail(err)
+			delete(s.chunks, id)
+		}
+	}
+
+	if s.initReady != nil && !isClosed(s.initReady) {
+		close(s.initReady)
+	}
+}
+
+func isClosed(ch chan bool) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,163 @@
+package vod
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeFFMpeg writes a shell script as ffmpeg, every run is appended to the returned file.
+func newFakeFFMpeg(t *testing.T, script string) (string, string) {
+	t.Helper()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ffmpeg is a shell script")
+	}
+
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	path := filepath.Join(dir, "ffmpeg")
+	content := "#!/bin/sh\necho \"$*\" >> " + runs + "\n" + script + "\n"
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0o700))
+
+	backoff := restartBackoff
+	restartBackoff = time.Millisecond * 10
+	t.Cleanup(func() { restartBackoff = backoff })
+
+	return path, runs
+}
+
+func countRuns(t *testing.T, runs string) []string {
+	t.Helper()
+
+	content, err := os.ReadFile(runs)
+	assert.Nil(t, err)
+
+	return strings.Split(strings.TrimSpace(string(content)), "\n")
+}
+
+func TestSupervisorFailsWaitersAfterRetries(t *testing.T) {
+	ffmpeg, runs := newFakeFFMpeg(t, "echo boom >&2\nexit 1")
+	info := testProbeInfo()
+	context := newTestContext(t, "crash", &ContextConfig{FFMpegPath: ffmpeg, HWAccel: HWAccelNone}, info)
+
+	_, err := context.Stream(Origin.Name).Chunk(0, 0)
+	assert.True(t, errors.Is(err, ErrTranscodeFailed))
+
+	var transcodeErr *TranscodeError
+	assert.True(t, errors.As(err, &transcodeErr))
+	assert.Equal(t, 0, transcodeErr.Segment)
+	assert.Equal(t, "none", transcodeErr.HWAccel)
+	assert.Contains(t, transcodeErr.Stderr, "boom")
+
+	assert.Len(t, countRuns(t, runs), maxRestarts+1)
+}
+
+func TestSupervisorClosesContextAfterRetries(t *testing.T) {
+	ffmpeg, _ := newFakeFFMpeg(t, "exit 1")
+	info := testProbeInfo()
+	context := newTestContext(t, "gives-up", &ContextConfig{FFMpegPath: ffmpeg, HWAccel: HWAccelNone}, info)
+	context.events = newEventBus(NewEmptyLogger())
+	events, cancel := context.events.subscribe()
+	defer cancel()
+
+	_, err := context.Stream(Origin.Name).Chunk(0, 0)
+	assert.ErrorIs(t, err, ErrTranscodeFailed)
+
+	for {
+		e := nextEvent(t, events)
+		if e.Type != EventContextClosed {
+			continue
+		}
+		assert.Equal(t, CloseError, e.Reason)
+		assert.ErrorIs(t, e.Err, ErrTranscodeFailed)
+
+		break
+	}
+	assert.ErrorIs(t, context.Close(), ErrTranscodeFailed)
+}
+
+func TestSupervisorKeepsOtherRenditionsAfterRetries(t *testing.T) {
+	ffmpeg, _ := newFakeFFMpeg(t, `case "$*" in *libx264*) exit 1;; esac
+echo "[segment @ 0x1] segment:'0.ts' count:0 ended" >&2`)
+	info := &ProbeInfo{Duration: 3, Width: 1920, Height: 1080, VideoCodec: "h264", AudioCodec: "aac"}
+	context := newTestContext(t, "one-fails", &ContextConfig{
+		FFMpegPath: ffmpeg,
+		HWAccel:    HWAccelNone,
+		StreamSpec: []StreamSpec{Origin, {Name: "force", Force: true}},
+	}, info)
+	context.events = newEventBus(NewEmptyLogger())
+	events, cancel := context.events.subscribe()
+	defer cancel()
+
+	_, err := context.Stream("force").Chunk(0, 0)
+	assert.ErrorIs(t, err, ErrTranscodeFailed)
+
+	// the crashes are reported, but the context is not closed.
+	reported := false
+	for done := false; !done; {
+		select {
+		case e := <-events:
+			assert.NotEqual(t, EventContextClosed, e.Type)
+			reported = reported || (e.Type == EventTranscodeError && e.Stream == "force")
+		case <-time.After(time.Millisecond * 200):
+			done = true
+		}
+	}
+	assert.True(t, reported)
+	assert.False(t, isClosed(context.closed))
+
+	_, err = context.Stream(Origin.Name).Chunk(0, 0)
+	assert.NoError(t, err)
+}
+
+func TestSupervisorFallsBackToSoftware(t *testing.T) {
+	ffmpeg, runs := newFakeFFMpeg(t, `case "$*" in *nvenc*) exit 1;; esac
+echo "[segment @ 0x1] segment:'0.ts' count:0 ended" >&2`)
+	info := &ProbeInfo{Duration: 3, Width: 1920, Height: 1080, VideoCodec: "h264", AudioCodec: "aac"}
+	context := newTestContext(t, "fallback", &ContextConfig{
+		FFMpegPath: ffmpeg,
+		HWAccel:    HWAccelNVENC,
+		StreamSpec: []StreamSpec{{Name: "force", Force: true}},
+	}, info)
+	stream := context.Stream("force")
+
+	chunk, err := stream.Chunk(0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, chunk.(*tsChunk).id)
+	assert.True(t, stream.softwareOnly.Load())
+	assert.Equal(t, HWAccelNone, stream.encoderHWInfo().codec)
+
+	lines := countRuns(t, runs)
+	assert.Len(t, lines, hwFallbackAfter+1)
+	assert.Contains(t, lines[0], "nvenc")
+	assert.NotContains(t, lines[hwFallbackAfter], "nvenc")
+}
+
+func TestStopProcessFailsWaiters(t *testing.T) {
+	info := testProbeInfo()
+	context := newTestContext(t, "stop", nil, info)
+	stream := context.Stream(Origin.Name)
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := stream.waitForChunk(3)
+		result <- err
+	}()
+
+	assert.Eventually(t, func() bool {
+		stream.m.Lock()
+		defer stream.m.Unlock()
+
+		return stream.chunks[3] != nil
+	}, time.Second, time.Millisecond*10)
+
+	stream.stopProcess()
+	assert.Equal(t, ErrProcessStopped, <-result)
+}
@@ -0,0 +1,252 @@
+package vod
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The formats of the thumbnails and sprite sheets.
+const (
+	ImageJPEG = "jpg"
+	ImagePNG  = "png"
+	ImageWebP = "webp"
+)
+
+const (
+	// the frame is scaled down to analyze in smart mode.
+	analyzeWidth  = 64
+	analyzeHeight = 36
+	// the frame darker than it is black, and the frame with less entropy is likely a title card or a fade.
+	minFrameLuma    = 24
+	minFrameEntropy = 4.0
+)
+
+// smartCandidates are the positions of the duration tried in smart mode, the beginning and the end are skipped,
+// which are usually logos and credits.
+var smartCandidates = []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6}
+
+// ImageMimeType returns the mime type of the image format.
+func ImageMimeType(format string) string {
+	switch format {
+	case ImagePNG:
+		return "image/png"
+	case ImageWebP:
+		return "image/webp"
+	}
+
+	return "image/jpeg"
+}
+
+// Thumbnail returns a frame of the video at the time in ThumbnailFormat, the width keeps the aspect ratio.
+// If width is 0, the frame is not scaled.
+// If at is 0, the frame is picked in smart mode, which skips the black and low entropy frames.
+// The frame is rotated as the player displays it.
+func (s *Service) Thumbnail(path string, at time.Duration, width int) (io.ReadCloser, error) {
+	info, err := s.probe(path, &s.config)
+	if err != nil {
+		return nil, err
+	}
+
+	seconds := at.Seconds()
+
+	switch {
+	case at <= 0:
+		seconds = s.smartThumbnailTime(path, info)
+	case seconds >= info.Duration:
+		return nil, ErrInvalidSeek
+	}
+
+	frame, err := s.extractFrame(path, info, seconds, imageFilter(width), imageCodecArgs(s.config.ThumbnailFormat))
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NopCloser(bytes.NewReader(frame)), nil
+}
+
+// smartThumbnailTime returns the first candidate which is neither black nor flat,
+// or the candidate with the most entropy if none qualifies.
+func (s *Service) smartThumbnailTime(path string, info *ProbeInfo) float64 {
+	best, bestEntropy := info.Duration*smartCandidates[0], -1.0
+
+	for _, candidate := range smartCandidates {
+		at := info.Duration * candidate
+
+		pixels, err := s.extractFrame(path, info, at,
+			fmt.Sprintf("scale=%d:%d,format=gray", analyzeWidth, analyzeHeight),
+			[]string{"-f", "rawvideo", "-pix_fmt", "gray"},
+		)
+		if err != nil {
+			s.logger.Warnf("failed to analyze frame at %.3f of %s: %v", at, path, err)
+
+			continue
+		}
+
+		luma, entropy := frameStats(pixels)
+		if luma >= minFrameLuma && entropy >= minFrameEntropy {
+			return at
+		}
+
+		if entropy > bestEntropy {
+			best, bestEntropy = at, entropy
+		}
+	}
+
+	return best
+}
+
+// extractFrame returns the encoded frame at the time, it tries the hardware decoder first.
+func (s *Service) extractFrame(path string, info *ProbeInfo, at float64, filter string, codecArgs []string) ([]byte, error) {
+	hwAccel, ok := allHWInfos[s.config.HWAccel]
+	if !ok {
+		hwAccel = allHWInfos[HWAccelNone]
+	}
+
+	input := s.config.inputArgs(path)
+
+	frame, err := s.runFrame(frameArgs(path, input, info, at, hwAccel, filter, codecArgs))
+	if err != nil && len(hwAccel.decoderArgs) != 0 {
+		s.logger.Warnf("failed to extract frame by %s, fallback to software: %v", hwAccel.name, err)
+
+		return s.runFrame(frameArgs(path, input, info, at, allHWInfos[HWAccelNone], filter, codecArgs))
+	}
+
+	return frame, err
+}
+
+func (s *Service) runFrame(args []string) ([]byte, error) {
+	cmd := exec.Command(s.config.FFMpegPath, args...)
+	s.logger.Debugf("frame command: %v", cmd.String())
+
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	frame, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if len(frame) == 0 {
+		return nil, ErrInvalidSeek
+	}
+
+	return frame, nil
+}
+
+// frameArgs returns the args of ffmpeg, input is the input options of the source.
+func frameArgs(path string, input []string, info *ProbeInfo, at float64, hwAccel hwInfo, filter string, codecArgs []string) []string {
+	args := []string{
+		"-loglevel", "error",
+		// the rotation is done by our filter, autorotate doesn't work with the frames in gpu memory.
+		"-noautorotate",
+		"-ss", fmt.Sprintf("%.3f", at),
+	}
+	if len(hwAccel.decoderArgs) != 0 {
+		args = append(args, "-hwaccel")
+		args = append(args, hwAccel.decoderArgs...)
+	}
+
+	filters := []string{hwAccel.downloadFilter(info.PixelFormat)}
+	// the HDR frame is washed-out without the tonemap, it's mapped on the cpu like the SDR h264 streams.
+	if info.HDR() {
+		filters = append(filters, tonemapFilter)
+	}
+	filters = append(filters, rotateFilter(info.Rotation), filter)
+
+	args = append(args, input...)
+	args = append(args,
+		"-i", path,
+		"-an", "-sn", "-dn",
+		"-frames:v", "1",
+		"-vf", joinFilters(filters...),
+	)
+	args = append(args, codecArgs...)
+
+	return append(args, "pipe:1")
+}
+
+// rotateFilter returns the filter rotates the frame clockwise.
+func rotateFilter(rotation int) string {
+	switch rotation {
+	case 90:
+		return "transpose=clock"
+	case 180:
+		return "hflip,vflip"
+	case 270:
+		return "transpose=cclock"
+	}
+
+	return ""
+}
+
+// joinFilters joins the non-empty filters to a filter chain.
+func joinFilters(filters ...string) string {
+	chain := make([]string, 0, len(filters))
+
+	for _, f := range filters {
+		if f != "" {
+			chain = append(chain, f)
+		}
+	}
+
+	if len(chain) == 0 {
+		return "null"
+	}
+
+	return strings.Join(chain, ",")
+}
+
+func imageFilter(width int) string {
+	if width <= 0 {
+		return ""
+	}
+
+	return "scale=" + strconv.Itoa(width) + ":-2"
+}
+
+func imageCodecArgs(format string) []string {
+	switch format {
+	case ImagePNG:
+		return []string{"-c:v", "png", "-f", "image2pipe"}
+	case ImageWebP:
+		return []string{"-c:v", "libwebp", "-quality", "80", "-f", "image2pipe"}
+	}
+
+	return []string{"-c:v", "mjpeg", "-q:v", "2", "-f", "image2pipe"}
+}
+
+// frameStats returns the mean luma and the shannon entropy in bits of the gray frame.
+func frameStats(pixels []byte) (float64, float64) {
+	if len(pixels) == 0 {
+		return 0, 0
+	}
+
+	var (
+		histogram [256]int
+		sum       int
+	)
+
+	for _, p := range pixels {
+		histogram[p]++
+		sum += int(p)
+	}
+
+	var entropy float64
+
+	total := float64(len(pixels))
+	for _, count := range histogram {
+		if count == 0 {
+			continue
+		}
+
+		p := float64(count) / total
+		entropy -= p * math.Log2(p)
+	}
+
+	return float64(sum) / total, entropy
+}
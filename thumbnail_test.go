@@ -0,0 +1,55 @@
+package vod
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameStats(t *testing.T) {
+	luma, entropy := frameStats(make([]byte, 100))
+	assert.Equal(t, 0.0, luma)
+	assert.Equal(t, 0.0, entropy)
+
+	pixels := make([]byte, 256)
+	for i := range pixels {
+		pixels[i] = byte(i)
+	}
+	luma, entropy = frameStats(pixels)
+	assert.Equal(t, 127.5, luma)
+	assert.InDelta(t, 8.0, entropy, 1e-9)
+}
+
+func TestResolveRotation(t *testing.T) {
+	result := &ProbeResult{}
+	err := json.Unmarshal([]byte(`{"streams":[{"codec_type":"video","side_data_list":[{"side_data_type":"Display Matrix","rotation":-90}]}]}`), result)
+	assert.NoError(t, err)
+	assert.Equal(t, 90, resolveRotation(result.Streams[0].Tags.Rotate, result.Streams[0].SideDataList))
+
+	assert.Equal(t, 270, resolveRotation("270", nil))
+	assert.Equal(t, 180, resolveRotation("", []probeSideData{{Rotation: 180}}))
+	assert.Equal(t, 0, resolveRotation("", nil))
+}
+
+func TestFrameArgs(t *testing.T) {
+	info := &ProbeInfo{Duration: 60, Width: 1920, Height: 1080, Rotation: 90}
+	w, h := info.displaySize()
+	assert.Equal(t, []int{1080, 1920}, []int{w, h})
+
+	args := frameArgs("in.mp4", nil, info, 12.5, allHWInfos[HWAccelVAAPI], imageFilter(320), imageCodecArgs(ImagePNG))
+	assert.Subset(t, args, []string{"-noautorotate", "-ss", "12.500", "-frames:v", "1", "-c:v", "png", "pipe:1"})
+	assert.Contains(t, args, "hwdownload,format=nv12,transpose=clock,scale=320:-2")
+
+	// the 10-bit HDR frame is downloaded in p010, then tonemapped.
+	hdr := &ProbeInfo{Duration: 60, Width: 3840, Height: 2160, PixelFormat: "yuv420p10le", ColorTransfer: transferPQ}
+	args = frameArgs("in.mp4", nil, hdr, 1, allHWInfos[HWAccelVAAPI], imageFilter(320), imageCodecArgs(ImageJPEG))
+	assert.Contains(t, args, "hwdownload,format=p010le,"+tonemapFilter+",scale=320:-2")
+	args = frameArgs("in.mp4", nil, hdr, 1, allHWInfos[HWAccelNone], imageFilter(0), imageCodecArgs(ImageJPEG))
+	assert.Contains(t, args, tonemapFilter)
+
+	args = frameArgs("in.mp4", nil, &ProbeInfo{}, 1, allHWInfos[HWAccelNone], imageFilter(0), imageCodecArgs(ImageJPEG))
+	assert.Contains(t, args, "null")
+	assert.NotContains(t, args, "-hwaccel")
+	assert.Equal(t, "image/webp", ImageMimeType(ImageWebP))
+}
@@ -0,0 +1,304 @@
+package vod
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+const (
+	defaultTrickplayInterval = 10
+	defaultTrickplayWidth    = 320
+	defaultTrickplayGrid     = 10
+	trickplayDir             = "trickplay"
+)
+
+var ErrTrickplayDisabled = errors.New("trickplay is disabled")
+
+// TrickplayConfig configures the thumbnail sprite sheets used by the players for scrubbing previews.
+// Every sprite sheet is a Columns x Rows grid of thumbnails, one thumbnail every Interval seconds.
+type TrickplayConfig struct {
+	Interval int    // in second, default is 10
+	Width    int    // width of a thumbnail, the height keeps the aspect ratio, default is 320
+	Columns  int    // default is 10
+	Rows     int    // default is 10
+	Format   string // ImageJPEG or ImageWebP, default is ImageJPEG
+}
+
+func (t TrickplayConfig) withDefault() TrickplayConfig {
+	if t.Interval <= 0 {
+		t.Interval = defaultTrickplayInterval
+	}
+	if t.Width <= 0 {
+		t.Width = defaultTrickplayWidth
+	}
+	if t.Columns <= 0 {
+		t.Columns = defaultTrickplayGrid
+	}
+	if t.Rows <= 0 {
+		t.Rows = defaultTrickplayGrid
+	}
+	if t.Format != ImageWebP {
+		t.Format = ImageJPEG
+	}
+
+	return t
+}
+
+// SpriteGenerator generates the uri of the sprite sheet, used by the WebVTT thumbnail track and the image playlist.
+type SpriteGenerator func(index int, context *Context) string
+
+func DefaultSpriteGenerator(index int, context *Context) string {
+	return fmt.Sprintf("/video/sprite?id=%s&index=%d", context.ID(), index)
+}
+
+// trickplay generates the sprite sheets of the context lazily, every sheet is generated by its own ffmpeg process.
+type trickplay struct {
+	m      sync.Mutex
+	config TrickplayConfig
+	width  int
+	height int
+	count  int // number of thumbnails
+	sheets map[int]string
+}
+
+func newTrickplay(config TrickplayConfig, info *ProbeInfo) *trickplay {
+	config = config.withDefault()
+
+	t := &trickplay{
+		config: config,
+		width:  config.Width,
+		height: config.Width,
+		count:  int(math.Ceil(info.Duration / float64(config.Interval))),
+		sheets: make(map[int]string),
+	}
+	if width, height := info.displaySize(); width > 0 && height > 0 {
+		// the encoders require even sizes.
+		t.height = int(math.Round(float64(config.Width)*float64(height)/float64(width)/2)) * 2
+	}
+
+	return t
+}
+
+func (t *trickplay) perSheet() int {
+	return t.config.Columns * t.config.Rows
+}
+
+func (t *trickplay) sheetCount() int {
+	return (t.count + t.perSheet() - 1) / t.perSheet()
+}
+
+// SpriteMimeType returns the mime type of the sprite sheets.
+func (c *Context) SpriteMimeType() string {
+	if c.trickplay == nil {
+		return ImageMimeType(ImageJPEG)
+	}
+
+	return ImageMimeType(c.trickplay.config.Format)
+}
+
+// SpriteCount returns the number of sprite sheets, it's 0 if trickplay is disabled.
+func (c *Context) SpriteCount() int {
+	if c.trickplay == nil {
+		return 0
+	}
+
+	return c.trickplay.sheetCount()
+}
+
+// Sprite returns the sprite sheet of the index, it's generated on the first request.
+func (c *Context) Sprite(index int) (io.ReadCloser, error) {
+	c.access()
+
+	if c.trickplay == nil {
+		return nil, ErrTrickplayDisabled
+	}
+	if index < 0 || index >= c.trickplay.sheetCount() {
+		return nil, ErrInvalidIndex
+	}
+
+	path, err := c.generateSprite(index)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(path)
+}
+
+// Thumbnails returns the WebVTT thumbnail track, every cue is the region of the sprite sheet.
+func (c *Context) Thumbnails() (io.ReadCloser, error) {
+	c.access()
+
+	t := c.trickplay
+	if t == nil {
+		return nil, ErrTrickplayDisabled
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("WEBVTT\n\n")
+
+	for i := 0; i < t.count; i++ {
+		start := float64(i * t.config.Interval)
+		end := math.Min(float64((i+1)*t.config.Interval), c.info.Duration)
+		pos := i % t.perSheet()
+
+		buf.WriteString(fmt.Sprintf("%s --> %s\n", vttTime(start), vttTime(end)))
+		buf.WriteString(fmt.Sprintf("%s#xywh=%d,%d,%d,%d\n\n",
+			c.contextConfig.SpriteGenerator(i/t.perSheet(), c),
+			pos%t.config.Columns*t.width, pos/t.config.Columns*t.height, t.width, t.height,
+		))
+	}
+
+	return io.NopCloser(buf), nil
+}
+
+// TrickplayPlaylist returns the image media playlist of the sprite sheets, referenced by #EXT-X-IMAGE-STREAM-INF.
+func (c *Context) TrickplayPlaylist() (io.ReadCloser, error) {
+	c.access()
+
+	t := c.trickplay
+	if t == nil {
+		return nil, ErrTrickplayDisabled
+	}
+
+	span := t.perSheet() * t.config.Interval
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("#EXTM3U\n")
+	buf.WriteString("#EXT-X-VERSION:7\n")
+	buf.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", span))
+	buf.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	buf.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	buf.WriteString("#EXT-X-IMAGES-ONLY\n")
+
+	for i := 0; i < t.sheetCount(); i++ {
+		start := float64(i * span)
+		duration := math.Min(float64(span), c.info.Duration-start)
+
+		// the last sheet is padded by the tile filter, so the layout is the same.
+		buf.WriteString(fmt.Sprintf("#EXT-X-TILES:RESOLUTION=%dx%d,LAYOUT=%dx%d,DURATION=%.3f\n",
+			t.width, t.height, t.config.Columns, t.config.Rows, float64(t.config.Interval)))
+		buf.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", duration))
+		buf.WriteString(c.contextConfig.SpriteGenerator(i, c) + "\n")
+	}
+
+	buf.WriteString("#EXT-X-ENDLIST\n")
+
+	return io.NopCloser(buf), nil
+}
+
+// trickplayStreamLine returns the EXT-X-IMAGE-STREAM-INF line of the master playlist.
+func (c *Context) trickplayStreamLine() string {
+	t := c.trickplay
+	codec := "jpeg"
+	if t.config.Format == ImageWebP {
+		codec = "webp"
+	}
+	// about 0.1 byte per pixel for the compressed images.
+	bandwidth := t.width * t.height * 8 / 10 / t.config.Interval
+
+	return fmt.Sprintf("#EXT-X-IMAGE-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"%s\",URI=\"trickplay.m3u8?id=%s\"\n",
+		bandwidth, t.width*t.config.Columns, t.height*t.config.Rows, codec, c.ID())
+}
+
+// generateSprite runs ffmpeg for the sheet, only the keyframes are decoded, so it's fast enough to do it on request.
+func (c *Context) generateSprite(index int) (string, error) {
+	t := c.trickplay
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if path, ok := t.sheets[index]; ok {
+		return path, nil
+	}
+
+	dir := filepath.Join(c.contextConfig.TmpPath, trickplayDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	hwAccel, ok := allHWInfos[c.contextConfig.HWAccel]
+	if !ok {
+		hwAccel = allHWInfos[HWAccelNone]
+	}
+
+	output := filepath.Join(dir, fmt.Sprintf("%d.%s", index, t.config.Format))
+	err := c.runSprite(index, c.spriteArgs(index, output, hwAccel))
+	if err != nil && len(hwAccel.decoderArgs) != 0 {
+		c.logger.Warnf("failed to generate sprite %d by %s, fallback to software: %v", index, hwAccel.name, err)
+
+		err = c.runSprite(index, c.spriteArgs(index, output, allHWInfos[HWAccelNone]))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	t.sheets[index] = output
+
+	return output, nil
+}
+
+func (c *Context) runSprite(index int, args []string) error {
+	cmd := exec.Command(c.contextConfig.FFMpegPath, args...)
+	c.logger.Debugf("sprite command: %v", cmd.String())
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("generate sprite %d: %w: %s", index, err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
+
+func (c *Context) spriteArgs(index int, output string, hwAccel hwInfo) []string {
+	t := c.trickplay
+	span := t.perSheet() * t.config.Interval
+
+	args := []string{
+		"-loglevel", "error",
+		"-noautorotate",
+		"-skip_frame", "nokey",
+	}
+	if index > 0 {
+		args = append(args, "-ss", strconv.Itoa(index*span))
+	}
+	if len(hwAccel.decoderArgs) != 0 {
+		args = append(args, "-hwaccel")
+		args = append(args, hwAccel.decoderArgs...)
+	}
+
+	args = append(args, c.contextConfig.inputArgs(c.path)...)
+	args = append(args,
+		"-t", strconv.Itoa(span),
+		"-i", c.path,
+		"-y",
+		"-an", "-sn",
+		"-vf", joinFilters(
+			hwAccel.downloadFilter(c.info.PixelFormat),
+			rotateFilter(c.info.Rotation),
+			fmt.Sprintf("fps=1/%d,scale=%d:%d,tile=%dx%d", t.config.Interval, t.width, t.height, t.config.Columns, t.config.Rows),
+		),
+		"-frames:v", "1",
+	)
+
+	if t.config.Format == ImageWebP {
+		args = append(args, "-c:v", "libwebp", "-quality", "75")
+	} else {
+		args = append(args, "-c:v", "mjpeg", "-q:v", "4")
+	}
+
+	return append(args, output)
+}
+
+// vttTime formats seconds to hh:mm:ss.ttt.
+func vttTime(seconds float64) string {
+	ms := int(math.Round(seconds * 1000))
+
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,73 @@
+package vod
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrickplayThumbnailsAndPlaylist(t *testing.T) {
+	config := &ContextConfig{
+		Format:    FormatHLS,
+		Trickplay: &TrickplayConfig{Interval: 5, Width: 160, Columns: 2, Rows: 2},
+	}
+	info := &ProbeInfo{Duration: 22, Width: 1920, Height: 1080, VideoCodec: "h264", AudioCodec: "aac"}
+	context := newTestContext(t, "trick", config, info)
+	assert.Equal(t, 2, context.SpriteCount())
+	assert.Equal(t, "image/jpeg", context.SpriteMimeType())
+
+	r, err := context.Thumbnails()
+	vtt := readAll(t, r, err)
+	assert.Contains(t, vtt, "00:00:05.000 --> 00:00:10.000\n/video/sprite?id=trick&index=0#xywh=160,0,160,90\n")
+	assert.Contains(t, vtt, "00:00:20.000 --> 00:00:22.000\n/video/sprite?id=trick&index=1#xywh=0,0,160,90\n")
+
+	r, err = context.TrickplayPlaylist()
+	playlist := readAll(t, r, err)
+	assert.Contains(t, playlist, "#EXT-X-IMAGES-ONLY\n")
+	assert.Contains(t, playlist, "#EXT-X-TILES:RESOLUTION=160x90,LAYOUT=2x2,DURATION=5.000\n#EXTINF:2.000,\n/video/sprite?id=trick&index=1\n")
+
+	// the single stream is served by the master playlist, so the image stream could be advertised.
+	r, err = context.Content()
+	master := readAll(t, r, err)
+	assert.Contains(t, master, `#EXT-X-IMAGE-STREAM-INF:BANDWIDTH=2304,RESOLUTION=320x180,CODECS="jpeg",URI="trickplay.m3u8?id=trick"`)
+
+	_, err = context.Sprite(2)
+	assert.ErrorIs(t, err, ErrInvalidIndex)
+
+	args := context.spriteArgs(1, "out.jpg", allHWInfos[HWAccelNone])
+	assert.Subset(t, args, []string{"-skip_frame", "nokey", "-ss", "20", "-t", "20", "-frames:v", "1", "out.jpg"})
+	assert.Contains(t, args, "fps=1/5,scale=160:90,tile=2x2")
+}
+
+func TestTrickplayDisabled(t *testing.T) {
+	context := newTestContext(t, "no-trick", nil, &ProbeInfo{Duration: 10, Width: 640, Height: 360})
+	_, err := context.Thumbnails()
+	assert.ErrorIs(t, err, ErrTrickplayDisabled)
+	assert.Equal(t, 0, context.SpriteCount())
+}
+
+func TestSpriteFallsBackToSoftware(t *testing.T) {
+	// the hardware decoder fails, the software one writes the sheet.
+	ffmpeg, runs := newFakeFFMpeg(t, "case \"$*\" in *-hwaccel*) exit 1 ;; esac\nfor last; do :; done\necho sheet > \"$last\"")
+	config := &ContextConfig{
+		Format:     FormatHLS,
+		FFMpegPath: ffmpeg,
+		HWAccel:    HWAccelVAAPI,
+		Trickplay:  &TrickplayConfig{Interval: 5, Width: 160, Columns: 2, Rows: 2},
+	}
+	info := &ProbeInfo{Duration: 22, Width: 3840, Height: 2160, VideoCodec: "hevc", AudioCodec: "aac", PixelFormat: "yuv420p10le"}
+	context := newTestContext(t, "trick-fallback", config, info)
+
+	// the 10-bit frames are downloaded in p010.
+	assert.Contains(t, strings.Join(context.spriteArgs(0, "out.jpg", allHWInfos[HWAccelVAAPI]), " "),
+		"-vf hwdownload,format=p010le,fps=1/5")
+
+	r, err := context.Sprite(0)
+	assert.Equal(t, "sheet\n", readAll(t, r, err))
+
+	if calls := countRuns(t, runs); assert.Len(t, calls, 2) {
+		assert.Contains(t, calls[0], "-hwaccel vaapi")
+		assert.NotContains(t, calls[1], "-hwaccel")
+	}
+}
@@ -0,0 +1,88 @@
+package vod
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testProbeInfo returns the probe of a 20s 1080p h264 and aac video.
+func testProbeInfo() *ProbeInfo {
+	return &ProbeInfo{Duration: 20, Width: 1920, Height: 1080, VideoCodec: "h264", AudioCodec: "aac"}
+}
+
+// newTestContext creates a hls context without requiring ffmpeg, the config could be nil.
+func newTestContext(t *testing.T, id string, config *ContextConfig, info *ProbeInfo) *Context {
+	t.Helper()
+
+	if config == nil {
+		config = &ContextConfig{}
+	}
+	if config.Format == "" {
+		config.Format = FormatHLS
+	}
+	if len(config.StreamSpec) == 0 {
+		config.StreamSpec = []StreamSpec{Origin}
+	}
+	if len(config.SupportVideoCodec) == 0 {
+		config.SupportVideoCodec = []string{"h264"}
+	}
+	if len(config.SupportAudioCodec) == 0 {
+		config.SupportAudioCodec = []string{"aac"}
+	}
+	config.TmpPath = t.TempDir()
+	setHLSDefaultValue(config)
+
+	context, err := newContext(id, "testdata/test.flv", config, info, nil, NewEmptyLogger())
+	assert.NoError(t, err)
+
+	return context
+}
+
+// newTestService creates a service without requiring ffmpeg, the ids are added as the hls contexts of testProbeInfo.
+// The service is stopped when the test ends.
+func newTestService(t *testing.T, ids ...string) *Service {
+	t.Helper()
+
+	service := &Service{contexts: make(map[string]*Context), keyframes: make(map[string]keyframeCache), logger: NewEmptyLogger()}
+	t.Cleanup(func() { _ = service.Stop() })
+
+	for _, id := range ids {
+		addTestContext(t, service, id, nil, testProbeInfo())
+	}
+
+	return service
+}
+
+// addTestContext creates a context by newTestContext and adds it to the service like createContext,
+// so the parts of the service like events should be set before.
+func addTestContext(t *testing.T, service *Service, id string, config *ContextConfig, info *ProbeInfo) *Context {
+	t.Helper()
+
+	context := newTestContext(t, id, config, info)
+	context.onClose = service.stopContext
+	context.cache = service.cache
+	context.admission = service.admission
+	context.load = service.load
+	context.events = service.events
+	context.metrics = service.metrics
+
+	service.m.Lock()
+	service.contexts[id] = context
+	service.m.Unlock()
+
+	return context
+}
+
+func readAll(t *testing.T, r io.ReadCloser, err error) string {
+	t.Helper()
+
+	assert.NoError(t, err)
+	defer r.Close()
+
+	content, err := io.ReadAll(r)
+	assert.NoError(t, err)
+
+	return string(content)
+}